@@ -0,0 +1,286 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// AppConfig configures an App, see NewApp.
+type AppConfig struct {
+	// Addr is the address the server listens on, Fiber configures the Fiber app and Options the server, see NewServer.
+	Addr    string
+	Fiber   fiber.Config
+	Options []Option
+	// Postgres selects the PostgreSQL database configured by DB instead of the in-memory storage. With StartUnready, the server starts
+	// before the database can be reached and reports not ready until it can, the tasks which need the database only start then.
+	Postgres     bool
+	DB           storage.DBConfig
+	StartUnready bool
+	// TrashRetention is how long deleted books are kept in the trash before they are purged, 0 keeps them forever. The trash is checked every PurgeInterval.
+	TrashRetention time.Duration
+	PurgeInterval  time.Duration
+	Webhooks       WebhookConfig
+	// CacheSize is the number of books which are cached for reads for at most CacheTTL, 0 disables the cache.
+	CacheSize int
+	CacheTTL  time.Duration
+	// OutboxInterval is how often the outbox is relayed to the webhooks and the OutboxSinks, and ViewFlushInterval how often the views of books
+	// are written to the database. Both are only used with PostgreSQL.
+	OutboxInterval    time.Duration
+	ViewFlushInterval time.Duration
+	OutboxSinks       []storage.OutboxSink
+	// ShutdownTimeout is how long requests in flight and background tasks may take to finish on shutdown, including the shutdown delay.
+	ShutdownTimeout time.Duration
+}
+
+// App is a server together with its storage and the tasks which run in the background of both, e.g. purging the trash,
+// delivering webhooks and keeping the cache up to date. It is started with Run.
+type App struct {
+	server          *Server
+	db              *sql.DB
+	background      *workers
+	bootstrapKey    string
+	shutdownTimeout time.Duration
+}
+
+// NewApp returns an App for the given configuration and starts its background tasks. With PostgreSQL, the database is waited for
+// as configured, unless the app starts unready. The in-memory storage starts out without keys, so it gets a bootstrap key with every scope, see BootstrapKey.
+func NewApp(ctx context.Context, config AppConfig) (*App, error) {
+	if config.Postgres {
+		var db *sql.DB
+		var err error
+		if config.StartUnready {
+			db, err = storage.NewDB(config.DB)
+		} else {
+			db, err = storage.OpenDB(ctx, config.DB)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newPostgresApp(db, config), nil
+	}
+
+	app := &App{background: newWorkers(), shutdownTimeout: config.ShutdownTimeout}
+	store := storage.NewInMemoryStorage()
+	key, err := IssueAPIKey(ctx, store, "bootstrap", data.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("issuing bootstrap api key: %w", err)
+	}
+	app.bootstrapKey = key.Key
+	startPurger(app.background, store, config.TrashRetention, config.PurgeInterval)
+	startWebhookDispatcher(app.background, store, store, config.Webhooks)
+	metrics := NewMetrics()
+	decorated, checkers := decorate(app.background, store, metrics, config.CacheSize, config.CacheTTL)
+	app.server = NewServer(decorated, config.Addr, config.Fiber, withAppOptions(config.Options, WithMetrics(metrics), WithCheckers(checkers...))...)
+	return app, nil
+}
+
+// newPostgresApp returns an App which stores its books in the given database and starts its background tasks, see NewApp.
+func newPostgresApp(db *sql.DB, config AppConfig) *App {
+	app := &App{db: db, background: newWorkers(), shutdownTimeout: config.ShutdownTimeout}
+	store := storage.NewPostgresqlStorage(db)
+	metrics := NewMetrics()
+	metrics.RegisterDB(db, "postgres")
+	startTasks := func() {
+		startPurger(app.background, store, config.TrashRetention, config.PurgeInterval)
+		// events are enqueued for webhooks by the outbox relay, so they are not lost if the server crashes
+		dispatcher := startWebhookDispatcher(app.background, store, nil, config.Webhooks)
+		sinks := append([]storage.OutboxSink{storage.OutboxSinkFunc(dispatcher.Enqueue)}, config.OutboxSinks...)
+		startOutboxRelay(app.background, store, config.OutboxInterval, sinks)
+		startListener(app.background, store, config.DB.ConnectionString())
+		startViewFlusher(app.background, store, config.ViewFlushInterval)
+	}
+	if config.StartUnready {
+		// the readiness checks fail until the database can be reached, the tasks which need it only start then
+		startWhenConnected(app.background, db, config.DB, startTasks)
+	} else {
+		startTasks()
+	}
+	decorated, checkers := decorate(app.background, store, metrics, config.CacheSize, config.CacheTTL)
+	app.server = NewServer(decorated, config.Addr, config.Fiber, withAppOptions(config.Options, WithMetrics(metrics), WithCheckers(checkers...), WithCheckers(
+		Checker{Name: "postgres", Check: store.Ping, Required: true},
+		Checker{Name: "schema", Check: store.CheckSchema, Required: true},
+	))...)
+	return app
+}
+
+// withAppOptions returns the options of the app's configuration followed by those of the app itself, without changing the configured ones.
+func withAppOptions(configured []Option, opts ...Option) []Option {
+	return append(append([]Option(nil), configured...), opts...)
+}
+
+// BootstrapKey returns the API key with every scope which was issued for the in-memory storage, or an empty string with PostgreSQL.
+func (app *App) BootstrapKey() string {
+	return app.bootstrapKey
+}
+
+// Run serves requests until the context is done or serving fails. Then the server is shut down gracefully, see Server.Shutdown,
+// the background tasks are stopped and the database is closed, within the shutdown timeout.
+func (app *App) Run(ctx context.Context) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- app.server.Start()
+	}()
+	var errs []error
+	select {
+	case err := <-served:
+		errs = append(errs, fmt.Errorf("serving: %w", err))
+	case <-ctx.Done():
+		slog.Info("shutting down", "delay", app.server.shutdownDelay, "timeout", app.shutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.shutdownTimeout)
+	defer cancel()
+	if err := app.server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("draining requests: %w", err))
+	}
+	if err := app.background.stop(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("stopping background tasks: %w", err))
+	}
+	if app.db != nil {
+		if err := app.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing database: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// workers runs the tasks of the app in the background until they are stopped.
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWorkers returns workers which do not run any tasks yet.
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// start runs a task in the background until the workers are stopped. Its errors are logged.
+func (w *workers) start(task string, run func(ctx context.Context, report func(error))) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx, logError(task))
+	}()
+}
+
+// stop stops all tasks and waits until they have finished, e.g. flushed what they have in flight, or until the context is done.
+func (w *workers) stop(ctx context.Context) error {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logError returns a function which logs the errors of a task running in the background.
+func logError(task string) func(error) {
+	return func(err error) {
+		slog.Error("background task failed", "task", task, "error", err)
+	}
+}
+
+// decorate instruments the given storage for the metrics and adds a cache for books on top, which is warmed up and invalidated by the change events
+// of the storage in the background. A size of 0 disables the cache. See storage.InstrumentedStorage and storage.CachedStorage.
+// The returned checkers keep the server unready until the cache is warm.
+func decorate(background *workers, store storage.Storage, metrics *Metrics, size int, ttl time.Duration) (storage.Storage, []Checker) {
+	instrumented := storage.NewInstrumentedStorage(store, metrics.ObserveOperation)
+	if size <= 0 {
+		return instrumented, nil
+	}
+	cache := storage.NewCachedStorage(instrumented, size, ttl)
+	metrics.RegisterCache(cache)
+	background.start("invalidating cache", cache.RunInvalidation)
+	background.start("warming up cache", func(ctx context.Context, report func(error)) {
+		warmUp(ctx, cache, report)
+	})
+	return cache, []Checker{{Name: "cache", Check: cache.CheckWarm, Required: true}}
+}
+
+// warmUp warms up the given cache, retrying until the books can be read or the context is done, see storage.CachedStorage.Warm.
+func warmUp(ctx context.Context, cache *storage.CachedStorage, report func(error)) {
+	for {
+		err := cache.Warm(ctx)
+		if err == nil {
+			return
+		}
+		report(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// startPurger purges books from the trash of the given storage in the background, see storage.RunPurger.
+func startPurger(background *workers, store storage.TrashStorage, retention time.Duration, interval time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	background.start("purger", func(ctx context.Context, report func(error)) {
+		storage.RunPurger(ctx, store, retention, interval, report)
+	})
+}
+
+// startWebhookDispatcher delivers change events to the webhooks of the given storage in the background, see WebhookDispatcher.
+// Without events, they have to be enqueued with the returned dispatcher.
+func startWebhookDispatcher(background *workers, store storage.WebhookStorage, events storage.EventStorage, config WebhookConfig) *WebhookDispatcher {
+	dispatcher := NewWebhookDispatcher(store, config)
+	background.start("webhook dispatcher", func(ctx context.Context, report func(error)) {
+		dispatcher.Run(ctx, events, report)
+	})
+	return dispatcher
+}
+
+// startOutboxRelay relays the outbox of the given storage to the sinks in the background, see storage.PostgresqlStorage.RunOutboxRelay.
+func startOutboxRelay(background *workers, store *storage.PostgresqlStorage, interval time.Duration, sinks []storage.OutboxSink) {
+	background.start("outbox relay", func(ctx context.Context, report func(error)) {
+		store.RunOutboxRelay(ctx, interval, report, sinks...)
+	})
+}
+
+// startListener applies the changes made through other servers to the given storage in the background, see storage.PostgresqlStorage.RunListener.
+func startListener(background *workers, store *storage.PostgresqlStorage, connectionString string) {
+	background.start("listener", func(ctx context.Context, report func(error)) {
+		store.RunListener(ctx, connectionString, report)
+	})
+}
+
+// startViewFlusher writes the views of books counted by the given storage to the database in the background, see storage.PostgresqlStorage.RunViewFlusher.
+func startViewFlusher(background *workers, store *storage.PostgresqlStorage, interval time.Duration) {
+	background.start("view flusher", func(ctx context.Context, report func(error)) {
+		store.RunViewFlusher(ctx, interval, report)
+	})
+}
+
+// startWhenConnected keeps trying to reach the given database in the background, without giving up, and calls start once it can be reached.
+// See storage.WaitForDB.
+func startWhenConnected(background *workers, db *sql.DB, config storage.DBConfig, start func()) {
+	config.Retry.MaxAttempts = 0
+	background.start("connecting to postgres", func(ctx context.Context, report func(error)) {
+		// without a limit of attempts, waiting only fails once the workers are stopped
+		if err := storage.WaitForDB(ctx, db, config); err != nil {
+			return
+		}
+		start()
+	})
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/torbendury/books-go/storage"
+)
+
+// freeAddress returns a local address which nothing listens on right now.
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// testAppConfig returns the configuration of an app which listens on a free local address and does not log.
+func testAppConfig(t *testing.T) AppConfig {
+	return AppConfig{
+		Addr:            freeAddress(t),
+		Fiber:           fiber.Config{DisableStartupMessage: true},
+		Options:         []Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))), WithAuditLog(io.Discard)},
+		TrashRetention:  time.Hour,
+		PurgeInterval:   time.Hour,
+		Webhooks:        WebhookConfig{MaxAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Second, Timeout: time.Second},
+		CacheSize:       10,
+		CacheTTL:        time.Minute,
+		ShutdownTimeout: 5 * time.Second,
+	}
+}
+
+// waitForStatus requests the target until it is answered with the given status or a second has passed, and returns the last status.
+// Connections are not kept alive, since they would hold up the shutdown of the app.
+func waitForStatus(target string, key string, status int) int {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	last := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		req, _ := http.NewRequest("GET", target, nil)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if last = resp.StatusCode; last == status {
+			break
+		}
+	}
+	return last
+}
+
+func TestApp(t *testing.T) {
+	config := testAppConfig(t)
+	app, err := NewApp(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := app.BootstrapKey()
+	assert.NotEmpty(t, key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- app.Run(ctx) }()
+	base := "http://" + config.Addr
+
+	// the app becomes ready once the cache is warm, and the bootstrap key grants access
+	assert.Equal(t, 200, waitForStatus(base+"/readyz", "", 200))
+	assert.Equal(t, 200, waitForStatus(base+"/books", key, 200))
+	assert.Equal(t, 401, waitForStatus(base+"/books", "", 401))
+
+	// the server and the background tasks are stopped once the context is done
+	cancel()
+	select {
+	case err := <-ran:
+		assert.NoError(t, err)
+	case <-time.After(config.ShutdownTimeout):
+		t.Fatal("app was not shut down")
+	}
+	assert.Error(t, app.background.ctx.Err())
+	_, err = http.Get(base + "/readyz")
+	assert.Error(t, err)
+}
+
+func TestAppStartUnready(t *testing.T) {
+	// a database which can not be reached
+	var down atomic.Bool
+	var attempts atomic.Int32
+	down.Store(true)
+	config := testAppConfig(t)
+	config.Postgres = true
+	config.StartUnready = true
+	config.CacheSize = 0
+	config.DB = storage.DBConfig{Host: "db", Port: 5432, Name: "books", Retry: storage.RetryConfig{BaseDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond}}
+	app := newPostgresApp(sql.OpenDB(flakyConnector{down: &down, attempts: &attempts}), config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- app.Run(ctx) }()
+
+	// the app serves, but is not ready while the database is tried again in the background
+	assert.Equal(t, 503, waitForStatus("http://"+config.Addr+"/readyz", "", 503))
+	assert.Equal(t, 200, waitForStatus("http://"+config.Addr+"/livez", "", 200))
+	assert.Greater(t, attempts.Load(), int32(1))
+
+	// waiting for the database does not hold up the shutdown
+	cancel()
+	select {
+	case err := <-ran:
+		assert.NoError(t, err)
+	case <-time.After(config.ShutdownTimeout):
+		t.Fatal("app was not shut down")
+	}
+}
+
+func Test_workers(t *testing.T) {
+	background := newWorkers()
+	release := make(chan struct{})
+	var stopped atomic.Bool
+	background.start("stubborn", func(ctx context.Context, report func(error)) {
+		<-ctx.Done()
+		<-release
+		stopped.Store(true)
+	})
+
+	// stopping gives up once the context is done, the tasks are still told to stop
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, background.stop(ctx), context.DeadlineExceeded)
+	assert.False(t, stopped.Load())
+
+	// once the tasks have finished, stopping succeeds
+	close(release)
+	assert.NoError(t, background.stop(context.Background()))
+	assert.True(t, stopped.Load())
+}
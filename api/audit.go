@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// storageContext returns the context for changes to the storage. It names the authenticated principal as actor
+// and carries the ID of the request, so both end up in the audit log.
+func (s *Server) storageContext(c *fiber.Ctx) context.Context {
+	actor := "anonymous"
+	if principal := PrincipalFrom(c); principal != nil {
+		actor = principal.Subject
+	}
+	return storage.WithRequestID(storage.WithActor(c.UserContext(), actor), requestID(c))
+}
+
+// handleGetBookHistory returns a page of the changes to the requested book, newest first.
+// The history of a book remains available after the book has been deleted.
+func (s *Server) handleGetBookHistory(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	page, size, err := pagination(c)
+	if err != nil {
+		return err
+	}
+	history, err := s.store.AuditEvents(c.UserContext(), data.AuditFilter{
+		Entity:   data.AuditEntityBook,
+		EntityID: id,
+		Page:     page,
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(history)
+}
+
+// handleGetAuditEvents returns a page of the audit log, newest first. Events can be filtered by the query parameters
+// actor, action, entity, entityId, since and until. Timestamps are expected in RFC 3339 format.
+func (s *Server) handleGetAuditEvents(c *fiber.Ctx) error {
+	page, size, err := pagination(c)
+	if err != nil {
+		return err
+	}
+	filter := data.AuditFilter{
+		Actor:    c.Query("actor"),
+		Action:   c.Query("action"),
+		Entity:   c.Query("entity"),
+		EntityID: c.QueryInt("entityId"),
+		Page:     page,
+		Size:     size,
+	}
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(param); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+			}
+		}
+	}
+	events, err := s.store.AuditEvents(c.UserContext(), filter)
+	if err != nil {
+		return err
+	}
+	return c.JSON(events)
+}
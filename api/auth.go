@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// APIKeyHeader is the request header which carries the API key.
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix marks secrets as API keys of this application, which makes leaked keys easy to spot.
+const apiKeyPrefix = "bgo_"
+
+// localPrincipal is the key under which the authenticated principal is stored in the locals of a request.
+const localPrincipal = "principal"
+
+// hashAPIKey returns the hex encoded SHA-256 hash of an API key secret, which is what the storage keeps.
+// API keys are long random secrets, so a fast hash is sufficient and allows looking keys up by their hash.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret generates a new random API key secret. It returns the secret and the prefix which is stored to tell keys apart.
+func newAPIKeySecret() (string, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(random)
+	return secret, secret[:len(apiKeyPrefix)+8], nil
+}
+
+// IssueAPIKey creates a new API key with the given name and scopes. The returned secret is not stored and can not be recovered later.
+func IssueAPIKey(ctx context.Context, store storage.KeyStorage, name string, scopes []string) (*data.IssuedAPIKey, error) {
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.CreateAPIKey(ctx, &data.APIKey{Name: name, Prefix: prefix, Scopes: scopes}, hashAPIKey(secret))
+	if err != nil {
+		return nil, err
+	}
+	return &data.IssuedAPIKey{APIKey: *key, Key: secret}, nil
+}
+
+// RotateAPIKey replaces the secret of an existing API key. The old secret stops working immediately.
+func RotateAPIKey(ctx context.Context, store storage.KeyStorage, id int) (*data.IssuedAPIKey, error) {
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.RotateAPIKey(ctx, id, prefix, hashAPIKey(secret))
+	if err != nil {
+		return nil, err
+	}
+	return &data.IssuedAPIKey{APIKey: *key, Key: secret}, nil
+}
+
+// Principal is the authenticated caller of a request, identified either by an API key or by a bearer token.
+// Claims is only set for bearer tokens and APIKey only for API keys. Publisher is read from the publisher claim of bearer tokens.
+type Principal struct {
+	Subject   string
+	Scopes    []string
+	Roles     []string
+	Publisher string
+	Claims    *Claims
+	APIKey    *data.APIKey
+}
+
+// HasScope reports whether the principal was granted the given scope.
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+// HasRole reports whether the principal has the given role.
+func (p *Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+// contains reports whether the slice contains the given string.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalFrom returns the principal which was authenticated for the request, or nil for routes without authentication.
+func PrincipalFrom(c *fiber.Ctx) *Principal {
+	principal, _ := c.Locals(localPrincipal).(*Principal)
+	return principal
+}
+
+// authenticate identifies the caller of a request by a bearer token in the Authorization header or by an API key.
+// Bearer tokens are only accepted if the server was configured with a JWTVerifier.
+func (s *Server) authenticate(c *fiber.Ctx) (*Principal, error) {
+	if authorization := c.Get(fiber.HeaderAuthorization); authorization != "" {
+		token, found := strings.CutPrefix(authorization, "Bearer ")
+		if !found || s.jwt == nil {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+		claims, err := s.jwt.Verify(token)
+		if err != nil {
+			return nil, err
+		}
+		publisher, _ := claims.Raw["publisher"].(string)
+		return &Principal{Subject: claims.Subject, Scopes: claims.Scopes, Roles: claims.Roles, Publisher: publisher, Claims: claims}, nil
+	}
+	secret := c.Get(APIKeyHeader)
+	if secret == "" {
+		return nil, errors.New("missing api key or bearer token")
+	}
+	key, err := s.store.GetAPIKeyByHash(c.UserContext(), hashAPIKey(secret))
+	if err != nil {
+		return nil, errors.New("invalid api key")
+	}
+	return &Principal{Subject: fmt.Sprintf("apikey:%v", key.ID), Scopes: key.Scopes, APIKey: key}, nil
+}
+
+// resourceFunc resolves the resources a request acts on, so conditional grants can be evaluated.
+// Resources which do not exist are returned as missing, the handler reports them. If they can not be looked up, they are left out.
+type resourceFunc func(c *fiber.Ctx) []Resource
+
+// authorize returns a middleware handler which is the single authorization layer of the server. It authenticates the caller
+// and only lets the request through if the policy grants the permission on the resources returned by resolve.
+// Requests without valid credentials are answered with 401 Unauthorized, denied requests with 403 Forbidden. Both are audit-logged.
+// The principal is stored in the request, see PrincipalFrom.
+func (s *Server) authorize(permission string, resolve ...resourceFunc) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal, err := s.authenticate(c)
+		if err != nil {
+			s.auditDenial(c, nil, permission, err.Error())
+			if s.jwt != nil {
+				c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			}
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		// scopes apply to every resource, so resources only have to be looked up for role grants
+		var resources []Resource
+		if !principal.HasScope(permission) {
+			for _, r := range resolve {
+				resources = append(resources, r(c)...)
+			}
+		}
+		if ok, reason := s.policy.Allows(principal, permission, resources); !ok {
+			s.auditDenial(c, principal, permission, reason)
+			return fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("permission %v denied: %v", permission, reason))
+		}
+		c.Locals(localPrincipal, principal)
+		annotateLogger(c, principal)
+		return c.Next()
+	}
+}
+
+// auditDenial writes a denied request as a single JSON line to the audit log. The principal is nil if authentication failed.
+func (s *Server) auditDenial(c *fiber.Ctx, principal *Principal, permission string, reason string) {
+	entry := struct {
+		Time       time.Time `json:"time"`
+		Event      string    `json:"event"`
+		RequestID  string    `json:"requestId"`
+		Subject    string    `json:"subject,omitempty"`
+		Roles      []string  `json:"roles,omitempty"`
+		Permission string    `json:"permission"`
+		Method     string    `json:"method"`
+		Path       string    `json:"path"`
+		IP         string    `json:"ip"`
+		Reason     string    `json:"reason"`
+	}{
+		Time:       time.Now().UTC(),
+		Event:      "access_denied",
+		RequestID:  requestID(c),
+		Permission: permission,
+		Method:     c.Method(),
+		Path:       c.Path(),
+		IP:         c.IP(),
+		Reason:     reason,
+	}
+	if principal != nil {
+		entry.Subject = principal.Subject
+		entry.Roles = principal.Roles
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	s.auditMutex.Lock()
+	defer s.auditMutex.Unlock()
+	_, _ = s.auditLog.Write(append(line, '\n'))
+}
+
+// bookOfParam resolves the book named by the id parameter of the path.
+func (s *Server) bookOfParam(c *fiber.Ctx) []Resource {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil
+	}
+	return s.storedBook(c, id)
+}
+
+// versionOfParams resolves the version of a book named by the id and n parameters of the path, i.e. the book as it is going to be stored by a revert.
+func (s *Server) versionOfParams(c *fiber.Ctx) []Resource {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil
+	}
+	n, err := c.ParamsInt("n")
+	if err != nil {
+		return nil
+	}
+	version, err := s.store.Version(c.UserContext(), id, n)
+	if storage.IsNotFound(err) {
+		return []Resource{{Missing: true}}
+	}
+	if err != nil {
+		return nil
+	}
+	return []Resource{{Publisher: version.Book.Publisher}}
+}
+
+// trashedBookOfParam resolves the deleted book named by the id parameter of the path.
+func (s *Server) trashedBookOfParam(c *fiber.Ctx) []Resource {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil
+	}
+	trash, err := s.store.Trash(c.UserContext())
+	if err != nil {
+		return nil
+	}
+	for _, book := range trash {
+		if book.ID == id {
+			return []Resource{{Publisher: book.Publisher}}
+		}
+	}
+	return []Resource{{Missing: true}}
+}
+
+// newBookOfBody resolves the book sent in the request body, i.e. the book as it is going to be stored.
+func (s *Server) newBookOfBody(c *fiber.Ctx) []Resource {
+	book := new(data.Book)
+	if err := json.Unmarshal(c.Body(), book); err != nil {
+		return nil
+	}
+	return []Resource{{Publisher: book.Publisher}}
+}
+
+// bookOfBody resolves both the stored book which is referenced by the ID in the request body and the book as it is going to be stored,
+// so a book can neither be changed nor moved to a publisher the principal does not belong to.
+func (s *Server) bookOfBody(c *fiber.Ctx) []Resource {
+	book := new(data.Book)
+	if err := json.Unmarshal(c.Body(), book); err != nil {
+		return nil
+	}
+	return append(s.storedBook(c, book.ID), Resource{Publisher: book.Publisher})
+}
+
+// storedBook resolves the stored book with the given ID.
+func (s *Server) storedBook(c *fiber.Ctx, id int) []Resource {
+	book, err := s.store.Get(c.UserContext(), id)
+	if storage.IsNotFound(err) {
+		return []Resource{{Missing: true}}
+	}
+	if err != nil {
+		return nil
+	}
+	return []Resource{{Publisher: book.Publisher}}
+}
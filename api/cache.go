@@ -0,0 +1,15 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/storage"
+)
+
+// handleGetCacheStats returns the hit and miss statistics of the book cache. If the storage is not cached, 404 is returned.
+func (s *Server) handleGetCacheStats(c *fiber.Ctx) error {
+	cache, ok := s.store.(*storage.CachedStorage)
+	if !ok {
+		return fiber.NewError(fiber.ErrNotFound.Code, "caching is disabled")
+	}
+	return c.JSON(cache.Stats())
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/torbendury/books-go/storage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is the header which carries the ID of a request, e.g. as set by a gateway. It is echoed in every response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID which is accepted from a client.
+const maxRequestIDLength = 128
+
+// localRequestID is the key under which the ID of a request is stored in the locals of a request.
+const localRequestID = "requestID"
+
+// validRequestID reports whether a request ID given by a client is accepted. IDs end up in logs and responses,
+// so they are limited to a reasonable length of letters, digits and a few separators.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of a request, as given by its RequestIDHeader. Requests without a valid ID get a random one,
+// which is kept for the rest of the request so its logs, audit events and response share it.
+func requestID(c *fiber.Ctx) string {
+	if id, ok := c.Locals(localRequestID).(string); ok {
+		return id
+	}
+	// the header value is only valid during the request, but the storage may keep it
+	id := utils.CopyString(c.Get(RequestIDHeader))
+	if !validRequestID(id) {
+		random := make([]byte, 16)
+		_, _ = rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	c.Locals(localRequestID, id)
+	return id
+}
+
+// responseHeaders lets a propagator write the trace context into the headers of a response.
+type responseHeaders struct {
+	c *fiber.Ctx
+}
+
+func (h responseHeaders) Get(key string) string {
+	return utils.CopyString(string(h.c.Response().Header.Peek(key)))
+}
+
+func (h responseHeaders) Set(key string, value string) {
+	h.c.Set(key, value)
+}
+
+func (h responseHeaders) Keys() []string {
+	var keys []string
+	h.c.Response().Header.VisitAll(func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// correlate is a middleware handler which lets a request be correlated with its logs, audit events and spans as well as with the reports of clients.
+// The ID of the request is passed to the storage with the user context of the request and echoed in the response. So is the trace context of the request:
+// if the request is not traced by the server, the trace context of its traceparent header is passed on and echoed as it is.
+func (s *Server) correlate(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = propagation.TraceContext{}.Extract(ctx, requestHeaders{c})
+	}
+	id := requestID(c)
+	c.SetUserContext(storage.WithRequestID(ctx, id))
+	c.Set(RequestIDHeader, id)
+	propagation.TraceContext{}.Inject(ctx, responseHeaders{c})
+	return c.Next()
+}
+
+// errorResponse is the body of every response to a failed request.
+type errorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"requestId"`
+}
+
+// handleError is the error handler of the server. It answers failed requests with their status code and an errorResponse,
+// so clients can report the ID of a failed request.
+func (s *Server) handleError(c *fiber.Ctx, err error) error {
+	return c.Status(responseStatus(c, err)).JSON(errorResponse{Error: err.Error(), RequestID: requestID(c)})
+}
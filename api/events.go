@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/torbendury/books-go/storage"
+)
+
+// eventKeepAliveInterval is how often an idle event stream sends a comment, so proxies keep the connection open
+// and disconnected clients are noticed.
+var eventKeepAliveInterval = 15 * time.Second
+
+// subscribe subscribes to the change events of the store. Clients resume after the event named by the Last-Event-ID header,
+// or by the lastEventId query parameter for WebSockets which can not set headers in browsers. Without either, only new events are sent.
+// If events have been lost in between, 410 Gone is returned and clients have to read the books again before subscribing anew.
+func (s *Server) subscribe(c *fiber.Ctx) (*storage.Subscription, error) {
+	after := storage.LiveEvents
+	lastEventID := c.Get("Last-Event-ID", c.Query("lastEventId"))
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || after < 0 {
+			return nil, fiber.NewError(fiber.ErrBadRequest.Code, fmt.Sprintf("invalid last event id %q", lastEventID))
+		}
+	}
+	sub, err := s.store.Subscribe(after)
+	if errors.Is(err, storage.ErrEventsLost) {
+		return nil, fiber.NewError(fiber.StatusGone, err.Error())
+	}
+	if err != nil {
+		return nil, fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return sub, nil
+}
+
+// handleGetEvents streams the changes of books to the client, either over a WebSocket if the request asks for an upgrade,
+// or as Server-Sent Events otherwise. The stream ends if the client falls too far behind or the server shuts down, the client should then resume
+// after the last event it has received.
+func (s *Server) handleGetEvents(c *fiber.Ctx) error {
+	sub, err := s.subscribe(c)
+	if err != nil {
+		return err
+	}
+	if websocket.IsWebSocketUpgrade(c) {
+		err := websocket.New(func(conn *websocket.Conn) {
+			streamWebSocket(conn, sub, s.shuttingDown)
+		})(c)
+		if err != nil {
+			sub.Close()
+		}
+		return err
+	}
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		streamServerSentEvents(w, sub, s.shuttingDown)
+	})
+	return nil
+}
+
+// streamServerSentEvents writes events of the subscription in the text/event-stream format until the client disconnects, the subscription ends
+// or shutdown is closed.
+func streamServerSentEvents(w *bufio.Writer, sub *storage.Subscription, shutdown <-chan struct{}) {
+	defer sub.Close()
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	// the status line and headers are only sent with the first flush
+	if _, err := w.WriteString(": connected\n\n"); err != nil || w.Flush() != nil {
+		return
+	}
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.Sequence, event.Type, payload)
+		case <-keepAlive.C:
+			_, _ = w.WriteString(": keep-alive\n\n")
+		case <-shutdown:
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// streamWebSocket sends events of the subscription as JSON text messages until the client disconnects, the subscription ends or shutdown is closed.
+// Messages from the client are ignored, they are only read to notice when the connection is closed.
+func streamWebSocket(conn *websocket.Conn, sub *storage.Subscription, shutdown <-chan struct{}) {
+	defer sub.Close()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-shutdown:
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"))
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+)
+
+// defaultCheckTimeout is how long a readiness check may take if its Checker does not say otherwise.
+const defaultCheckTimeout = 2 * time.Second
+
+// Checker is a readiness check of a dependency of the server, e.g. storage.PostgresqlStorage.Ping.
+type Checker struct {
+	Name string
+	// Check fails if the dependency is not usable. It has to give up once its context is done.
+	Check func(ctx context.Context) error
+	// Required checks make the server unready when they fail, others are only reported.
+	Required bool
+	// Timeout bounds how long the check may take, defaultCheckTimeout if 0.
+	Timeout time.Duration
+}
+
+// WithCheckers adds readiness checks to the server, see handleReadyz.
+func WithCheckers(checkers ...Checker) Option {
+	return func(s *Server) {
+		s.checkers = append(s.checkers, checkers...)
+	}
+}
+
+// run runs the check within its timeout. A check which does not give up in time is reported as timed out.
+func (checker Checker) run(ctx context.Context) data.CheckResult {
+	timeout := checker.Timeout
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.New("timed out")
+	}
+	result := data.CheckResult{
+		Name:     checker.Name,
+		Required: checker.Required,
+		Status:   data.CheckOK,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		result.Status = data.CheckFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// handleLivez reports that the server is alive, regardless of its dependencies. A server which does not answer has to be restarted.
+func (s *Server) handleLivez(c *fiber.Ctx) error {
+	return c.JSON(data.HealthStatus{Message: "ok"})
+}
+
+// handleReadyz runs all readiness checks concurrently and reports their outcome. If any required check failed, or the server is shutting down,
+// the server should not receive traffic and answers with 503 Service Unavailable.
+func (s *Server) handleReadyz(c *fiber.Ctx) error {
+	report := data.ReadinessReport{
+		Status: data.StatusReady,
+		Checks: make([]data.CheckResult, len(s.checkers)),
+	}
+	// the user context is created lazily, so it is fetched once before the checks run concurrently
+	ctx := c.UserContext()
+	done := make(chan struct{})
+	for i, checker := range s.checkers {
+		go func(i int, checker Checker) {
+			report.Checks[i] = checker.run(ctx)
+			done <- struct{}{}
+		}(i, checker)
+	}
+	for range s.checkers {
+		<-done
+	}
+	select {
+	case <-s.shuttingDown:
+		report.Checks = append(report.Checks, data.CheckResult{
+			Name:     "shutdown",
+			Required: true,
+			Status:   data.CheckFailed,
+			Error:    "server is shutting down",
+			Duration: time.Duration(0).String(),
+		})
+	default:
+	}
+	for _, check := range report.Checks {
+		if check.Required && check.Status != data.CheckOK {
+			report.Status = data.StatusUnready
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+	}
+	return c.JSON(report)
+}
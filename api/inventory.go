@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// defaultReservationTTL is used for reservations which do not specify how long they should be held.
+const defaultReservationTTL = 15 * time.Minute
+
+// inventoryError maps errors of the inventory storage to HTTP errors. Requests which would violate stock constraints
+// are answered with 409 Conflict and missing books or reservations with 404 Not Found. Everything else, e.g. a database
+// which can not be reached, is a failure of the server.
+func inventoryError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrInsufficientStock) || errors.Is(err, storage.ErrReservationNotActive):
+		return fiber.NewError(fiber.ErrConflict.Code, err.Error())
+	case storage.IsNotFound(err):
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	default:
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+}
+
+// handleGetStock returns the stock level of the book with the requested ID.
+func (s *Server) handleGetStock(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	level, err := s.store.GetStock(c.UserContext(), id)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(level)
+}
+
+// handleIncrementStock adds the requested quantity to the stock of a book.
+func (s *Server) handleIncrementStock(c *fiber.Ctx) error {
+	return s.adjustStock(c, 1)
+}
+
+// handleDecrementStock removes the requested quantity from the stock of a book. Reserved copies can not be removed.
+func (s *Server) handleDecrementStock(c *fiber.Ctx) error {
+	return s.adjustStock(c, -1)
+}
+
+// adjustStock parses a data.StockAdjustment and applies it to the stock of the requested book in the given direction.
+func (s *Server) adjustStock(c *fiber.Ctx, sign int) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	adjustment := new(data.StockAdjustment)
+	if err := c.BodyParser(adjustment); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	level, err := s.store.AdjustStock(c.UserContext(), id, sign*adjustment.Quantity)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(level)
+}
+
+// handleSetLowStockThreshold configures at which available quantity a book is reported as low on stock.
+func (s *Server) handleSetLowStockThreshold(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	threshold := new(data.StockThreshold)
+	if err := c.BodyParser(threshold); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	level, err := s.store.SetLowStockThreshold(c.UserContext(), id, threshold.Threshold)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(level)
+}
+
+// handleGetStockLedger returns every stock movement of the requested book, oldest first.
+func (s *Server) handleGetStockLedger(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	movements, err := s.store.GetStockLedger(c.UserContext(), id)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(movements)
+}
+
+// handleGetLowStock returns the stock levels of all books which reached their low-stock threshold.
+func (s *Server) handleGetLowStock(c *fiber.Ctx) error {
+	levels, err := s.store.LowStock(c.UserContext())
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(levels)
+}
+
+// handleCreateReservation holds copies of the requested book until the reservation is fulfilled, released or expires.
+func (s *Server) handleCreateReservation(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	request := new(data.ReservationRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	ttl := defaultReservationTTL
+	if request.TTLSeconds > 0 {
+		ttl = time.Duration(request.TTLSeconds) * time.Second
+	}
+	reservation, err := s.store.Reserve(c.UserContext(), id, request.Quantity, ttl)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(reservation)
+}
+
+// handleReleaseReservation gives the copies of an active reservation back to the available stock.
+func (s *Server) handleReleaseReservation(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	reservation, err := s.store.ReleaseReservation(c.UserContext(), id)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(reservation)
+}
+
+// handleFulfilReservation removes the copies of an active reservation from the stock, e.g. once they have been sold.
+func (s *Server) handleFulfilReservation(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	reservation, err := s.store.FulfilReservation(c.UserContext(), id)
+	if err != nil {
+		return inventoryError(err)
+	}
+	return c.JSON(reservation)
+}
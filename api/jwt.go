@@ -0,0 +1,431 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksRefreshInterval is how long a JWKS fetched from a URL is used before it is fetched again.
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits how often tokens with an unknown key ID can trigger fetching the JWKS from a URL.
+	jwksMinRefreshInterval = 10 * time.Second
+	// jwksFileCheckInterval is how often a JWKS file is checked for changes.
+	jwksFileCheckInterval = time.Second
+	// defaultRolesClaim is the claim which holds the roles of the subject if JWTConfig.RolesClaim is empty.
+	defaultRolesClaim = "roles"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens which are malformed or whose signature does not verify.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned for tokens which are expired or not valid yet.
+	ErrTokenExpired = errors.New("token is expired or not valid yet")
+	// ErrInvalidClaims is returned for tokens which were not issued by the configured issuer or for the configured audience.
+	ErrInvalidClaims = errors.New("token has invalid claims")
+)
+
+// JWTConfig configures the validation of bearer tokens.
+// JWKS is the path or http(s) URL of the JSON Web Key Set which holds the public keys of the token issuer.
+// Leeway is the clock skew which is tolerated when checking exp and nbf.
+type JWTConfig struct {
+	JWKS       string
+	Issuer     string
+	Audience   string
+	Leeway     time.Duration
+	RolesClaim string
+}
+
+// Claims are the claims of a validated token. Scopes are read from the space separated scope claim,
+// Roles from the configured roles claim. All claims, including custom ones, are kept in Raw.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	Scopes    []string
+	Roles     []string
+	Raw       map[string]interface{}
+}
+
+// JWTVerifier validates bearer tokens signed with RS256, ES256 or EdDSA against the keys of a JWKS.
+// The JWKS is reloaded when the file changes or, for URLs, periodically and whenever a token names an unknown key,
+// so keys can be rotated without restarting the server. It is safe for concurrent use. Keys are looked up without locking,
+// and reloading never holds up tokens whose key is known already.
+type JWTVerifier struct {
+	config JWTConfig
+	client *http.Client
+	now    func() time.Time
+
+	keys      atomic.Pointer[keySet]
+	checkedAt atomic.Int64
+	refresh   singleflight.Group
+}
+
+// keySet holds the keys of a loaded JWKS. It is replaced as a whole when the JWKS is reloaded, so it can be read without locking.
+type keySet struct {
+	keys     map[string]crypto.PublicKey
+	modTime  time.Time
+	loadedAt time.Time
+}
+
+// NewJWTVerifier returns a JWTVerifier for the given configuration. The JWKS is loaded right away, so a missing or broken key set is reported on startup.
+func NewJWTVerifier(config JWTConfig) (*JWTVerifier, error) {
+	if config.JWKS == "" || config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("jwks, issuer and audience are required to validate tokens")
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = defaultRolesClaim
+	}
+	v := &JWTVerifier{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	v.checkedAt.Store(v.now().UnixNano())
+	return v, nil
+}
+
+// isURL reports whether the JWKS is fetched via HTTP instead of being read from a local file.
+func (v *JWTVerifier) isURL() bool {
+	return strings.HasPrefix(v.config.JWKS, "http://") || strings.HasPrefix(v.config.JWKS, "https://")
+}
+
+// reload reads and parses the JWKS, unless it is a file which has not changed since it was loaded.
+func (v *JWTVerifier) reload() error {
+	var raw []byte
+	var modTime time.Time
+	if v.isURL() {
+		resp, err := v.client.Get(v.config.JWKS)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching jwks from %v: unexpected status %v", v.config.JWKS, resp.Status)
+		}
+		if raw, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+	} else {
+		info, err := os.Stat(v.config.JWKS)
+		if err != nil {
+			return err
+		}
+		if current := v.keys.Load(); current != nil && info.ModTime().Equal(current.modTime) {
+			return nil
+		}
+		if raw, err = os.ReadFile(v.config.JWKS); err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	v.keys.Store(&keySet{keys: keys, modTime: modTime, loadedAt: v.now()})
+	return nil
+}
+
+// refreshKeys reloads the JWKS outside of any lock. Requests which ask for it at the same time share a single reload.
+// If reloading fails, the keys loaded before stay in use, so a broken update does not lock out every client.
+func (v *JWTVerifier) refreshKeys() {
+	v.checkedAt.Store(v.now().UnixNano())
+	_, _, _ = v.refresh.Do("jwks", func() (interface{}, error) {
+		return nil, v.reload()
+	})
+}
+
+// key returns the public key with the given key ID, reloading the JWKS if it may have changed.
+// Only tokens with an unknown key ID wait for a JWKS to be fetched from a URL, at most once every jwksMinRefreshInterval.
+// The periodic refresh happens in the background, while the known keys stay in use.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	now := v.now()
+	sinceCheck := now.Sub(time.Unix(0, v.checkedAt.Load()))
+	key, ok := v.keys.Load().lookup(kid)
+	switch {
+	case !v.isURL():
+		if sinceCheck > jwksFileCheckInterval {
+			v.refreshKeys()
+			key, ok = v.keys.Load().lookup(kid)
+		}
+	case !ok:
+		if sinceCheck > jwksMinRefreshInterval {
+			v.refreshKeys()
+			key, ok = v.keys.Load().lookup(kid)
+		}
+	case now.Sub(v.keys.Load().loadedAt) > jwksRefreshInterval && sinceCheck > jwksMinRefreshInterval:
+		go v.refreshKeys()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// lookup finds a key by its ID. Tokens without a key ID are accepted if the key set holds a single key.
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// Verify checks the signature and the registered claims of a compact serialized token and returns its claims.
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected three segments", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, err
+	}
+	claims, err := parseClaims(raw, v.config.RolesClaim)
+	if err != nil {
+		return nil, err
+	}
+	return claims, v.validate(claims)
+}
+
+// validate checks issuer, audience and the validity period of a token.
+func (v *JWTVerifier) validate(claims *Claims) error {
+	if claims.Issuer != v.config.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidClaims, claims.Issuer)
+	}
+	audience := false
+	for _, aud := range claims.Audience {
+		audience = audience || aud == v.config.Audience
+	}
+	if !audience {
+		return fmt.Errorf("%w: token is not meant for audience %q", ErrInvalidClaims, v.config.Audience)
+	}
+	now := v.now()
+	if claims.ExpiresAt.IsZero() || now.After(claims.ExpiresAt.Add(v.config.Leeway)) {
+		return fmt.Errorf("%w: expired at %v", ErrTokenExpired, claims.ExpiresAt)
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.config.Leeway).Before(claims.NotBefore) {
+		return fmt.Errorf("%w: not valid before %v", ErrTokenExpired, claims.NotBefore)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// verifySignature verifies the signature of a token with the given algorithm. The key has to match the algorithm,
+// so a token can not pick a weaker algorithm than the key was meant for.
+func verifySignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+	valid := false
+	switch alg {
+	case "RS256":
+		if pub, ok := key.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+		}
+	case "ES256":
+		if pub, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(pub, digest[:], r, s)
+		}
+	case "EdDSA":
+		if pub, ok := key.(ed25519.PublicKey); ok {
+			valid = ed25519.Verify(pub, signingInput, signature)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+	if !valid {
+		return fmt.Errorf("%w: signature does not verify", ErrInvalidToken)
+	}
+	return nil
+}
+
+// parseClaims reads the registered claims, scopes and roles from the raw claims of a token.
+func parseClaims(raw map[string]interface{}, rolesClaim string) (*Claims, error) {
+	claims := &Claims{Raw: raw}
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Subject, _ = raw["sub"].(string)
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []interface{}:
+		claims.Audience = stringsOf(aud)
+	}
+	for name, target := range map[string]*time.Time{"exp": &claims.ExpiresAt, "nbf": &claims.NotBefore, "iat": &claims.IssuedAt} {
+		value, ok := raw[name]
+		if !ok {
+			continue
+		}
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v is not a numeric date", ErrInvalidToken, name)
+		}
+		seconds, err := number.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		*target = time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+	}
+	if scope, ok := raw["scope"].(string); ok {
+		claims.Scopes = strings.Fields(scope)
+	}
+	if roles, ok := raw[rolesClaim].([]interface{}); ok {
+		claims.Roles = stringsOf(roles)
+	}
+	return claims, nil
+}
+
+// stringsOf returns the strings of a decoded JSON array, skipping values of other types.
+func stringsOf(values []interface{}) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// jwk is a single JSON Web Key as found in a JWKS. Only the members of RSA, EC and OKP public keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses a JSON Web Key Set into public keys by key ID. Keys which are not meant for signatures are skipped.
+func parseJWKS(raw []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("parsing jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parsing jwks key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey converts the JSON Web Key into a public key of the crypto packages.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid p-256 coordinates")
+		}
+		// ecdh rejects points which are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v %v", k.Kty, k.Crv)
+}
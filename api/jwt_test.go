@@ -0,0 +1,284 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// testSigner signs tokens with a locally generated key and describes its public key as a JWK.
+type testSigner struct {
+	kid  string
+	alg  string
+	key  crypto.Signer
+	jwk  map[string]string
+	hash bool
+}
+
+func newEd25519Signer(t *testing.T, kid string) *testSigner {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "EdDSA", key: key, jwk: map[string]string{
+		"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(pub),
+	}}
+}
+
+func newTestSigners(t *testing.T) []*testSigner {
+	b64 := base64.RawURLEncoding.EncodeToString
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*testSigner{
+		{kid: "rsa", alg: "RS256", key: rsaKey, hash: true, jwk: map[string]string{
+			"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+		{kid: "ec", alg: "ES256", key: ecKey, hash: true, jwk: map[string]string{
+			"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+		}},
+		newEd25519Signer(t, "ed"),
+	}
+}
+
+func (ts *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": ts.alg, "kid": ts.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := []byte(input)
+	var opts crypto.SignerOpts = crypto.Hash(0)
+	if ts.hash {
+		sum := sha256.Sum256(digest)
+		digest, opts = sum[:], crypto.SHA256
+	}
+	if ecKey, ok := ts.key.(*ecdsa.PrivateKey); ok {
+		// JWS uses the fixed size r || s encoding instead of ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input + "." + b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	signature, err := ts.key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(signature)
+}
+
+func writeJWKS(t *testing.T, path string, signers ...*testSigner) {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, signer := range signers {
+		keys = append(keys, signer.jwk)
+	}
+	raw, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClaims(offset time.Duration) map[string]interface{} {
+	now := time.Now().Add(offset)
+	return map[string]interface{}{
+		"iss":   "https://gateway.example",
+		"aud":   []string{"books-go", "other"},
+		"sub":   "ada",
+		"exp":   now.Add(time.Minute).Unix(),
+		"nbf":   now.Add(-time.Minute).Unix(),
+		"scope": "books:read books:write",
+		"roles": []string{"editor"},
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	signers := newTestSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers...)
+	verifier, err := NewJWTVerifier(JWTConfig{JWKS: path, Issuer: "https://gateway.example", Audience: "books-go", Leeway: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every supported algorithm
+	for _, signer := range signers {
+		claims, err := verifier.Verify(signer.sign(t, testClaims(0)))
+		if assert.NoError(t, err, signer.alg) {
+			assert.Equal(t, "ada", claims.Subject)
+			assert.Equal(t, []string{"books:read", "books:write"}, claims.Scopes)
+			assert.Equal(t, []string{"editor"}, claims.Roles)
+		}
+	}
+
+	// registered claims
+	claims := testClaims(0)
+	claims["iss"] = "https://evil.example"
+	_, err = verifier.Verify(signers[0].sign(t, claims))
+	assert.ErrorIs(t, err, ErrInvalidClaims)
+	claims = testClaims(0)
+	claims["aud"] = "other"
+	_, err = verifier.Verify(signers[0].sign(t, claims))
+	assert.ErrorIs(t, err, ErrInvalidClaims)
+	claims = testClaims(0)
+	delete(claims, "exp")
+	_, err = verifier.Verify(signers[0].sign(t, claims))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	// leeway
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(-80*time.Second)))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(-100*time.Second)))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(80*time.Second)))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(100*time.Second)))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	// tampered tokens and mismatching algorithms
+	token := signers[1].sign(t, testClaims(0))
+	_, err = verifier.Verify(token[:len(token)-4] + "AAAA")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	forged := *signers[2]
+	forged.kid = "rsa"
+	_, err = verifier.Verify(forged.sign(t, testClaims(0)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = verifier.Verify("not.a.token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// rotation: keys removed from the file are no longer accepted, new keys are, once the file has been checked again
+	rotated := newEd25519Signer(t, "ed-2")
+	writeJWKS(t, path, signers[0], rotated)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.Verify(rotated.sign(t, testClaims(0)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	verifier.now = func() time.Time { return later.Add(jwksFileCheckInterval) }
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(0)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = verifier.Verify(rotated.sign(t, testClaims(0)))
+	assert.NoError(t, err)
+}
+
+func TestJWTVerifierURL(t *testing.T) {
+	signers := newTestSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers[1])
+	var stalled atomic.Bool
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if stalled.Load() {
+			<-release
+		}
+		http.ServeFile(w, r, path)
+	}))
+	defer jwks.Close()
+
+	verifier, err := NewJWTVerifier(JWTConfig{JWKS: jwks.URL + "/jwks.json", Issuer: "https://gateway.example", Audience: "books-go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.Verify(signers[1].sign(t, testClaims(0)))
+	assert.NoError(t, err)
+
+	// unknown key IDs trigger fetching the key set again, but not on every request
+	writeJWKS(t, path, signers[1], signers[2])
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(0)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	now := time.Now()
+	verifier.now = func() time.Time { return now.Add(jwksMinRefreshInterval + time.Second) }
+	_, err = verifier.Verify(signers[2].sign(t, testClaims(0)))
+	assert.NoError(t, err)
+
+	// while a token with an unknown key ID waits for a slow key set, tokens with known keys are still verified
+	stalled.Store(true)
+	verifier.now = func() time.Time { return now.Add(2 * (jwksMinRefreshInterval + time.Second)) }
+	unknown := make(chan error)
+	go func() {
+		_, err := verifier.Verify(newEd25519Signer(t, "ed-unknown").sign(t, testClaims(0)))
+		unknown <- err
+	}()
+	known := make(chan error)
+	go func() {
+		_, err := verifier.Verify(signers[1].sign(t, testClaims(0)))
+		known <- err
+	}()
+	select {
+	case err := <-known:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("verifying a token with a known key waited for the key set")
+	}
+	close(release)
+	assert.ErrorIs(t, <-unknown, ErrInvalidToken)
+
+	_, err = NewJWTVerifier(JWTConfig{JWKS: jwks.URL + "/missing", Issuer: "https://gateway.example", Audience: "books-go"})
+	assert.Error(t, err)
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	signers := newTestSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers...)
+	verifier, err := NewJWTVerifier(JWTConfig{JWKS: path, Issuer: "https://gateway.example", Audience: "books-go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithJWTVerifier(verifier), WithAuditLog(io.Discard))
+	var principal *Principal
+	server.fiberApp.Get("/books", server.authorize(data.ScopeBooksRead), func(c *fiber.Ctx) error {
+		principal = PrincipalFrom(c)
+		return server.handleGetAllBooks(c)
+	})
+	server.fiberApp.Get("/keys", server.authorize(data.ScopeKeysAdmin), server.handleGetAPIKeys)
+
+	send := func(target string, authorization string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", authorization)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+
+	token := signers[0].sign(t, testClaims(0))
+	assert.Equal(t, 200, send("/books", "Bearer "+token).StatusCode)
+	if assert.NotNil(t, principal) {
+		assert.Equal(t, "ada", principal.Subject)
+		assert.True(t, principal.HasRole("editor"))
+		assert.Equal(t, "https://gateway.example", principal.Claims.Issuer)
+	}
+	assert.Equal(t, 403, send("/keys", "Bearer "+token).StatusCode)
+	resp := send("/books", "Bearer "+signers[0].sign(t, testClaims(-time.Hour)))
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, 401, send("/books", "Basic YWRhOmFkYQ==").StatusCode)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// keyError maps errors of the key storage to HTTP errors. Changing a revoked key is answered with 409 Conflict and
+// missing keys with 404 Not Found. Everything else, e.g. a database which can not be reached, is a failure of the server.
+func keyError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrKeyRevoked):
+		return fiber.NewError(fiber.ErrConflict.Code, err.Error())
+	case storage.IsNotFound(err):
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	default:
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+}
+
+// handleIssueAPIKey issues a new API key. The response is the only time the secret of the key is shown.
+func (s *Server) handleIssueAPIKey(c *fiber.Ctx) error {
+	request := new(data.APIKeyRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	key, err := IssueAPIKey(c.UserContext(), s.store, request.Name, request.Scopes)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(key)
+}
+
+// handleGetAPIKeys returns all API keys without their secrets.
+func (s *Server) handleGetAPIKeys(c *fiber.Ctx) error {
+	keys, err := s.store.ListAPIKeys(c.UserContext())
+	if err != nil {
+		return err
+	}
+	return c.JSON(keys)
+}
+
+// handleRotateAPIKey replaces the secret of the requested API key and returns the new secret.
+func (s *Server) handleRotateAPIKey(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	key, err := RotateAPIKey(c.UserContext(), s.store, id)
+	if err != nil {
+		return keyError(err)
+	}
+	return c.JSON(key)
+}
+
+// handleRevokeAPIKey revokes the requested API key for good.
+func (s *Server) handleRevokeAPIKey(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	key, err := s.store.RevokeAPIKey(c.UserContext(), id)
+	if err != nil {
+		return keyError(err)
+	}
+	return c.JSON(key)
+}
+
+// RunKeyCommand manages API keys from the command line, e.g. to bootstrap the first admin key of a new database.
+// The first argument selects the command (issue, list, rotate or revoke), the result is written as JSON to out.
+func RunKeyCommand(ctx context.Context, store storage.KeyStorage, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: keys issue|list|rotate|revoke [flags]")
+	}
+	flags := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	name := flags.String("name", "", "name of the new key - only for issue")
+	scopes := flags.String("scopes", data.ScopeBooksRead, "comma separated scopes of the new key - only for issue")
+	id := flags.Int("id", 0, "id of the key - only for rotate and revoke")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var result interface{}
+	var err error
+	switch args[0] {
+	case "issue":
+		request := data.APIKeyRequest{Name: *name, Scopes: strings.Split(*scopes, ",")}
+		if err := validator.New().Struct(request); err != nil {
+			return err
+		}
+		result, err = IssueAPIKey(ctx, store, request.Name, request.Scopes)
+	case "list":
+		result, err = store.ListAPIKeys(ctx)
+	case "rotate":
+		result, err = RotateAPIKey(ctx, store, *id)
+	case "revoke":
+		result, err = store.RevokeAPIKey(ctx, *id)
+	default:
+		return fmt.Errorf("unknown keys command %v", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
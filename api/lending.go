@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// loanPeriod is how long a borrower may keep a copy, and also how much a renewal extends a loan.
+const loanPeriod = 14 * 24 * time.Hour
+
+// maxRenewals is how often a single loan may be renewed.
+const maxRenewals = 2
+
+// lendingError maps errors of the lending storage to HTTP errors. Requests which conflict with the current state
+// of copies, loans or holds are answered with 409 Conflict and missing books or loans with 404 Not Found.
+// Everything else, e.g. a database which can not be reached, is a failure of the server.
+func lendingError(err error) error {
+	for _, conflict := range []error{storage.ErrNoCopyAvailable, storage.ErrLoanReturned, storage.ErrRenewalDenied, storage.ErrDuplicateHold} {
+		if errors.Is(err, conflict) {
+			return fiber.NewError(fiber.ErrConflict.Code, err.Error())
+		}
+	}
+	if storage.IsNotFound(err) {
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	}
+	return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+}
+
+// handleAddCopies adds copies of the requested book to the library. New copies serve waiting holds first.
+func (s *Server) handleAddCopies(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	request := new(data.CopiesRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	copies, err := s.store.AddCopies(c.UserContext(), id, request.Count)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(copies)
+}
+
+// handleGetCopies returns all copies of the requested book and their status.
+func (s *Server) handleGetCopies(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	copies, err := s.store.ListCopies(c.UserContext(), id)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.JSON(copies)
+}
+
+// handleCheckOut lends a copy of the requested book to a borrower. If no copy is available, the borrower can place a hold instead.
+func (s *Server) handleCheckOut(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	request := new(data.BorrowerRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	loan, err := s.store.CheckOut(c.UserContext(), id, request.Borrower, loanPeriod)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(loan)
+}
+
+// handleReturnLoan closes the requested loan. The copy goes to the next borrower waiting for the book, if any.
+func (s *Server) handleReturnLoan(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	loan, err := s.store.ReturnLoan(c.UserContext(), id)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.JSON(loan)
+}
+
+// handleRenewLoan extends the due date of the requested loan by another loan period.
+func (s *Server) handleRenewLoan(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	loan, err := s.store.RenewLoan(c.UserContext(), id, loanPeriod, maxRenewals)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.JSON(loan)
+}
+
+// handlePlaceHold queues a borrower for the requested book.
+func (s *Server) handlePlaceHold(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	request := new(data.BorrowerRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	hold, err := s.store.PlaceHold(c.UserContext(), id, request.Borrower)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(hold)
+}
+
+// handleGetHolds returns the hold queue of the requested book.
+func (s *Server) handleGetHolds(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	holds, err := s.store.ListHolds(c.UserContext(), id)
+	if err != nil {
+		return lendingError(err)
+	}
+	return c.JSON(holds)
+}
+
+// handleGetOverdueLoans returns every open loan which is past its due date, the longest overdue first.
+func (s *Server) handleGetOverdueLoans(c *fiber.Ctx) error {
+	loans, err := s.store.OverdueLoans(c.UserContext(), time.Now())
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(loans)
+}
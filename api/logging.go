@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/torbendury/books-go/storage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats of the logs, see LogConfig.
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// maxLoggedBody is the number of bytes of a request body which are logged at most, longer bodies are truncated.
+const maxLoggedBody = 1024
+
+// redacted replaces the values of sensitive fields in the logs.
+const redacted = "[REDACTED]"
+
+// sensitiveFields are parts of the names of log attributes and JSON fields whose values are never logged.
+var sensitiveFields = []string{"password", "secret", "token", "authorization", "cookie", "apikey", "api_key"}
+
+// isSensitive reports whether a field holds a secret by its name. A field named key holds the secret of an API key.
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	if name == "key" {
+		return true
+	}
+	for _, part := range sensitiveFields {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogConfig configures the logs of the server, see NewLogger.
+type LogConfig struct {
+	// Level is the minimum level of the records which are logged.
+	Level slog.Level
+	// Format is either LogFormatJSON, which is the default, or LogFormatText.
+	Format string
+}
+
+// NewLogger returns a logger which writes records of at least the configured level to w, one per line.
+// The values of attributes with sensitive names, e.g. password or secret, are redacted.
+func NewLogger(w io.Writer, config LogConfig) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level: config.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if isSensitive(a.Key) {
+				return slog.String(a.Key, redacted)
+			}
+			return a
+		},
+	}
+	switch config.Format {
+	case LogFormatJSON, "":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected %v or %v", config.Format, LogFormatJSON, LogFormatText)
+}
+
+// loggedBody returns a request body as it is logged: as compact JSON with the values of sensitive fields redacted, truncated to maxLoggedBody bytes.
+// Bodies which are not JSON may hold secrets which can not be told apart, so only their size is logged.
+func loggedBody(body []byte) string {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	logged, err := json.Marshal(redact(value))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	if len(logged) <= maxLoggedBody {
+		return string(logged)
+	}
+	// cut at the start of a character, so the log stays valid UTF-8
+	cut := maxLoggedBody
+	for cut > 0 && !utf8.RuneStart(logged[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", logged[:cut], len(logged)-cut)
+}
+
+// redact replaces the values of sensitive fields within a decoded JSON value.
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if isSensitive(name) {
+				v[name] = redacted
+			} else {
+				v[name] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redact(element)
+		}
+	}
+	return value
+}
+
+// logRequests is a middleware handler which gives every request a logger carrying its ID and trace, and logs the request once it has been handled.
+// The logger is passed on in the user context of the request, so the storage logs with it too, see storage.LoggerFrom.
+// Once the request has been authorized, the logger also carries its route and user, see annotateLogger.
+func (s *Server) logRequests(c *fiber.Ctx) error {
+	start := time.Now()
+	middleware := c.Route()
+	logger := s.logger.With(slog.String("request_id", requestID(c)))
+	if span := trace.SpanContextFromContext(c.UserContext()); span.IsValid() {
+		logger = logger.With(slog.String("trace_id", span.TraceID().String()))
+	}
+	c.SetUserContext(storage.WithLogger(c.UserContext(), logger))
+
+	err := c.Next()
+	status := responseStatus(c, err)
+	attrs := []slog.Attr{
+		slog.String("method", utils.CopyString(c.Method())),
+		slog.String("path", utils.CopyString(c.Path())),
+		slog.String("route", routeTemplate(c, middleware)),
+		slog.Int("status", status),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("ip", c.IP()),
+		slog.String("user_agent", string(c.Request().Header.UserAgent())),
+	}
+	if principal := PrincipalFrom(c); principal != nil {
+		attrs = append(attrs, slog.String("user", principal.Subject))
+	}
+	if body := c.Body(); len(body) > 0 {
+		attrs = append(attrs, slog.String("body", loggedBody(body)))
+	}
+	level := slog.LevelInfo
+	if status >= fiber.StatusInternalServerError {
+		level = slog.LevelError
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+	}
+	logger.LogAttrs(c.UserContext(), level, "request", attrs...)
+	return err
+}
+
+// annotateLogger adds the route and the authenticated user of a request to its logger, see logRequests.
+func annotateLogger(c *fiber.Ctx, principal *Principal) {
+	logger := storage.LoggerFrom(c.UserContext()).With(slog.String("route", c.Route().Path), slog.String("user", principal.Subject))
+	c.SetUserContext(storage.WithLogger(c.UserContext(), logger))
+}
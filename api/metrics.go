@@ -0,0 +1,142 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/torbendury/books-go/storage"
+)
+
+// metricsNamespace prefixes the names of all metrics of the server.
+const metricsNamespace = "books"
+
+// unmatchedRoute is the route label of requests which did not match any route, so unknown paths do not create new series.
+const unmatchedRoute = "unmatched"
+
+// Metrics collects the metrics of a server in its own Prometheus registry, together with the metrics of the Go runtime and the process.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	operations      *prometheus.HistogramVec
+	operationErrors *prometheus.CounterVec
+}
+
+// NewMetrics returns a new set of metrics. Pass it to the server with WithMetrics and to a storage with storage.NewInstrumentedStorage.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of handled HTTP requests by route template, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of handled HTTP requests by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		operations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of storage operations by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		operationErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_operation_errors_total",
+			Help:      "Number of failed storage operations by operation.",
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.operations,
+		m.operationErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// ObserveOperation records a storage operation. It is a storage.OperationObserver.
+func (m *Metrics) ObserveOperation(operation string, duration time.Duration, err error) {
+	m.operations.WithLabelValues(operation).Observe(duration.Seconds())
+	if err != nil {
+		m.operationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// RegisterDB adds the connection pool statistics of a database, e.g. the one of a storage.PostgresqlStorage.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterCache adds the hit, miss and eviction counters of a book cache.
+func (m *Metrics) RegisterCache(cache *storage.CachedStorage) {
+	counter := func(name string, help string, value func(storage.CacheStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(cache.Stats())) })
+	}
+	m.registry.MustRegister(
+		counter("cache_hits_total", "Number of book reads served from the cache.", func(s storage.CacheStats) uint64 { return s.Hits }),
+		counter("cache_misses_total", "Number of book reads which missed the cache.", func(s storage.CacheStats) uint64 { return s.Misses }),
+		counter("cache_evictions_total", "Number of books evicted from the full cache.", func(s storage.CacheStats) uint64 { return s.Evictions }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_entries",
+			Help:      "Number of books in the cache.",
+		}, func() float64 { return float64(cache.Stats().Entries) }),
+	)
+}
+
+// instrument is a middleware handler which counts and times every request by the template of the route which handled it, e.g. /book/:id.
+func (m *Metrics) instrument(c *fiber.Ctx) error {
+	start := time.Now()
+	middleware := c.Route()
+	err := c.Next()
+	labels := []string{routeTemplate(c, middleware), utils.CopyString(c.Method()), strconv.Itoa(responseStatus(c, err))}
+	m.requests.WithLabelValues(labels...).Inc()
+	m.requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// routeTemplate returns the template of the route which handled a request, once the handlers after the given middleware returned.
+// If the request did not match any route, the route is still the one of the middleware and unmatchedRoute is returned.
+func routeTemplate(c *fiber.Ctx, middleware *fiber.Route) string {
+	route := c.Route()
+	if route == middleware {
+		return unmatchedRoute
+	}
+	return route.Path
+}
+
+// responseStatus returns the status code of the response to a request, once the handlers returned the given error.
+// Errors have not been turned into responses by the error handler yet, so their status code is taken from the error itself.
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *Metrics) handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// orderError maps errors of the order storage to HTTP errors. Transitions which are not allowed from the current state are answered
+// with 409 Conflict and missing orders with the given status. Everything else, e.g. a database which can not be reached, is a failure of the server.
+func orderError(err error, notFound int) error {
+	switch {
+	case errors.Is(err, storage.ErrInvalidTransition):
+		return fiber.NewError(fiber.ErrConflict.Code, err.Error())
+	case storage.IsNotFound(err):
+		return fiber.NewError(notFound, err.Error())
+	default:
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+}
+
+// handleCreateOrder creates a pending order. Every line is priced with the current price of its book by the store.
+// If any of the ordered books does not exist, the order is rejected.
+func (s *Server) handleCreateOrder(c *fiber.Ctx) error {
+	order := new(data.Order)
+	if err := c.BodyParser(order); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	order, err := s.store.CreateOrder(c.UserContext(), order)
+	if err != nil {
+		// a missing book is a mistake of the order, not a missing resource
+		return orderError(err, fiber.ErrBadRequest.Code)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(order)
+}
+
+// handleGetOrder returns the order with the requested ID, including its lines and total.
+func (s *Server) handleGetOrder(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	order, err := s.store.GetOrder(c.UserContext(), id)
+	if err != nil {
+		return orderError(err, fiber.ErrNotFound.Code)
+	}
+	return c.JSON(order)
+}
+
+// handleUpdateOrderStatus moves the requested order into another state.
+// Transitions which are not allowed from the current state are answered with 409 Conflict.
+func (s *Server) handleUpdateOrderStatus(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	change := new(data.OrderStatusChange)
+	if err := c.BodyParser(change); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	order, err := s.store.UpdateOrderStatus(c.UserContext(), id, change.Status)
+	if err != nil {
+		return orderError(err, fiber.ErrNotFound.Code)
+	}
+	return c.JSON(order)
+}
+
+// handleGetCustomerOrders returns all orders of the requested customer, oldest first.
+func (s *Server) handleGetCustomerOrders(c *fiber.Ctx) error {
+	orders, err := s.store.ListOrders(c.UserContext(), c.Params("customerId"))
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(orders)
+}
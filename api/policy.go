@@ -0,0 +1,115 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ConditionSamePublisher restricts a grant to books of the publisher the principal belongs to.
+const ConditionSamePublisher = "same-publisher"
+
+// defaultPolicy is the policy used by servers which are not configured with a policy file.
+//
+//go:embed policy.json
+var defaultPolicy []byte
+
+// Grant gives a role a permission. If a condition is set, the grant only applies if the condition holds for every
+// resource the request touches, so conditional grants never apply to routes which do not name a resource.
+type Grant struct {
+	Permission string `json:"permission"`
+	Condition  string `json:"condition,omitempty"`
+}
+
+// Policy maps roles to the permissions they are granted. Permissions are the same as the scopes of API keys.
+type Policy struct {
+	Roles map[string][]Grant `json:"roles"`
+}
+
+// Resource is something a request acts on, described by the attributes conditions are evaluated against.
+// Missing marks a resource which the request names but which does not exist. Conditions hold for it, so the handler can answer 404 Not Found.
+type Resource struct {
+	Publisher string
+	Missing   bool
+}
+
+// DefaultPolicy returns the built-in policy with the roles viewer, editor and admin.
+func DefaultPolicy() *Policy {
+	policy, err := parsePolicy(defaultPolicy)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+// LoadPolicy reads a policy from a JSON file, see policy.json for the format.
+func LoadPolicy(path string) (*Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(raw)
+}
+
+// parsePolicy parses a policy and rejects unknown permissions and conditions, so typos do not silently deny or grant access.
+func parsePolicy(raw []byte) (*Policy, error) {
+	policy := new(Policy)
+	if err := json.Unmarshal(raw, policy); err != nil {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+	for role, grants := range policy.Roles {
+		for _, grant := range grants {
+			if !contains(data.Scopes, grant.Permission) {
+				return nil, fmt.Errorf("role %v: unknown permission %q", role, grant.Permission)
+			}
+			if grant.Condition != "" && grant.Condition != ConditionSamePublisher {
+				return nil, fmt.Errorf("role %v: unknown condition %q", role, grant.Condition)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Allows reports whether the principal may use the permission on the given resources, and the reason if it may not.
+// Scopes which were granted directly to an API key or token apply unconditionally, roles are granted permissions by the policy.
+func (p *Policy) Allows(principal *Principal, permission string, resources []Resource) (bool, string) {
+	if principal.HasScope(permission) {
+		return true, ""
+	}
+	reason := fmt.Sprintf("no role grants %v", permission)
+	for _, role := range principal.Roles {
+		for _, grant := range p.Roles[role] {
+			if grant.Permission != permission {
+				continue
+			}
+			ok, why := grant.holds(principal, resources)
+			if ok {
+				return true, ""
+			}
+			reason = why
+		}
+	}
+	return false, reason
+}
+
+// holds reports whether the condition of the grant is met for all resources.
+func (g Grant) holds(principal *Principal, resources []Resource) (bool, string) {
+	switch g.Condition {
+	case "":
+		return true, ""
+	case ConditionSamePublisher:
+		if principal.Publisher == "" || len(resources) == 0 {
+			return false, fmt.Sprintf("%v requires a publisher", g.Permission)
+		}
+		for _, resource := range resources {
+			if !resource.Missing && resource.Publisher != principal.Publisher {
+				return false, fmt.Sprintf("book belongs to publisher %q", resource.Publisher)
+			}
+		}
+		return true, ""
+	}
+	return false, fmt.Sprintf("unknown condition %v", g.Condition)
+}
@@ -2,16 +2,19 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/torbendury/books-go/data"
 	"github.com/torbendury/books-go/storage"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Server holds information about any kind of data store which implements the storage.Storage interface.
@@ -22,64 +25,221 @@ type Server struct {
 	listenAddress string
 	fiberApp      *fiber.App
 	validator     *validator.Validate
+	jwt           *JWTVerifier
+	policy        *Policy
+	auditLog      io.Writer
+	auditMutex    sync.Mutex
+	metrics       *Metrics
+	tracer        trace.Tracer
+	logger        *slog.Logger
+	checkers      []Checker
+	shutdownDelay time.Duration
+	shuttingDown  chan struct{}
+	shutdownOnce  sync.Once
+}
+
+// Option configures optional features of a Server, see NewServer.
+type Option func(*Server)
+
+// WithJWTVerifier lets the server accept bearer tokens which are validated by the given verifier, in addition to API keys.
+func WithJWTVerifier(verifier *JWTVerifier) Option {
+	return func(s *Server) {
+		s.jwt = verifier
+	}
+}
+
+// WithPolicy replaces the built-in role policy, see DefaultPolicy.
+func WithPolicy(policy *Policy) Option {
+	return func(s *Server) {
+		s.policy = policy
+	}
+}
+
+// WithAuditLog sets where denied requests are logged. By default, they are written to stdout next to the access log.
+func WithAuditLog(w io.Writer) Option {
+	return func(s *Server) {
+		s.auditLog = w
+	}
+}
+
+// WithMetrics lets the server count and time its requests and serve the given metrics at /metrics.
+func WithMetrics(metrics *Metrics) Option {
+	return func(s *Server) {
+		s.metrics = metrics
+	}
+}
+
+// WithTracing lets the server record a span for every request with a tracer of the given provider, see NewTracerProvider.
+func WithTracing(provider trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// WithLogger sets the logger of requests. By default, they are logged with the default logger of slog.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithShutdownDelay sets how long the server keeps serving after it started to report not ready on shutdown, see Shutdown.
+func WithShutdownDelay(delay time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownDelay = delay
+	}
 }
 
 // NewServer returns a new Server instance. This Server instance is basically idling until the Start() method is called.
-func NewServer(store storage.Storage, listenAddress string, config fiber.Config) *Server {
-	return &Server{
+// Unless the config has an error handler, failed requests are answered with a JSON body naming the error and the request ID.
+func NewServer(store storage.Storage, listenAddress string, config fiber.Config, opts ...Option) *Server {
+	s := &Server{
 		store:         store,
 		listenAddress: listenAddress,
-		fiberApp:      fiber.New(config),
 		validator:     validator.New(),
+		policy:        DefaultPolicy(),
+		auditLog:      os.Stdout,
+		logger:        slog.Default(),
+		shuttingDown:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = s.handleError
 	}
+	s.fiberApp = fiber.New(config)
+	return s
 }
 
 // Start is responsible for configuring middleware, registering routes and putting the Fiber app in listen mode.
+// Every route except the probes and the metrics requires an API key or bearer token which is granted the permission noted next to it, see authorize.
 // Since this is effectively starting process forks etc. and is never really "ending", we can not unit-test this.
 func (s *Server) Start() error {
-	s.fiberApp.Use(
-		logger.New(logger.Config{
-			Format:        "{\"time\":${time}, \"latency\":\"${cust_latency}\", \"method\":\"${method}\", \"path\":\"${path}\", \"ip\":\"${ip}\", \"body\":${cust_reqbody}, \"useragent\":\"${ua}\", \"status\":${status}}\n",
-			DisableColors: true,
-			Output:        os.Stdout,
-			CustomTags: map[string]logger.LogFunc{
-				"cust_latency": func(output logger.Buffer, c *fiber.Ctx, data *logger.Data, extraParam string) (int, error) {
-					latency := data.Stop.Sub(data.Start)
-					return output.WriteString(fmt.Sprintf("%v", latency))
-				},
-				"cust_reqbody": func(output logger.Buffer, c *fiber.Ctx, data *logger.Data, extraParam string) (int, error) {
-					body := c.Body()
-					dst := &bytes.Buffer{}
-					if err := json.Compact(dst, body); err != nil {
-						return output.WriteString(string(body))
-					}
-					return output.WriteString(dst.String())
-				},
-			},
-		}),
-	)
+	if s.tracer != nil {
+		s.fiberApp.Use(s.trace)
+	}
+	if s.metrics != nil {
+		s.fiberApp.Use(s.metrics.instrument)
+		s.fiberApp.Get("/metrics", s.metrics.handler())
+	}
+	s.fiberApp.Use(s.correlate, s.logRequests)
+
+	// writes to a single book are evaluated against that book, so editors are limited to the books of their publisher
+	read := s.authorize(data.ScopeBooksRead)
+	write := s.authorize(data.ScopeBooksWrite)
+	writeBook := s.authorize(data.ScopeBooksWrite, s.bookOfParam)
+	admin := s.authorize(data.ScopeKeysAdmin)
 
 	s.fiberApp.Get("/health", s.handleHealthCheck)
-	s.fiberApp.Post("/book", s.ValidateBook, s.handleCreateBook)
-	s.fiberApp.Get("/book/:id", s.handleGetBookById)
-	s.fiberApp.Get("/books", s.handleGetAllBooks)
-	s.fiberApp.Put("/book", s.ValidateBook, s.handleUpdateBook)
-	s.fiberApp.Delete("/book/:id", s.handleDeleteBook)
+	s.fiberApp.Get("/livez", s.handleLivez)
+	s.fiberApp.Get("/readyz", s.handleReadyz)
+	s.fiberApp.Post("/book", s.authorize(data.ScopeBooksWrite, s.newBookOfBody), s.ValidateBook, s.handleCreateBook)
+	s.fiberApp.Get("/book/:id", read, s.handleGetBookById)
+	s.fiberApp.Get("/books", read, s.handleGetAllBooks)
+	s.fiberApp.Get("/books/search", read, s.handleSearchBooks)
+	s.fiberApp.Get("/books/suggest", read, s.handleSuggestBooks)
+	s.fiberApp.Put("/book", s.authorize(data.ScopeBooksWrite, s.bookOfBody), s.ValidateBook, s.handleUpdateBook)
+	s.fiberApp.Delete("/book/:id", writeBook, s.handleDeleteBook)
+	s.fiberApp.Post("/book/:id/reviews", writeBook, s.ValidateReview, s.handleCreateReview)
+	s.fiberApp.Get("/book/:id/reviews", read, s.handleGetReviews)
+	s.fiberApp.Delete("/book/:id/reviews/:reviewId", writeBook, s.handleDeleteReview)
+	s.fiberApp.Get("/book/:id/stock", read, s.handleGetStock)
+	s.fiberApp.Post("/book/:id/stock/increment", writeBook, validate[data.StockAdjustment](s), s.handleIncrementStock)
+	s.fiberApp.Post("/book/:id/stock/decrement", writeBook, validate[data.StockAdjustment](s), s.handleDecrementStock)
+	s.fiberApp.Put("/book/:id/stock/threshold", writeBook, validate[data.StockThreshold](s), s.handleSetLowStockThreshold)
+	s.fiberApp.Get("/book/:id/stock/ledger", read, s.handleGetStockLedger)
+	s.fiberApp.Post("/book/:id/reservations", writeBook, validate[data.ReservationRequest](s), s.handleCreateReservation)
+	s.fiberApp.Post("/reservations/:id/release", write, s.handleReleaseReservation)
+	s.fiberApp.Post("/reservations/:id/fulfil", write, s.handleFulfilReservation)
+	s.fiberApp.Get("/stock/low", read, s.handleGetLowStock)
+	s.fiberApp.Post("/orders", write, validate[data.Order](s), s.handleCreateOrder)
+	s.fiberApp.Get("/orders/:id", read, s.handleGetOrder)
+	s.fiberApp.Put("/orders/:id/status", write, validate[data.OrderStatusChange](s), s.handleUpdateOrderStatus)
+	s.fiberApp.Get("/customers/:customerId/orders", read, s.handleGetCustomerOrders)
+	s.fiberApp.Post("/book/:id/copies", writeBook, validate[data.CopiesRequest](s), s.handleAddCopies)
+	s.fiberApp.Get("/book/:id/copies", read, s.handleGetCopies)
+	s.fiberApp.Post("/book/:id/loans", writeBook, validate[data.BorrowerRequest](s), s.handleCheckOut)
+	s.fiberApp.Post("/book/:id/holds", writeBook, validate[data.BorrowerRequest](s), s.handlePlaceHold)
+	s.fiberApp.Get("/book/:id/holds", read, s.handleGetHolds)
+	s.fiberApp.Get("/loans/overdue", read, s.handleGetOverdueLoans)
+	s.fiberApp.Post("/loans/:id/return", write, s.handleReturnLoan)
+	s.fiberApp.Post("/loans/:id/renew", write, s.handleRenewLoan)
+	s.fiberApp.Post("/users", write, validate[data.User](s), s.handleCreateUser)
+	s.fiberApp.Get("/users/:id", read, s.handleGetUser)
+	s.fiberApp.Get("/users/:id/lists/:list", read, s.handleGetReadingList)
+	s.fiberApp.Post("/users/:id/lists/:list/entries", write, validate[data.ListEntry](s), s.handleAddListEntry)
+	s.fiberApp.Put("/users/:id/lists/:list/entries/:bookId", write, validate[data.ListProgress](s), s.handleSetListProgress)
+	s.fiberApp.Delete("/users/:id/lists/:list/entries/:bookId", write, s.handleRemoveListEntry)
+	s.fiberApp.Put("/users/:id/lists/:list/order", write, validate[data.ListOrder](s), s.handleReorderList)
+	s.fiberApp.Post("/keys", admin, validate[data.APIKeyRequest](s), s.handleIssueAPIKey)
+	s.fiberApp.Get("/keys", admin, s.handleGetAPIKeys)
+	s.fiberApp.Post("/keys/:id/rotate", admin, s.handleRotateAPIKey)
+	s.fiberApp.Delete("/keys/:id", admin, s.handleRevokeAPIKey)
+	// the history of a book names who changed it and in which request, so it is guarded like the audit log
+	audit := s.authorize(data.ScopeAuditRead)
+	s.fiberApp.Get("/book/:id/history", audit, s.handleGetBookHistory)
+	s.fiberApp.Get("/audit", audit, s.handleGetAuditEvents)
+	s.fiberApp.Get("/trash", read, s.handleGetTrash)
+	s.fiberApp.Post("/book/:id/restore", s.authorize(data.ScopeBooksWrite, s.trashedBookOfParam), s.handleRestoreBook)
+	s.fiberApp.Get("/book/:id/versions", read, s.handleGetBookVersions)
+	s.fiberApp.Get("/book/:id/versions/:n", read, s.handleGetBookVersion)
+	s.fiberApp.Post("/book/:id/revert/:n", s.authorize(data.ScopeBooksWrite, s.bookOfParam, s.versionOfParams), s.handleRevertBook)
+	s.fiberApp.Get("/events", read, s.handleGetEvents)
+	s.fiberApp.Get("/cache/stats", read, s.handleGetCacheStats)
+	webhooks := s.authorize(data.ScopeWebhooks)
+	s.fiberApp.Post("/webhooks", webhooks, validate[data.WebhookRequest](s), s.handleCreateWebhook)
+	s.fiberApp.Get("/webhooks", webhooks, s.handleGetWebhooks)
+	s.fiberApp.Delete("/webhooks/:id", webhooks, s.handleDeleteWebhook)
+	s.fiberApp.Get("/webhooks/:id/deliveries", webhooks, s.handleGetWebhookDeliveries)
 
 	return s.fiberApp.Listen(s.listenAddress)
 }
 
+// Shutdown stops the server gracefully. It reports not ready right away, see handleReadyz, and keeps serving for the shutdown delay,
+// so load balancers stop routing requests to it. Then it stops accepting connections, ends all event streams, so their clients
+// resume elsewhere, and waits for the requests in flight until the context is done. Start returns once the server has been shut down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shuttingDown)
+	})
+	delay := time.NewTimer(s.shutdownDelay)
+	defer delay.Stop()
+	select {
+	case <-delay.C:
+	case <-ctx.Done():
+	}
+	return s.fiberApp.ShutdownWithContext(ctx)
+}
+
 // ValidateBook is a middleware handler for schema validation.
 // This enables us to encapsulate user input validation without worrying about it in every handler.
 // As seen in `Start()`, we can register it as a middleware handler easily.
 func (s *Server) ValidateBook(c *fiber.Ctx) error {
-	var errors []*data.BookValidationError
-	body := new(data.Book)
-	c.BodyParser(&body)
+	return s.validateBody(c, new(data.Book))
+}
+
+// ValidateReview is a middleware handler for schema validation of reviews, see ValidateBook.
+func (s *Server) ValidateReview(c *fiber.Ctx) error {
+	return s.validateBody(c, new(data.Review))
+}
+
+// validate returns a middleware handler which validates the request body against the schema of T, see ValidateBook.
+func validate[T any](s *Server) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return s.validateBody(c, new(T))
+	}
+}
+
+// validateBody parses the request body into the given struct pointer and validates it against its schema.
+// If the body is invalid, the list of validation errors is returned to the client. Otherwise, the next handler is called.
+func (s *Server) validateBody(c *fiber.Ctx, body interface{}) error {
+	var errors []*data.ValidationError
+	c.BodyParser(body)
 	err := s.validator.Struct(body)
 	if err != nil {
 		for _, err := range err.(validator.ValidationErrors) {
-			var el data.BookValidationError
+			var el data.ValidationError
 			el.Field = err.Field()
 			el.Tag = err.Tag()
 			el.Value = err.Param()
@@ -90,26 +250,81 @@ func (s *Server) ValidateBook(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// pagination reads the `page` and `size` query parameters. Pages start at 1, the size defaults to 20 and is capped at 100.
+func pagination(c *fiber.Ctx) (int, int, error) {
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		return 0, 0, fiber.NewError(fiber.ErrBadRequest.Code, "query parameter 'page' must be at least 1")
+	}
+	size := c.QueryInt("size", 20)
+	if size < 1 || size > 100 {
+		return 0, 0, fiber.NewError(fiber.ErrBadRequest.Code, "query parameter 'size' must be between 1 and 100")
+	}
+	return page, size, nil
+}
+
 // handleGetBookById checks if a correct ID has been requested, a book with the requested ID
-// exists in the store and returns it if it exists.
+// exists in the store and returns it if it exists. With the `asOf` query parameter, the book is returned as it was at that time.
+// The current version of the book is returned as ETag, see handleUpdateBook.
 func (s *Server) handleGetBookById(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
 	}
-	book, err := s.store.Get(id)
+	if c.Query("asOf") != "" {
+		return s.handleGetBookAsOf(c, id)
+	}
+	book, err := s.store.Get(c.UserContext(), id)
 	if err != nil {
 		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
 	}
+	// The view only feeds the popularity of suggestions, so failing to record it must not fail the request.
+	_ = s.store.RecordView(c.UserContext(), id)
+	setETag(c, book)
 	return c.JSON(book)
 }
 
 // handleGetAllBooks calls the configured store and returns a JSON list of all existing books.
 func (s *Server) handleGetAllBooks(c *fiber.Ctx) error {
-	books := s.store.GetAll()
+	books, err := s.store.GetAll(c.UserContext())
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
 	return c.JSON(books)
 }
 
+// handleSearchBooks runs a full-text search for the `q` query parameter and returns the ranked results.
+// An empty query is rejected since it would not match anything anyway.
+func (s *Server) handleSearchBooks(c *fiber.Ctx) error {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		return fiber.NewError(fiber.ErrBadRequest.Code, "query parameter 'q' must not be empty")
+	}
+	results, err := s.store.Search(c.UserContext(), query)
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(results)
+}
+
+// handleSuggestBooks returns title suggestions for the `prefix` query parameter, e.g. for a search-as-you-type box.
+// The number of suggestions can be controlled with `limit`, which defaults to 10 and is capped at 50.
+func (s *Server) handleSuggestBooks(c *fiber.Ctx) error {
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	if prefix == "" {
+		return fiber.NewError(fiber.ErrBadRequest.Code, "query parameter 'prefix' must not be empty")
+	}
+	limit := c.QueryInt("limit", 10)
+	if limit < 1 || limit > 50 {
+		return fiber.NewError(fiber.ErrBadRequest.Code, "query parameter 'limit' must be between 1 and 50")
+	}
+	suggestions, err := s.store.Suggest(c.UserContext(), prefix, limit)
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(suggestions)
+}
+
 // handleCreateBook validates the request body. If the body is not a valid book, an error is returned.
 // If the request body is valid, it calls the store to persist the book.
 // If any error occurs during persisting the book, the error is returned.
@@ -120,7 +335,7 @@ func (s *Server) handleCreateBook(c *fiber.Ctx) error {
 	if err != nil {
 		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
 	}
-	resultBook, err := s.store.Create(book)
+	resultBook, err := s.store.Create(s.storageContext(c), book)
 	if err != nil {
 		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
 	}
@@ -128,14 +343,14 @@ func (s *Server) handleCreateBook(c *fiber.Ctx) error {
 }
 
 // handleDeleteBook validates the requested book ID. If it is valid, the store is called to check
-// if there is a book with the given ID. If the ID is found, the book is deleted.
+// if there is a book with the given ID. If the ID is found, the book is moved to the trash, from where it can be restored until it is purged.
 // If any error occurs, it is returned to the client.
 func (s *Server) handleDeleteBook(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
 	}
-	if err = s.store.Delete(id); err != nil {
+	if err = s.store.Delete(s.storageContext(c), id); err != nil {
 		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
 	}
 	return c.SendStatus(fiber.StatusOK)
@@ -144,19 +359,90 @@ func (s *Server) handleDeleteBook(c *fiber.Ctx) error {
 // handleUpdateBook validates the request body to be a book.
 // If the body is valid, the book is being looked up in the store.
 // If the book exists, it is updated and the updated book is returned to the client.
+// The version the update is based on can be sent in the body or in the If-Match header. If the book has been changed since, 412 Precondition Failed is returned.
 func (s *Server) handleUpdateBook(c *fiber.Ctx) error {
 	book := new(data.Book)
 	err := c.BodyParser(book)
 	if err != nil {
 		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
 	}
-	book, err = s.store.Update(book)
+	expected, err := ifMatch(c)
 	if err != nil {
-		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+		return err
+	}
+	if expected != 0 {
+		book.Version = expected
+	}
+	book, err = s.store.Update(s.storageContext(c), book)
+	if err != nil {
+		return versionError(err)
 	}
+	setETag(c, book)
 	return c.JSON(book)
 }
 
+// reviewError maps errors of the review storage to HTTP errors. Missing books and reviews are answered with 404 Not Found.
+// Everything else, e.g. a database which can not be reached, is a failure of the server.
+func reviewError(err error) error {
+	if storage.IsNotFound(err) {
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	}
+	return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+}
+
+// handleCreateReview adds a review to the book with the requested ID.
+// The book's rating aggregate is updated by the store, the created review is returned to the client.
+func (s *Server) handleCreateReview(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	review := new(data.Review)
+	if err := c.BodyParser(review); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	review.BookID = id
+	review, err = s.store.CreateReview(c.UserContext(), review)
+	if err != nil {
+		return reviewError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(review)
+}
+
+// handleGetReviews returns a page of reviews of the book with the requested ID, newest first.
+func (s *Server) handleGetReviews(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	page, size, err := pagination(c)
+	if err != nil {
+		return err
+	}
+	reviews, err := s.store.GetReviews(c.UserContext(), id, page, size)
+	if err != nil {
+		return reviewError(err)
+	}
+	return c.JSON(reviews)
+}
+
+// handleDeleteReview removes a single review of the book with the requested ID.
+func (s *Server) handleDeleteReview(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	reviewID, err := c.ParamsInt("reviewId")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	if err = s.store.DeleteReview(c.UserContext(), id, reviewID); err != nil {
+		return reviewError(err)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// handleHealthCheck is kept for existing clients, it only reports liveness like handleLivez.
 func (s *Server) handleHealthCheck(c *fiber.Ctx) error {
 	status := data.HealthStatus{
 		Message: "ok",
@@ -1,17 +1,36 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	fastws "github.com/fasthttp/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/torbendury/books-go/data"
 	"github.com/torbendury/books-go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var testCreateBook = data.Book{
@@ -26,12 +45,14 @@ var testBookList = []data.Book{
 		Description: "Test1",
 		Price:       1.11,
 		ID:          1,
+		Version:     1,
 	},
 	{
 		Title:       "Test1",
 		Description: "Test1",
 		Price:       1.11,
 		ID:          2,
+		Version:     1,
 	},
 }
 
@@ -57,6 +78,26 @@ func setupServer() *Server {
 	return NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{})
 }
 
+// setupUnreachableServer returns a server whose database refuses every connection, so every operation of its storage fails.
+func setupUnreachableServer() *Server {
+	var down atomic.Bool
+	var attempts atomic.Int32
+	down.Store(true)
+	return NewServer(storage.NewPostgresqlStorage(sql.OpenDB(flakyConnector{down: &down, attempts: &attempts})), ":3000", fiber.Config{})
+}
+
+// assertStorageFailure sends a request to a server set up with setupUnreachableServer and expects it to be answered with 500,
+// so a failing storage is not mistaken for a missing resource.
+func assertStorageFailure(t *testing.T, server *Server, method string, target string, body string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := server.fiberApp.Test(req, -1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 500, resp.StatusCode, method+" "+target)
+	}
+}
+
 func Test_handleCreateBook(t *testing.T) {
 	// grab a fresh server
 	server := setupServer()
@@ -91,7 +132,7 @@ func Test_handleGetBookById(t *testing.T) {
 	server.fiberApp.Get("/book/:id", server.handleGetBookById)
 
 	// insert test data
-	_, err := server.store.Create(&testCreateBook)
+	_, err := server.store.Create(context.Background(), &testCreateBook)
 	if err != nil {
 		t.Error(err)
 	}
@@ -135,13 +176,13 @@ func Test_handleGetAllBooks(t *testing.T) {
 	server.fiberApp.Get("/books", server.handleGetAllBooks)
 
 	// insert test data
-	_, err := server.store.Create(&testCreateBook)
+	_, err := server.store.Create(context.Background(), &testCreateBook)
 	if err != nil {
 		t.Error(err)
 	}
 
 	// insert test data
-	_, err = server.store.Create(&testCreateBook)
+	_, err = server.store.Create(context.Background(), &testCreateBook)
 	if err != nil {
 		t.Error(err)
 	}
@@ -159,6 +200,15 @@ func Test_handleGetAllBooks(t *testing.T) {
 		t.Error(err)
 	}
 	assert.Equal(t, testBookList, responseBook)
+
+	// a storage which can not read the books fails the request instead of the server, e.g. while the database is unreachable
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Get("/books", unreachable.handleGetAllBooks)
+	resp, _ = unreachable.fiberApp.Test(httptest.NewRequest("GET", "/books", nil), -1)
+	assert.Equal(t, 500, resp.StatusCode)
+	cache := storage.NewCachedStorage(unreachable.store, 10, time.Minute)
+	assert.ErrorContains(t, cache.Warm(context.Background()), "connection refused")
+	assert.Error(t, cache.CheckWarm(context.Background()))
 }
 
 func Test_handleUpdateBook(t *testing.T) {
@@ -168,7 +218,7 @@ func Test_handleUpdateBook(t *testing.T) {
 	server.fiberApp.Put("/book", server.handleUpdateBook)
 
 	// insert test data
-	_, err := server.store.Create(&testCreateBook)
+	_, err := server.store.Create(context.Background(), &testCreateBook)
 	if err != nil {
 		t.Error(err)
 	}
@@ -193,7 +243,10 @@ func Test_handleUpdateBook(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Equal(t, testUpdateBook, responseBook)
+	// every update is a new version
+	updatedBook := testUpdateBook
+	updatedBook.Version = 2
+	assert.Equal(t, updatedBook, responseBook)
 
 	// non existing book
 	body, err = json.Marshal(nonExistingBook)
@@ -223,7 +276,7 @@ func Test_handleDeleteBook(t *testing.T) {
 	server.fiberApp.Delete("/book/:id", server.handleDeleteBook)
 
 	// insert test data
-	_, err := server.store.Create(&testCreateBook)
+	_, err := server.store.Create(context.Background(), &testCreateBook)
 	if err != nil {
 		t.Error(err)
 	}
@@ -262,3 +315,2300 @@ func Test_handleHealthCheck(t *testing.T) {
 	}
 	assert.Equal(t, `{"message":"ok"}`, string(body))
 }
+
+func Test_handleSearchBooks(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary route
+	server.fiberApp.Get("/books/search", server.handleSearchBooks)
+
+	// insert test data
+	for _, book := range []data.Book{
+		{Title: "Reading for beginners", Description: "How to read books", Price: 1.11},
+		{Title: "Cooking", Description: "Recipes for people who like reading", Price: 2.22},
+		{Title: "Gardening", Description: "Plants and flowers", Price: 3.33},
+	} {
+		book := book
+		if _, err := server.store.Create(context.Background(), &book); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// stemmed match in title and description, title matches rank higher
+	req := httptest.NewRequest("GET", "/books/search?q=reads", nil)
+	resp, _ := server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	defer resp.Body.Close()
+	var results []data.SearchResult
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		t.Error(err)
+	}
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, 1, results[0].Book.ID)
+		assert.Equal(t, 2, results[1].Book.ID)
+		assert.Contains(t, results[0].Snippet, "<b>Reading</b>")
+	}
+
+	// stop words only, nothing should match
+	req = httptest.NewRequest("GET", "/books/search?q=the", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// empty query, this should return 400
+	req = httptest.NewRequest("GET", "/books/search?q=", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func Test_handleSuggestBooks(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Get("/books/suggest", server.handleSuggestBooks)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+
+	// insert test data
+	for _, book := range []data.Book{
+		{Title: "Crème Brûlée for Programmers", Description: "Desserts", Price: 1.11},
+		{Title: "Creative Coding", Description: "Art", Price: 2.22},
+		{Title: "Bitter tears of software architects", Description: "Drama", Price: 3.33},
+	} {
+		book := book
+		if _, err := server.store.Create(context.Background(), &book); err != nil {
+			t.Error(err)
+		}
+	}
+	// make the second book more popular
+	req := httptest.NewRequest("GET", "/book/2", nil)
+	resp, _ := server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	suggest := func(query string) []data.Suggestion {
+		req := httptest.NewRequest("GET", "/books/suggest?"+query, nil)
+		resp, _ := server.fiberApp.Test(req, -1)
+		assert.Equal(t, 200, resp.StatusCode)
+		defer resp.Body.Close()
+		var suggestions []data.Suggestion
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, &suggestions)
+		if err != nil {
+			t.Error(err)
+		}
+		return suggestions
+	}
+
+	// exact prefix, ranked by popularity
+	suggestions := suggest("prefix=cre")
+	if assert.Len(t, suggestions, 2) {
+		assert.Equal(t, 2, suggestions[0].ID)
+		assert.Equal(t, int64(1), suggestions[0].Popularity)
+		assert.Equal(t, 1, suggestions[1].ID)
+	}
+
+	// case and diacritic insensitive
+	suggestions = suggest("prefix=CREME")
+	if assert.Len(t, suggestions, 1) {
+		assert.Equal(t, "Crème Brûlée for Programmers", suggestions[0].Title)
+	}
+
+	// typo tolerant, also matches words inside the title
+	suggestions = suggest("prefix=tesrs")
+	if assert.Len(t, suggestions, 1) {
+		assert.Equal(t, 3, suggestions[0].ID)
+	}
+
+	// limit
+	assert.Len(t, suggest("prefix=cre&limit=1"), 1)
+
+	// deleted books are not suggested anymore
+	if err := server.store.Delete(context.Background(), 3); err != nil {
+		t.Error(err)
+	}
+	assert.Len(t, suggest("prefix=bitter"), 0)
+
+	// invalid requests, these should return 400
+	req = httptest.NewRequest("GET", "/books/suggest?prefix=", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 400, resp.StatusCode)
+	req = httptest.NewRequest("GET", "/books/suggest?prefix=cre&limit=0", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func Test_handleReviews(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Post("/book/:id/reviews", server.ValidateReview, server.handleCreateReview)
+	server.fiberApp.Get("/book/:id/reviews", server.handleGetReviews)
+	server.fiberApp.Delete("/book/:id/reviews/:reviewId", server.handleDeleteReview)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+	server.fiberApp.Delete("/book/:id", server.handleDeleteBook)
+
+	// insert test data
+	book := testCreateBook
+	if _, err := server.store.Create(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+
+	// create reviews
+	for _, review := range []string{
+		`{"rating": 5, "text": "Great", "author": "Anna"}`,
+		`{"rating": 4, "text": "Good", "author": "Bert"}`,
+		`{"rating": 4, "text": "Good, too", "author": "Carl"}`,
+	} {
+		req := httptest.NewRequest("POST", "/book/1/reviews", bytes.NewBufferString(review))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		assert.Equal(t, 202, resp.StatusCode)
+	}
+
+	// invalid rating, this should return 400
+	req := httptest.NewRequest("POST", "/book/1/reviews", bytes.NewBufferString(`{"rating": 6, "author": "Dora"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := server.fiberApp.Test(req, -1)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// nonexisting book, this should return 404
+	req = httptest.NewRequest("POST", "/book/420/reviews", bytes.NewBufferString(`{"rating": 1, "author": "Dora"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// second page, newest first
+	req = httptest.NewRequest("GET", "/book/1/reviews?page=2&size=2", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	var page data.ReviewPage
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(body, &page)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, 3, page.Total)
+	if assert.Len(t, page.Reviews, 1) {
+		assert.Equal(t, "Anna", page.Reviews[0].Author)
+	}
+
+	// pages far beyond the last one are empty, their offset does not overflow
+	req = httptest.NewRequest("GET", "/book/1/reviews?page=288230376151711744&size=64", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	page = data.ReviewPage{}
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(body, &page)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, 3, page.Total)
+	assert.Empty(t, page.Reviews)
+
+	// the aggregate is returned with the book
+	getBook := func() data.Book {
+		req := httptest.NewRequest("GET", "/book/1", nil)
+		resp, _ := server.fiberApp.Test(req, -1)
+		assert.Equal(t, 200, resp.StatusCode)
+		var responseBook data.Book
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, &responseBook)
+		if err != nil {
+			t.Error(err)
+		}
+		return responseBook
+	}
+	assert.Equal(t, &data.RatingSummary{Average: 13.0 / 3, Count: 3, Histogram: [5]int{0, 0, 0, 2, 1}}, getBook().Rating)
+
+	// deleting a review updates the aggregate
+	req = httptest.NewRequest("DELETE", "/book/1/reviews/1", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, &data.RatingSummary{Average: 4, Count: 2, Histogram: [5]int{0, 0, 0, 2, 0}}, getBook().Rating)
+
+	// nonexisting review, this should return 404
+	req = httptest.NewRequest("DELETE", "/book/1/reviews/1", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// deleting the book cascades to its reviews
+	req = httptest.NewRequest("DELETE", "/book/1", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	req = httptest.NewRequest("GET", "/book/1/reviews", nil)
+	resp, _ = server.fiberApp.Test(req, -1)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// failures of the storage are not mistaken for missing books or reviews
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Post("/book/:id/reviews", unreachable.ValidateReview, unreachable.handleCreateReview)
+	unreachable.fiberApp.Get("/book/:id/reviews", unreachable.handleGetReviews)
+	unreachable.fiberApp.Delete("/book/:id/reviews/:reviewId", unreachable.handleDeleteReview)
+	assertStorageFailure(t, unreachable, "POST", "/book/1/reviews", `{"rating": 1, "author": "Dora"}`)
+	assertStorageFailure(t, unreachable, "GET", "/book/1/reviews", "")
+	assertStorageFailure(t, unreachable, "DELETE", "/book/1/reviews/1", "")
+}
+
+func Test_handleInventory(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Get("/book/:id/stock", server.handleGetStock)
+	server.fiberApp.Post("/book/:id/stock/increment", validate[data.StockAdjustment](server), server.handleIncrementStock)
+	server.fiberApp.Post("/book/:id/stock/decrement", validate[data.StockAdjustment](server), server.handleDecrementStock)
+	server.fiberApp.Put("/book/:id/stock/threshold", validate[data.StockThreshold](server), server.handleSetLowStockThreshold)
+	server.fiberApp.Get("/book/:id/stock/ledger", server.handleGetStockLedger)
+	server.fiberApp.Post("/book/:id/reservations", validate[data.ReservationRequest](server), server.handleCreateReservation)
+	server.fiberApp.Post("/reservations/:id/release", server.handleReleaseReservation)
+	server.fiberApp.Post("/reservations/:id/fulfil", server.handleFulfilReservation)
+	server.fiberApp.Get("/stock/low", server.handleGetLowStock)
+
+	// insert test data
+	book := testCreateBook
+	if _, err := server.store.Create(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	stock := func() data.StockLevel {
+		resp := send("GET", "/book/1/stock", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		var level data.StockLevel
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, &level)
+		if err != nil {
+			t.Error(err)
+		}
+		return level
+	}
+
+	// books without inventory have no stock
+	assert.Equal(t, data.StockLevel{BookID: 1}, stock())
+
+	// increment, decrement and never go negative
+	assert.Equal(t, 200, send("POST", "/book/1/stock/increment", `{"quantity": 5}`).StatusCode)
+	assert.Equal(t, 200, send("POST", "/book/1/stock/decrement", `{"quantity": 2}`).StatusCode)
+	assert.Equal(t, 409, send("POST", "/book/1/stock/decrement", `{"quantity": 4}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/book/1/stock/decrement", `{"quantity": -4}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/book/1/stock/increment", `{"quantity": 100001}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/book/1/stock/increment", `{"quantity": 9223372036854775807}`).StatusCode)
+	assert.Equal(t, 404, send("POST", "/book/420/stock/increment", `{"quantity": 1}`).StatusCode)
+	assert.Equal(t, 3, stock().Quantity)
+
+	// reserved copies are not available anymore
+	assert.Equal(t, 202, send("POST", "/book/1/reservations", `{"quantity": 2}`).StatusCode)
+	assert.Equal(t, 409, send("POST", "/book/1/reservations", `{"quantity": 2}`).StatusCode)
+	assert.Equal(t, 409, send("POST", "/book/1/stock/decrement", `{"quantity": 2}`).StatusCode)
+	assert.Equal(t, data.StockLevel{BookID: 1, Quantity: 3, Reserved: 2, Available: 1}, stock())
+
+	// low stock threshold
+	assert.Equal(t, 200, send("PUT", "/book/1/stock/threshold", `{"threshold": 1}`).StatusCode)
+	assert.True(t, stock().LowStock)
+	resp := send("GET", "/stock/low", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var levels []data.StockLevel
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(body, &levels)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Len(t, levels, 1)
+
+	// fulfilled reservations decrement the stock, finished reservations can not be finished again
+	assert.Equal(t, 200, send("POST", "/reservations/1/fulfil", "").StatusCode)
+	assert.Equal(t, 409, send("POST", "/reservations/1/release", "").StatusCode)
+	assert.Equal(t, 404, send("POST", "/reservations/420/release", "").StatusCode)
+	assert.Equal(t, data.StockLevel{BookID: 1, Quantity: 1, Available: 1, LowStockThreshold: 1, LowStock: true}, stock())
+
+	// expired reservations do not count anymore and can not be fulfilled
+	if _, err := server.store.Reserve(context.Background(), 1, 1, time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 1, stock().Available)
+	assert.Equal(t, 409, send("POST", "/reservations/2/fulfil", "").StatusCode)
+
+	// concurrent decrements never let the stock drop below zero
+	if _, err := server.store.AdjustStock(context.Background(), 1, 9); err != nil {
+		t.Error(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = server.store.AdjustStock(context.Background(), 1, -1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, stock().Quantity)
+
+	// every movement has been recorded
+	resp = send("GET", "/book/1/stock/ledger", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var movements []data.StockMovement
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(body, &movements)
+	if err != nil {
+		t.Error(err)
+	}
+	reasons := make([]string, 0, len(movements))
+	for _, movement := range movements[:6] {
+		reasons = append(reasons, movement.Reason)
+	}
+	assert.Equal(t, []string{"increment", "decrement", "reserve", "fulfil", "reserve", "expire"}, reasons)
+	assert.Len(t, movements, 17)
+
+	// failures of the storage are not mistaken for missing books or reservations
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Get("/book/:id/stock", unreachable.handleGetStock)
+	unreachable.fiberApp.Post("/reservations/:id/release", unreachable.handleReleaseReservation)
+	assertStorageFailure(t, unreachable, "GET", "/book/1/stock", "")
+	assertStorageFailure(t, unreachable, "POST", "/reservations/1/release", "")
+}
+
+func Test_handleOrders(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Post("/orders", validate[data.Order](server), server.handleCreateOrder)
+	server.fiberApp.Get("/orders/:id", server.handleGetOrder)
+	server.fiberApp.Put("/orders/:id/status", validate[data.OrderStatusChange](server), server.handleUpdateOrderStatus)
+	server.fiberApp.Get("/customers/:customerId/orders", server.handleGetCustomerOrders)
+
+	// insert test data
+	book := testCreateBook
+	if _, err := server.store.Create(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// create an order, prices are captured from the book
+	resp := send("POST", "/orders", `{"customerId": "c1", "lines": [{"bookId": 1, "quantity": 3}]}`)
+	assert.Equal(t, 202, resp.StatusCode)
+	var order data.Order
+	decode(resp, &order)
+	assert.Equal(t, data.OrderPending, order.Status)
+	assert.Equal(t, 3.33, order.Total)
+	assert.Equal(t, []data.OrderLine{{BookID: 1, Quantity: 3, Title: "Test1", UnitPrice: 1.11, LineTotal: 3.33}}, order.Lines)
+
+	// later price changes do not affect existing orders
+	if _, err := server.store.Update(context.Background(), &data.Book{ID: 1, Title: "Test1", Description: "Test1", Price: 9.99}); err != nil {
+		t.Error(err)
+	}
+	resp = send("GET", "/orders/1", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &order)
+	assert.Equal(t, 3.33, order.Total)
+
+	// invalid orders
+	assert.Equal(t, 400, send("POST", "/orders", `{"customerId": "c1", "lines": []}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/orders", `{"customerId": "c1", "lines": [{"bookId": 420, "quantity": 1}]}`).StatusCode)
+	assert.Equal(t, 404, send("GET", "/orders/420", "").StatusCode)
+
+	// valid and invalid transitions
+	assert.Equal(t, 409, send("PUT", "/orders/1/status", `{"status": "shipped"}`).StatusCode)
+	assert.Equal(t, 200, send("PUT", "/orders/1/status", `{"status": "paid"}`).StatusCode)
+	assert.Equal(t, 200, send("PUT", "/orders/1/status", `{"status": "shipped"}`).StatusCode)
+	assert.Equal(t, 409, send("PUT", "/orders/1/status", `{"status": "cancelled"}`).StatusCode)
+	assert.Equal(t, 400, send("PUT", "/orders/1/status", `{"status": "lost"}`).StatusCode)
+	assert.Equal(t, 404, send("PUT", "/orders/420/status", `{"status": "paid"}`).StatusCode)
+
+	// list orders of a customer
+	assert.Equal(t, 202, send("POST", "/orders", `{"customerId": "c2", "lines": [{"bookId": 1, "quantity": 1}]}`).StatusCode)
+	resp = send("GET", "/customers/c1/orders", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var orders []data.Order
+	decode(resp, &orders)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, data.OrderShipped, orders[0].Status)
+	}
+
+	// failures of the storage are not mistaken for missing books or orders
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Post("/orders", validate[data.Order](unreachable), unreachable.handleCreateOrder)
+	unreachable.fiberApp.Get("/orders/:id", unreachable.handleGetOrder)
+	unreachable.fiberApp.Put("/orders/:id/status", validate[data.OrderStatusChange](unreachable), unreachable.handleUpdateOrderStatus)
+	assertStorageFailure(t, unreachable, "POST", "/orders", `{"customerId": "c1", "lines": [{"bookId": 1, "quantity": 3}]}`)
+	assertStorageFailure(t, unreachable, "GET", "/orders/1", "")
+	assertStorageFailure(t, unreachable, "PUT", "/orders/1/status", `{"status": "paid"}`)
+}
+
+func Test_handleLending(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Post("/book/:id/copies", validate[data.CopiesRequest](server), server.handleAddCopies)
+	server.fiberApp.Get("/book/:id/copies", server.handleGetCopies)
+	server.fiberApp.Post("/book/:id/loans", validate[data.BorrowerRequest](server), server.handleCheckOut)
+	server.fiberApp.Post("/book/:id/holds", validate[data.BorrowerRequest](server), server.handlePlaceHold)
+	server.fiberApp.Get("/book/:id/holds", server.handleGetHolds)
+	server.fiberApp.Get("/loans/overdue", server.handleGetOverdueLoans)
+	server.fiberApp.Post("/loans/:id/return", server.handleReturnLoan)
+	server.fiberApp.Post("/loans/:id/renew", server.handleRenewLoan)
+
+	// insert test data
+	book := testCreateBook
+	if _, err := server.store.Create(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// no copies, nothing to lend
+	assert.Equal(t, 409, send("POST", "/book/1/loans", `{"borrower": "anna"}`).StatusCode)
+	assert.Equal(t, 404, send("POST", "/book/420/copies", `{"count": 1}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/book/1/copies", `{"count": 0}`).StatusCode)
+
+	// a single copy can only be lent once
+	assert.Equal(t, 202, send("POST", "/book/1/copies", `{"count": 1}`).StatusCode)
+	resp := send("POST", "/book/1/loans", `{"borrower": "anna"}`)
+	assert.Equal(t, 202, resp.StatusCode)
+	var loan data.Loan
+	decode(resp, &loan)
+	assert.Equal(t, 1, loan.CopyID)
+	assert.Equal(t, 409, send("POST", "/book/1/loans", `{"borrower": "bert"}`).StatusCode)
+
+	// holds are served first-come first-served
+	assert.Equal(t, 202, send("POST", "/book/1/holds", `{"borrower": "bert"}`).StatusCode)
+	assert.Equal(t, 202, send("POST", "/book/1/holds", `{"borrower": "carl"}`).StatusCode)
+	assert.Equal(t, 409, send("POST", "/book/1/holds", `{"borrower": "carl"}`).StatusCode)
+
+	// renewals are denied while others are waiting
+	assert.Equal(t, 409, send("POST", "/loans/1/renew", "").StatusCode)
+
+	// the returned copy is put aside for the first hold
+	assert.Equal(t, 200, send("POST", "/loans/1/return", "").StatusCode)
+	assert.Equal(t, 409, send("POST", "/loans/1/return", "").StatusCode)
+	assert.Equal(t, 409, send("POST", "/book/1/loans", `{"borrower": "carl"}`).StatusCode)
+	resp = send("GET", "/book/1/holds", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var holds []data.Hold
+	decode(resp, &holds)
+	if assert.Len(t, holds, 2) {
+		assert.Equal(t, data.HoldReady, holds[0].Status)
+		assert.Equal(t, "bert", holds[0].Borrower)
+		assert.Equal(t, data.HoldWaiting, holds[1].Status)
+	}
+	assert.Equal(t, 202, send("POST", "/book/1/loans", `{"borrower": "bert"}`).StatusCode)
+
+	// new copies serve the next hold right away
+	assert.Equal(t, 202, send("POST", "/book/1/copies", `{"count": 1}`).StatusCode)
+	resp = send("GET", "/book/1/copies", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var copies []data.Copy
+	decode(resp, &copies)
+	assert.Equal(t, []data.Copy{
+		{ID: 1, BookID: 1, Status: data.CopyOnLoan},
+		{ID: 2, BookID: 1, Status: data.CopyOnHold, HeldFor: "carl"},
+	}, copies)
+
+	// renewals are limited
+	assert.Equal(t, 200, send("POST", "/loans/2/renew", "").StatusCode)
+	assert.Equal(t, 200, send("POST", "/loans/2/renew", "").StatusCode)
+	assert.Equal(t, 409, send("POST", "/loans/2/renew", "").StatusCode)
+	assert.Equal(t, 404, send("POST", "/loans/420/renew", "").StatusCode)
+
+	// overdue report
+	assert.Equal(t, 202, send("POST", "/book/1/loans", `{"borrower": "carl"}`).StatusCode)
+	overdue, err := server.store.OverdueLoans(context.Background(), time.Now().Add(loanPeriod+time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if assert.Len(t, overdue, 1) {
+		assert.Equal(t, "carl", overdue[0].Borrower)
+	}
+	resp = send("GET", "/loans/overdue", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var loans []data.Loan
+	decode(resp, &loans)
+	assert.Len(t, loans, 0)
+
+	// failures of the storage are not mistaken for missing books or loans
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Post("/book/:id/copies", validate[data.CopiesRequest](unreachable), unreachable.handleAddCopies)
+	unreachable.fiberApp.Get("/book/:id/copies", unreachable.handleGetCopies)
+	unreachable.fiberApp.Post("/book/:id/loans", validate[data.BorrowerRequest](unreachable), unreachable.handleCheckOut)
+	unreachable.fiberApp.Post("/book/:id/holds", validate[data.BorrowerRequest](unreachable), unreachable.handlePlaceHold)
+	unreachable.fiberApp.Get("/book/:id/holds", unreachable.handleGetHolds)
+	unreachable.fiberApp.Post("/loans/:id/return", unreachable.handleReturnLoan)
+	unreachable.fiberApp.Post("/loans/:id/renew", unreachable.handleRenewLoan)
+	assertStorageFailure(t, unreachable, "POST", "/book/1/copies", `{"count": 1}`)
+	assertStorageFailure(t, unreachable, "GET", "/book/1/copies", "")
+	assertStorageFailure(t, unreachable, "POST", "/book/1/loans", `{"borrower": "ada"}`)
+	assertStorageFailure(t, unreachable, "POST", "/book/1/holds", `{"borrower": "ada"}`)
+	assertStorageFailure(t, unreachable, "GET", "/book/1/holds", "")
+	assertStorageFailure(t, unreachable, "POST", "/loans/1/return", "")
+	assertStorageFailure(t, unreachable, "POST", "/loans/1/renew", "")
+}
+
+func Test_handleReadingLists(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Delete("/book/:id", server.handleDeleteBook)
+	server.fiberApp.Post("/users", validate[data.User](server), server.handleCreateUser)
+	server.fiberApp.Get("/users/:id", server.handleGetUser)
+	server.fiberApp.Get("/users/:id/lists/:list", server.handleGetReadingList)
+	server.fiberApp.Post("/users/:id/lists/:list/entries", validate[data.ListEntry](server), server.handleAddListEntry)
+	server.fiberApp.Put("/users/:id/lists/:list/entries/:bookId", validate[data.ListProgress](server), server.handleSetListProgress)
+	server.fiberApp.Delete("/users/:id/lists/:list/entries/:bookId", server.handleRemoveListEntry)
+	server.fiberApp.Put("/users/:id/lists/:list/order", validate[data.ListOrder](server), server.handleReorderList)
+
+	// insert test data
+	for i := 0; i < 3; i++ {
+		book := testCreateBook
+		if _, err := server.store.Create(context.Background(), &book); err != nil {
+			t.Error(err)
+		}
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	bookIDs := func(list data.ReadingList) []int {
+		ids := make([]int, 0, len(list.Entries))
+		for i, entry := range list.Entries {
+			assert.Equal(t, i, entry.Position)
+			ids = append(ids, entry.BookID)
+		}
+		return ids
+	}
+
+	// users
+	assert.Equal(t, 400, send("POST", "/users", `{"name": ""}`).StatusCode)
+	assert.Equal(t, 202, send("POST", "/users", `{"name": "ada"}`).StatusCode)
+	assert.Equal(t, 200, send("GET", "/users/1", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/users/420", "").StatusCode)
+
+	// lists start out empty, unknown lists do not exist
+	resp := send("GET", "/users/1/lists/wishlist", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var list data.ReadingList
+	decode(resp, &list)
+	assert.Empty(t, list.Entries)
+	assert.Equal(t, 404, send("GET", "/users/1/lists/favourites", "").StatusCode)
+
+	// entries are appended in order, books can only be added once
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Equal(t, 202, send("POST", "/users/1/lists/reading/entries", `{"bookId": `+id+`}`).StatusCode)
+	}
+	assert.Equal(t, 409, send("POST", "/users/1/lists/reading/entries", `{"bookId": 2}`).StatusCode)
+	assert.Equal(t, 404, send("POST", "/users/1/lists/reading/entries", `{"bookId": 420}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/users/1/lists/reading/entries", `{"bookId": 1, "progress": 101}`).StatusCode)
+
+	// progress
+	resp = send("PUT", "/users/1/lists/reading/entries/2", `{"progress": 42}`)
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &list)
+	assert.Equal(t, 42, list.Entries[1].Progress)
+	assert.Equal(t, 404, send("PUT", "/users/1/lists/reading/entries/420", `{"progress": 42}`).StatusCode)
+
+	// reordering requires every book exactly once
+	assert.Equal(t, 400, send("PUT", "/users/1/lists/reading/order", `{"bookIds": [3, 1]}`).StatusCode)
+	assert.Equal(t, 400, send("PUT", "/users/1/lists/reading/order", `{"bookIds": [3, 1, 1]}`).StatusCode)
+	resp = send("PUT", "/users/1/lists/reading/order", `{"bookIds": [3, 1, 2]}`)
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &list)
+	assert.Equal(t, []int{3, 1, 2}, bookIDs(list))
+
+	// removing entries closes the gap
+	resp = send("DELETE", "/users/1/lists/reading/entries/1", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &list)
+	assert.Equal(t, []int{3, 2}, bookIDs(list))
+	assert.Equal(t, 404, send("DELETE", "/users/1/lists/reading/entries/1", "").StatusCode)
+
+	// deleting a book hides it from all lists, restoring it brings it back
+	assert.Equal(t, 202, send("POST", "/users/1/lists/wishlist/entries", `{"bookId": 3}`).StatusCode)
+	assert.Equal(t, 200, send("DELETE", "/book/3", "").StatusCode)
+	resp = send("GET", "/users/1/lists/wishlist", "")
+	decode(resp, &list)
+	assert.Empty(t, list.Entries)
+	resp = send("GET", "/users/1/lists/reading", "")
+	decode(resp, &list)
+	assert.Equal(t, []int{2}, bookIDs(list))
+	// hidden entries are not part of the order
+	assert.Equal(t, 200, send("PUT", "/users/1/lists/reading/order", `{"bookIds": [2]}`).StatusCode)
+	_, err := server.store.Restore(context.Background(), 3)
+	assert.NoError(t, err)
+	resp = send("GET", "/users/1/lists/reading", "")
+	decode(resp, &list)
+	assert.Equal(t, []int{2, 3}, bookIDs(list))
+
+	// purging a book removes it from all lists
+	assert.Equal(t, 200, send("DELETE", "/book/3", "").StatusCode)
+	purged, err := server.store.Purge(context.Background(), time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	resp = send("GET", "/users/1/lists/reading", "")
+	decode(resp, &list)
+	assert.Equal(t, []int{2}, bookIDs(list))
+	assert.Equal(t, 42, list.Entries[0].Progress)
+	resp = send("GET", "/users/1/lists/wishlist", "")
+	decode(resp, &list)
+	assert.Empty(t, list.Entries)
+
+	// failures of the storage are not mistaken for missing users, books or entries
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Get("/users/:id", unreachable.handleGetUser)
+	unreachable.fiberApp.Get("/users/:id/lists/:list", unreachable.handleGetReadingList)
+	unreachable.fiberApp.Post("/users/:id/lists/:list/entries", validate[data.ListEntry](unreachable), unreachable.handleAddListEntry)
+	unreachable.fiberApp.Put("/users/:id/lists/:list/entries/:bookId", validate[data.ListProgress](unreachable), unreachable.handleSetListProgress)
+	unreachable.fiberApp.Delete("/users/:id/lists/:list/entries/:bookId", unreachable.handleRemoveListEntry)
+	unreachable.fiberApp.Put("/users/:id/lists/:list/order", validate[data.ListOrder](unreachable), unreachable.handleReorderList)
+	assertStorageFailure(t, unreachable, "GET", "/users/1", "")
+	assertStorageFailure(t, unreachable, "GET", "/users/1/lists/reading", "")
+	assertStorageFailure(t, unreachable, "POST", "/users/1/lists/reading/entries", `{"bookId": 2}`)
+	assertStorageFailure(t, unreachable, "PUT", "/users/1/lists/reading/entries/2", `{"progress": 42}`)
+	assertStorageFailure(t, unreachable, "DELETE", "/users/1/lists/reading/entries/2", "")
+	assertStorageFailure(t, unreachable, "PUT", "/users/1/lists/reading/order", `{"bookIds": [2]}`)
+}
+
+func Test_authorizeScopes(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Get("/books", server.authorize(data.ScopeBooksRead), server.handleGetAllBooks)
+	server.fiberApp.Post("/book", server.authorize(data.ScopeBooksWrite), server.ValidateBook, server.handleCreateBook)
+
+	reader, err := IssueAPIKey(context.Background(), server.store, "reader", []string{data.ScopeBooksRead})
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, key string, body string) int {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp.StatusCode
+	}
+	book, _ := json.Marshal(testCreateBook)
+
+	assert.Equal(t, 401, send("GET", "/books", "", ""))
+	assert.Equal(t, 401, send("GET", "/books", "bgo_guessed", ""))
+	assert.Equal(t, 200, send("GET", "/books", reader.Key, ""))
+	assert.Equal(t, 403, send("POST", "/book", reader.Key, string(book)))
+
+	// revoked keys are rejected
+	if _, err := server.store.RevokeAPIKey(context.Background(), reader.ID); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, 401, send("GET", "/books", reader.Key, ""))
+}
+
+func Test_handleAPIKeys(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	admin := server.authorize(data.ScopeKeysAdmin)
+	server.fiberApp.Get("/books", server.authorize(data.ScopeBooksRead), server.handleGetAllBooks)
+	server.fiberApp.Post("/keys", admin, validate[data.APIKeyRequest](server), server.handleIssueAPIKey)
+	server.fiberApp.Get("/keys", admin, server.handleGetAPIKeys)
+	server.fiberApp.Post("/keys/:id/rotate", admin, server.handleRotateAPIKey)
+	server.fiberApp.Delete("/keys/:id", admin, server.handleRevokeAPIKey)
+
+	root, err := IssueAPIKey(context.Background(), server.store, "root", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, key string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// issue a key, its secret is never listed
+	assert.Equal(t, 400, send("POST", "/keys", root.Key, `{"name": "ci", "scopes": ["books:delete"]}`).StatusCode)
+	resp := send("POST", "/keys", root.Key, `{"name": "ci", "scopes": ["books:read"]}`)
+	assert.Equal(t, 202, resp.StatusCode)
+	var issued data.IssuedAPIKey
+	decode(resp, &issued)
+	assert.Equal(t, 2, issued.ID)
+	assert.True(t, strings.HasPrefix(issued.Key, issued.Prefix))
+	assert.Equal(t, 403, send("GET", "/keys", issued.Key, "").StatusCode)
+	resp = send("GET", "/keys", root.Key, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.NotContains(t, string(body), issued.Key)
+
+	// rotating replaces the secret
+	resp = send("POST", "/keys/2/rotate", root.Key, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var rotated data.IssuedAPIKey
+	decode(resp, &rotated)
+	assert.NotEqual(t, issued.Key, rotated.Key)
+	assert.Equal(t, []string{data.ScopeBooksRead}, rotated.Scopes)
+	assert.Equal(t, 401, send("GET", "/books", issued.Key, "").StatusCode)
+	assert.Equal(t, 200, send("GET", "/books", rotated.Key, "").StatusCode)
+
+	// revoked keys can not be rotated or revoked again
+	assert.Equal(t, 200, send("DELETE", "/keys/2", root.Key, "").StatusCode)
+	assert.Equal(t, 409, send("DELETE", "/keys/2", root.Key, "").StatusCode)
+	assert.Equal(t, 409, send("POST", "/keys/2/rotate", root.Key, "").StatusCode)
+	assert.Equal(t, 404, send("POST", "/keys/420/rotate", root.Key, "").StatusCode)
+	assert.Equal(t, 404, send("DELETE", "/keys/420", root.Key, "").StatusCode)
+	assert.Equal(t, 401, send("GET", "/books", rotated.Key, "").StatusCode)
+
+	// failures of the storage are not mistaken for missing keys
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Post("/keys/:id/rotate", unreachable.handleRotateAPIKey)
+	unreachable.fiberApp.Delete("/keys/:id", unreachable.handleRevokeAPIKey)
+	assertStorageFailure(t, unreachable, "POST", "/keys/2/rotate", "")
+	assertStorageFailure(t, unreachable, "DELETE", "/keys/2", "")
+
+	// keys can also be managed from the command line
+	var out bytes.Buffer
+	assert.Error(t, RunKeyCommand(context.Background(), server.store, []string{"issue", "-name", "cli", "-scopes", "books:delete"}, &out))
+	assert.NoError(t, RunKeyCommand(context.Background(), server.store, []string{"issue", "-name", "cli", "-scopes", "books:read,books:write"}, &out))
+	decode(&http.Response{Body: io.NopCloser(&out)}, &issued)
+	assert.Equal(t, []string{data.ScopeBooksRead, data.ScopeBooksWrite}, issued.Scopes)
+	assert.Equal(t, 200, send("GET", "/books", issued.Key, "").StatusCode)
+}
+
+func Test_authorizeRoles(t *testing.T) {
+	signer := newEd25519Signer(t, "ed")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signer)
+	verifier, err := NewJWTVerifier(JWTConfig{JWKS: path, Issuer: "https://gateway.example", Audience: "books-go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithJWTVerifier(verifier), WithAuditLog(&audit))
+	// register necessary routes
+	server.fiberApp.Get("/books", server.authorize(data.ScopeBooksRead), server.handleGetAllBooks)
+	server.fiberApp.Post("/book", server.authorize(data.ScopeBooksWrite, server.newBookOfBody), server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Put("/book", server.authorize(data.ScopeBooksWrite, server.bookOfBody), server.ValidateBook, server.handleUpdateBook)
+	server.fiberApp.Delete("/book/:id", server.authorize(data.ScopeBooksWrite, server.bookOfParam), server.handleDeleteBook)
+	server.fiberApp.Post("/orders", server.authorize(data.ScopeBooksWrite), validate[data.Order](server), server.handleCreateOrder)
+	server.fiberApp.Get("/keys", server.authorize(data.ScopeKeysAdmin), server.handleGetAPIKeys)
+
+	// insert test data
+	for _, publisher := range []string{"acme", "other"} {
+		if _, err := server.store.Create(context.Background(), &data.Book{Title: "Test1", Description: "Test1", Price: 1.11, Publisher: publisher}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	token := func(role string, publisher string) string {
+		claims := testClaims(0)
+		delete(claims, "scope")
+		claims["sub"] = role
+		claims["roles"] = []string{role}
+		claims["publisher"] = publisher
+		return signer.sign(t, claims)
+	}
+	viewer, editor, admin := token("viewer", ""), token("editor", "acme"), token("admin", "")
+	send := func(method string, target string, token string, body string) int {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp.StatusCode
+	}
+
+	// viewers can only read
+	assert.Equal(t, 200, send("GET", "/books", viewer, ""))
+	assert.Equal(t, 403, send("POST", "/book", viewer, `{"title": "T", "description": "D", "price": 1, "publisher": "acme"}`))
+
+	// editors can only write books of their publisher
+	assert.Equal(t, 200, send("GET", "/books", editor, ""))
+	assert.Equal(t, 202, send("POST", "/book", editor, `{"title": "T", "description": "D", "price": 1, "publisher": "acme"}`))
+	assert.Equal(t, 403, send("POST", "/book", editor, `{"title": "T", "description": "D", "price": 1, "publisher": "other"}`))
+	assert.Equal(t, 200, send("PUT", "/book", editor, `{"id": 1, "title": "T", "description": "D", "price": 2, "publisher": "acme"}`))
+	assert.Equal(t, 403, send("PUT", "/book", editor, `{"id": 1, "title": "T", "description": "D", "price": 2, "publisher": "other"}`))
+	assert.Equal(t, 403, send("PUT", "/book", editor, `{"id": 2, "title": "T", "description": "D", "price": 2, "publisher": "acme"}`))
+	assert.Equal(t, 403, send("DELETE", "/book/2", editor, ""))
+	assert.Equal(t, 200, send("DELETE", "/book/3", editor, ""))
+	assert.Equal(t, 403, send("POST", "/orders", editor, `{"customerId": "c1", "lines": [{"bookId": 1, "quantity": 1}]}`))
+	assert.Equal(t, 403, send("GET", "/keys", editor, ""))
+
+	// missing books are reported by the handler instead of being denied, as long as the editor belongs to a publisher
+	assert.Equal(t, 404, send("DELETE", "/book/420", editor, ""))
+	assert.Equal(t, 403, send("DELETE", "/book/420", token("editor", ""), ""))
+
+	// admins can do everything
+	assert.Equal(t, 200, send("DELETE", "/book/2", admin, ""))
+	assert.Equal(t, 200, send("GET", "/keys", admin, ""))
+
+	// denials are audit-logged
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	assert.Len(t, lines, 8)
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &entry); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, "access_denied", entry["event"])
+	assert.Equal(t, "editor", entry["subject"])
+	assert.Equal(t, "/book", entry["path"])
+	assert.Equal(t, data.ScopeBooksWrite, entry["permission"])
+
+	// policies are validated when they are loaded
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policy, []byte(`{"roles": {"editor": [{"permission": "books:wirte"}]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadPolicy(policy)
+	assert.Error(t, err)
+}
+
+func Test_handleAuditEvents(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	write := server.authorize(data.ScopeBooksWrite)
+	server.fiberApp.Post("/book", write, server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Put("/book", write, server.ValidateBook, server.handleUpdateBook)
+	server.fiberApp.Delete("/book/:id", write, server.handleDeleteBook)
+	audit := server.authorize(data.ScopeAuditRead)
+	server.fiberApp.Get("/book/:id/history", audit, server.handleGetBookHistory)
+	server.fiberApp.Get("/audit", audit, server.handleGetAuditEvents)
+
+	key, err := IssueAPIKey(context.Background(), server.store, "editor", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, requestID string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key.Key)
+		req.Header.Set(RequestIDHeader, requestID)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// create, update and delete a book
+	book, _ := json.Marshal(testCreateBook)
+	update, _ := json.Marshal(testUpdateBook)
+	assert.Equal(t, 202, send("POST", "/book", "req-1", string(book)).StatusCode)
+	assert.Equal(t, 200, send("PUT", "/book", "req-2", string(update)).StatusCode)
+	assert.Equal(t, 200, send("DELETE", "/book/1", "req-3", "").StatusCode)
+	assert.Equal(t, 202, send("POST", "/book", "req-4", string(book)).StatusCode)
+
+	// the history outlives the book, newest first
+	resp := send("GET", "/book/1/history", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var history data.AuditPage
+	decode(resp, &history)
+	if assert.Len(t, history.Events, 3) {
+		assert.Equal(t, []string{data.AuditDelete, data.AuditUpdate, data.AuditCreate},
+			[]string{history.Events[0].Action, history.Events[1].Action, history.Events[2].Action})
+		updated := history.Events[1]
+		assert.Equal(t, fmt.Sprintf("apikey:%v", key.ID), updated.Actor)
+		assert.Equal(t, "req-2", updated.RequestID)
+		assert.Equal(t, []data.FieldChange{
+			{Field: "title", Before: "Test1", After: "Test2"},
+			{Field: "description", Before: "Test1", After: "Test2"},
+			{Field: "price", Before: 1.11, After: 2.22},
+		}, updated.Changes)
+		assert.Len(t, history.Events[0].Changes, 4)
+		assert.Nil(t, history.Events[0].Changes[0].After)
+	}
+
+	// like the audit log, the history names actors and request IDs, so readers of books can not see it
+	reader, err := IssueAPIKey(context.Background(), server.store, "reader", []string{data.ScopeBooksRead})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, target := range []string{"/book/1/history", "/audit"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set(APIKeyHeader, reader.Key)
+		resp, _ := server.fiberApp.Test(req, -1)
+		assert.Equal(t, 403, resp.StatusCode, target)
+	}
+
+	// the audit log can be filtered
+	resp = send("GET", "/audit?action=create", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var events data.AuditPage
+	decode(resp, &events)
+	assert.Equal(t, 2, events.Total)
+	resp = send("GET", "/audit?entityId=1&size=1&page=2", "", "")
+	decode(resp, &events)
+	assert.Equal(t, 3, events.Total)
+	if assert.Len(t, events.Events, 1) {
+		assert.Equal(t, "req-2", events.Events[0].RequestID)
+	}
+	resp = send("GET", "/audit?until="+url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "", "")
+	decode(resp, &events)
+	assert.Equal(t, 0, events.Total)
+	assert.Equal(t, 400, send("GET", "/audit?since=yesterday", "", "").StatusCode)
+
+	// pages far beyond the last one are empty, their offset does not overflow
+	for _, target := range []string{"/audit?page=288230376151711744&size=64", "/book/1/history?page=288230376151711744&size=64"} {
+		resp = send("GET", target, "", "")
+		assert.Equal(t, 200, resp.StatusCode, target)
+		events = data.AuditPage{}
+		decode(resp, &events)
+		assert.Greater(t, events.Total, 0, target)
+		assert.Empty(t, events.Events, target)
+	}
+}
+
+func Test_handleTrash(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	read := server.authorize(data.ScopeBooksRead)
+	write := server.authorize(data.ScopeBooksWrite)
+	server.fiberApp.Post("/book", write, server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Get("/book/:id", read, server.handleGetBookById)
+	server.fiberApp.Get("/books", read, server.handleGetAllBooks)
+	server.fiberApp.Delete("/book/:id", write, server.handleDeleteBook)
+	server.fiberApp.Post("/book/:id/reviews", write, server.ValidateReview, server.handleCreateReview)
+	server.fiberApp.Get("/book/:id/reviews", read, server.handleGetReviews)
+	server.fiberApp.Get("/book/:id/history", server.authorize(data.ScopeAuditRead), server.handleGetBookHistory)
+	server.fiberApp.Get("/trash", read, server.handleGetTrash)
+	server.fiberApp.Post("/book/:id/restore", write, server.handleRestoreBook)
+
+	key, err := IssueAPIKey(context.Background(), server.store, "editor", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key.Key)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	book, _ := json.Marshal(testCreateBook)
+	assert.Equal(t, 202, send("POST", "/book", string(book)).StatusCode)
+	assert.Equal(t, 202, send("POST", "/book", string(book)).StatusCode)
+	assert.Equal(t, 202, send("POST", "/book/1/reviews", `{"rating": 4, "text": "Nice", "author": "ada"}`).StatusCode)
+
+	// deleted books are hidden from normal reads, but show up in the trash
+	assert.Equal(t, 200, send("DELETE", "/book/1", "").StatusCode)
+	assert.Equal(t, 404, send("DELETE", "/book/1", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/book/1", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/book/1/reviews", "").StatusCode)
+	var books []data.Book
+	decode(send("GET", "/books", ""), &books)
+	assert.Len(t, books, 1)
+	resp := send("GET", "/trash", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &books)
+	if assert.Len(t, books, 1) {
+		assert.Equal(t, 1, books[0].ID)
+		assert.NotNil(t, books[0].DeletedAt)
+	}
+
+	// restoring brings back the book together with its reviews
+	resp = send("POST", "/book/1/restore", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var restored data.Book
+	decode(resp, &restored)
+	assert.Nil(t, restored.DeletedAt)
+	if assert.NotNil(t, restored.Rating) {
+		assert.Equal(t, 1, restored.Rating.Count)
+	}
+	assert.Equal(t, 200, send("GET", "/book/1", "").StatusCode)
+	assert.Equal(t, 404, send("POST", "/book/1/restore", "").StatusCode)
+	decode(send("GET", "/trash", ""), &books)
+	assert.Empty(t, books)
+
+	// books are only purged after the retention period
+	assert.Equal(t, 200, send("DELETE", "/book/1", "").StatusCode)
+	purged, err := server.store.Purge(context.Background(), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		storage.RunPurger(ctx, server.store, 0, time.Hour, func(err error) { t.Error(err) })
+		close(done)
+	}()
+	cancel()
+	<-done
+	decode(send("GET", "/trash", ""), &books)
+	assert.Empty(t, books)
+	assert.Equal(t, 404, send("POST", "/book/1/restore", "").StatusCode)
+
+	// the whole lifecycle is audited
+	var history data.AuditPage
+	decode(send("GET", "/book/1/history", ""), &history)
+	if assert.Len(t, history.Events, 5) {
+		assert.Equal(t, []string{data.AuditPurge, data.AuditDelete, data.AuditRestore, data.AuditDelete, data.AuditCreate},
+			[]string{history.Events[0].Action, history.Events[1].Action, history.Events[2].Action, history.Events[3].Action, history.Events[4].Action})
+		assert.Equal(t, storage.PurgerActor, history.Events[0].Actor)
+	}
+
+	// failures of the storage are not mistaken for books missing from the trash
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Post("/book/:id/restore", unreachable.handleRestoreBook)
+	assertStorageFailure(t, unreachable, "POST", "/book/1/restore", "")
+}
+
+func Test_handleBookVersions(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	server.fiberApp.Post("/book", server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+	server.fiberApp.Put("/book", server.ValidateBook, server.handleUpdateBook)
+	server.fiberApp.Get("/book/:id/versions", server.handleGetBookVersions)
+	server.fiberApp.Get("/book/:id/versions/:n", server.handleGetBookVersion)
+	server.fiberApp.Post("/book/:id/revert/:n", server.handleRevertBook)
+
+	send := func(method string, target string, ifMatch string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	book, _ := json.Marshal(testCreateBook)
+	assert.Equal(t, 202, send("POST", "/book", "", string(book)).StatusCode)
+	resp := send("GET", "/book/1", "", "")
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+
+	// updates are rejected if they are based on an outdated version
+	update, _ := json.Marshal(testUpdateBook)
+	resp = send("PUT", "/book", `"1"`, string(update))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+	assert.Equal(t, 412, send("PUT", "/book", `"1"`, string(update)).StatusCode)
+	assert.Equal(t, 412, send("PUT", "/book", "", `{"id": 1, "title": "Test3", "description": "Test3", "price": 3.33, "version": 1}`).StatusCode)
+	assert.Equal(t, 400, send("PUT", "/book", "latest", string(update)).StatusCode)
+	assert.Equal(t, 200, send("PUT", "/book", `W/"2"`, `{"id": 1, "title": "Test3", "description": "Test3", "price": 3.33}`).StatusCode)
+
+	// every revision is kept as a full snapshot, newest first
+	resp = send("GET", "/book/1/versions?size=2", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var versions data.BookVersionPage
+	decode(resp, &versions)
+	assert.Equal(t, 3, versions.Total)
+	if assert.Len(t, versions.Versions, 2) {
+		assert.Equal(t, 3, versions.Versions[0].Version)
+		assert.Equal(t, "Test2", versions.Versions[1].Book.Title)
+	}
+	// pages far beyond the last one are empty, their offset does not overflow
+	resp = send("GET", "/book/1/versions?page=288230376151711744&size=64", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	versions = data.BookVersionPage{}
+	decode(resp, &versions)
+	assert.Empty(t, versions.Versions)
+	page, err := server.store.Versions(context.Background(), 1, 1<<58, 64)
+	if assert.NoError(t, err) {
+		assert.Empty(t, page.Versions)
+	}
+	resp = send("GET", "/book/1/versions/1", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var version data.BookVersion
+	decode(resp, &version)
+	assert.Equal(t, "Test1", version.Book.Title)
+	assert.Equal(t, 404, send("GET", "/book/1/versions/4", "", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/book/420/versions", "", "").StatusCode)
+
+	// books can be looked at as they were at a given time
+	var asOf data.Book
+	resp = send("GET", "/book/1?asOf="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	decode(resp, &asOf)
+	assert.Equal(t, "Test3", asOf.Title)
+	assert.Equal(t, 404, send("GET", "/book/1?asOf="+url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "", "").StatusCode)
+	assert.Equal(t, 400, send("GET", "/book/1?asOf=yesterday", "", "").StatusCode)
+
+	// reverting creates a new revision and is subject to the same concurrency control as updates
+	assert.Equal(t, 412, send("POST", "/book/1/revert/1", `"2"`, "").StatusCode)
+	resp = send("POST", "/book/1/revert/1", `"3"`, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	var reverted data.Book
+	decode(resp, &reverted)
+	assert.Equal(t, "Test1", reverted.Title)
+	assert.Equal(t, 4, reverted.Version)
+	assert.Equal(t, 404, send("POST", "/book/1/revert/9", "", "").StatusCode)
+
+	// failures of the storage are not mistaken for missing books or versions
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Put("/book", unreachable.ValidateBook, unreachable.handleUpdateBook)
+	unreachable.fiberApp.Get("/book/:id/versions", unreachable.handleGetBookVersions)
+	unreachable.fiberApp.Get("/book/:id/versions/:n", unreachable.handleGetBookVersion)
+	unreachable.fiberApp.Post("/book/:id/revert/:n", unreachable.handleRevertBook)
+	assertStorageFailure(t, unreachable, "PUT", "/book", string(update))
+	assertStorageFailure(t, unreachable, "GET", "/book/1/versions", "")
+	assertStorageFailure(t, unreachable, "GET", "/book/1/versions/1", "")
+	assertStorageFailure(t, unreachable, "POST", "/book/1/revert/1", "")
+}
+
+func Test_handleEvents(t *testing.T) {
+	// streams only end once the server notices the client is gone
+	eventKeepAliveInterval = 10 * time.Millisecond
+	defer func() { eventKeepAliveInterval = 15 * time.Second }()
+	// grab a fresh server, streaming needs a real listener
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{DisableStartupMessage: true})
+	server.fiberApp.Get("/events", server.handleGetEvents)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.fiberApp.Listener(ln) }()
+	defer func() { _ = server.fiberApp.Shutdown() }()
+
+	book := testCreateBook
+	if _, err := server.store.Create(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+	get := func(lastEventID string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/events", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// server-sent events replay everything after the last event id, then follow new changes
+	resp := get("0")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	book.Title = "Test2"
+	if _, err := server.store.Update(context.Background(), &book); err != nil {
+		t.Error(err)
+	}
+	lines := bufio.NewReader(resp.Body)
+	var received []string
+	for len(received) < 4 {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+			received = append(received, strings.TrimSpace(line))
+		}
+	}
+	resp.Body.Close()
+	assert.Equal(t, []string{"id: 1", "event: " + data.EventBookCreated, "id: 2", "event: " + data.EventBookUpdated}, received)
+	assert.Equal(t, 410, get("42").StatusCode)
+	assert.Equal(t, 400, get("latest").StatusCode)
+
+	// the same stream is available over a websocket
+	conn, _, err := fastws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/events?lastEventId=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := server.store.Delete(context.Background(), book.ID); err != nil {
+		t.Error(err)
+	}
+	for _, expected := range []data.Event{
+		{Sequence: 2, Type: data.EventBookUpdated, BookID: 1},
+		{Sequence: 3, Type: data.EventBookDeleted, BookID: 1},
+	} {
+		var event data.Event
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected.Sequence, event.Sequence)
+		assert.Equal(t, expected.Type, event.Type)
+		assert.Equal(t, expected.BookID, event.BookID)
+		assert.Equal(t, expected.Type == data.EventBookDeleted, event.Book == nil)
+	}
+}
+
+func Test_handleWebhooks(t *testing.T) {
+	// grab a fresh server
+	server := setupServer()
+	// register necessary routes
+	webhooks := server.authorize(data.ScopeWebhooks)
+	server.fiberApp.Post("/book", server.authorize(data.ScopeBooksWrite), server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Post("/webhooks", webhooks, validate[data.WebhookRequest](server), server.handleCreateWebhook)
+	server.fiberApp.Get("/webhooks", webhooks, server.handleGetWebhooks)
+	server.fiberApp.Delete("/webhooks/:id", webhooks, server.handleDeleteWebhook)
+	server.fiberApp.Get("/webhooks/:id/deliveries", webhooks, server.handleGetWebhookDeliveries)
+
+	key, err := IssueAPIKey(context.Background(), server.store, "admin", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key.Key)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the receiver checks the signature of every delivery and fails the first two attempts
+	const secret = "0123456789abcdef"
+	var mu sync.Mutex
+	attempts := 0
+	received := make([]data.Event, 0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(HeaderWebhookTimestamp), 10, 64)
+		if err != nil || r.Header.Get(HeaderWebhookSignature) != SignWebhook(secret, timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event data.Event
+		_ = json.Unmarshal(body, &event)
+		assert.Equal(t, event.Type, r.Header.Get(HeaderWebhookEvent))
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	// webhooks are validated and their secrets are never returned
+	assert.Equal(t, 400, send("POST", "/webhooks", `{"url": "not a url", "events": ["book.created"], "secret": "`+secret+`"}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/webhooks", `{"url": "`+receiver.URL+`", "events": ["book.sold"], "secret": "`+secret+`"}`).StatusCode)
+	assert.Equal(t, 400, send("POST", "/webhooks", `{"url": "`+receiver.URL+`", "events": ["book.created"], "secret": "short"}`).StatusCode)
+	resp := send("POST", "/webhooks", `{"url": "`+receiver.URL+`", "events": ["book.created"], "secret": "`+secret+`"}`)
+	assert.Equal(t, 202, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.NotContains(t, string(body), secret)
+	assert.Equal(t, 202, send("POST", "/webhooks", `{"url": "`+broken.URL+`", "events": ["book.created"], "secret": "`+secret+`"}`).StatusCode)
+	assert.Equal(t, 202, send("POST", "/webhooks", `{"url": "`+receiver.URL+`", "events": ["book.deleted"], "secret": "`+secret+`"}`).StatusCode)
+	var hooks []data.Webhook
+	decode(send("GET", "/webhooks", ""), &hooks)
+	if assert.Len(t, hooks, 3) {
+		assert.Equal(t, receiver.URL, hooks[0].URL)
+		assert.Equal(t, []string{"book.created"}, hooks[0].Events)
+		assert.Empty(t, hooks[0].Secret)
+	}
+
+	// changes made before the dispatcher starts are delivered as well
+	book, _ := json.Marshal(testCreateBook)
+	assert.Equal(t, 202, send("POST", "/book", string(book)).StatusCode)
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher := NewWebhookDispatcher(server.store, WebhookConfig{
+		MaxAttempts:  3,
+		BaseDelay:    time.Millisecond,
+		MaxDelay:     5 * time.Millisecond,
+		Timeout:      time.Second,
+		PollInterval: 5 * time.Millisecond,
+	})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		dispatcher.Run(ctx, server.store, func(err error) { t.Error(err) })
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// waitFor polls the delivery log of a webhook until its only delivery is not pending anymore
+	waitFor := func(id int) data.WebhookDelivery {
+		deadline := time.Now().Add(time.Second)
+		for {
+			var page data.WebhookDeliveryPage
+			decode(send("GET", fmt.Sprintf("/webhooks/%v/deliveries", id), ""), &page)
+			if len(page.Deliveries) == 1 && page.Deliveries[0].Status != data.DeliveryPending || time.Now().After(deadline) {
+				if assert.Len(t, page.Deliveries, 1) {
+					return page.Deliveries[0]
+				}
+				return data.WebhookDelivery{}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// failed attempts are retried until the receiver accepts the delivery
+	delivery := waitFor(1)
+	assert.Equal(t, data.DeliverySucceeded, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, 200, delivery.LastStatusCode)
+	assert.Equal(t, data.EventBookCreated, delivery.EventType)
+	mu.Lock()
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, 1, received[0].BookID)
+		assert.Equal(t, "Test1", received[0].Book.Title)
+	}
+	mu.Unlock()
+
+	// deliveries which keep failing are given up as dead
+	delivery = waitFor(2)
+	assert.Equal(t, data.DeliveryDead, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, 500, delivery.LastStatusCode)
+	assert.Contains(t, delivery.LastError, "500")
+
+	// pages far beyond the last one are empty, their offset does not overflow
+	var beyond data.WebhookDeliveryPage
+	decode(send("GET", "/webhooks/2/deliveries?page=288230376151711744&size=64", ""), &beyond)
+	assert.Greater(t, beyond.Total, 0)
+	assert.Empty(t, beyond.Deliveries)
+
+	// webhooks only receive the events they are subscribed to
+	var page data.WebhookDeliveryPage
+	decode(send("GET", "/webhooks/3/deliveries", ""), &page)
+	assert.Equal(t, 0, page.Total)
+
+	// deleting a webhook drops its delivery log
+	assert.Equal(t, 200, send("DELETE", "/webhooks/2", "").StatusCode)
+	assert.Equal(t, 404, send("DELETE", "/webhooks/2", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/webhooks/2/deliveries", "").StatusCode)
+	decode(send("GET", "/webhooks", ""), &hooks)
+	assert.Len(t, hooks, 2)
+
+	// failures of the storage are not mistaken for missing webhooks
+	unreachable := setupUnreachableServer()
+	unreachable.fiberApp.Delete("/webhooks/:id", unreachable.handleDeleteWebhook)
+	unreachable.fiberApp.Get("/webhooks/:id/deliveries", unreachable.handleGetWebhookDeliveries)
+	assertStorageFailure(t, unreachable, "DELETE", "/webhooks/1", "")
+	assertStorageFailure(t, unreachable, "GET", "/webhooks/1/deliveries", "")
+}
+
+// countingStorage counts the reads of books and delays them, so concurrent reads overlap.
+type countingStorage struct {
+	storage.Storage
+	gets  atomic.Int32
+	delay time.Duration
+}
+
+func (cs *countingStorage) Get(ctx context.Context, id int) (*data.Book, error) {
+	cs.gets.Add(1)
+	time.Sleep(cs.delay)
+	return cs.Storage.Get(ctx, id)
+}
+
+func Test_handleCachedBooks(t *testing.T) {
+	// grab a fresh server on top of a cache which holds two books
+	counting := &countingStorage{Storage: storage.NewInMemoryStorage()}
+	cache := storage.NewCachedStorage(counting, 2, time.Minute)
+	server := NewServer(cache, ":3000", fiber.Config{})
+	// register necessary routes
+	server.fiberApp.Post("/book", server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+	server.fiberApp.Put("/book", server.ValidateBook, server.handleUpdateBook)
+	server.fiberApp.Post("/book/:id/reviews", server.ValidateReview, server.handleCreateReview)
+	server.fiberApp.Get("/cache/stats", server.handleGetCacheStats)
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	book, _ := json.Marshal(testCreateBook)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 202, send("POST", "/book", string(book)).StatusCode)
+	}
+
+	// repeated reads are served from the cache
+	var got data.Book
+	decode(send("GET", "/book/1", ""), &got)
+	decode(send("GET", "/book/1", ""), &got)
+	assert.Equal(t, int32(1), counting.gets.Load())
+	var stats storage.CacheStats
+	decode(send("GET", "/cache/stats", ""), &stats)
+	assert.Equal(t, storage.CacheStats{Hits: 1, Misses: 1, Entries: 1, Capacity: 2}, stats)
+
+	// changes through the cache invalidate the book, including changes of its rating
+	assert.Equal(t, 200, send("PUT", "/book", `{"id": 1, "title": "Cached", "description": "Test1", "price": 1.23}`).StatusCode)
+	decode(send("GET", "/book/1", ""), &got)
+	assert.Equal(t, "Cached", got.Title)
+	assert.Equal(t, 202, send("POST", "/book/1/reviews", `{"rating": 5, "text": "Great", "author": "ada"}`).StatusCode)
+	decode(send("GET", "/book/1", ""), &got)
+	if assert.NotNil(t, got.Rating) {
+		assert.Equal(t, 1, got.Rating.Count)
+	}
+	assert.Equal(t, int32(3), counting.gets.Load())
+
+	// the least recently used book is evicted
+	assert.Equal(t, 200, send("GET", "/book/2", "").StatusCode)
+	assert.Equal(t, 200, send("GET", "/book/3", "").StatusCode)
+	assert.Equal(t, 200, send("GET", "/book/3", "").StatusCode)
+	decode(send("GET", "/cache/stats", ""), &stats)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 200, send("GET", "/book/1", "").StatusCode)
+	assert.Equal(t, int32(6), counting.gets.Load())
+
+	// missing books are not cached
+	assert.Equal(t, 404, send("GET", "/book/4", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/book/4", "").StatusCode)
+	assert.Equal(t, int32(8), counting.gets.Load())
+
+	// concurrent misses for the same book are collapsed into a single read
+	cache.Clear()
+	counting.gets.Store(0)
+	counting.delay = 20 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := cache.Get(context.Background(), 2)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 2, b.ID)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), counting.gets.Load())
+
+	// books expire after the TTL
+	counting.delay = 0
+	expiring := storage.NewCachedStorage(counting, 2, 10*time.Millisecond)
+	_, _ = expiring.Get(context.Background(), 2)
+	_, _ = expiring.Get(context.Background(), 2)
+	time.Sleep(20 * time.Millisecond)
+	_, _ = expiring.Get(context.Background(), 2)
+	assert.Equal(t, int32(3), counting.gets.Load())
+
+	// without a cache, there are no statistics
+	uncached := setupServer()
+	uncached.fiberApp.Get("/cache/stats", uncached.handleGetCacheStats)
+	resp, _ := uncached.fiberApp.Test(httptest.NewRequest("GET", "/cache/stats", nil), -1)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func Test_metrics(t *testing.T) {
+	// grab a fresh server whose storage is instrumented and cached
+	metrics := NewMetrics()
+	cache := storage.NewCachedStorage(storage.NewInstrumentedStorage(storage.NewInMemoryStorage(), metrics.ObserveOperation), 10, time.Minute)
+	metrics.RegisterCache(cache)
+	server := NewServer(cache, ":3000", fiber.Config{}, WithMetrics(metrics))
+	// register necessary routes
+	server.fiberApp.Use(metrics.instrument)
+	server.fiberApp.Get("/metrics", metrics.handler())
+	server.fiberApp.Post("/book", server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+
+	send := func(method string, target string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+
+	book, _ := json.Marshal(testCreateBook)
+	assert.Equal(t, 202, send("POST", "/book", string(book)).StatusCode)
+	assert.Equal(t, 200, send("GET", "/book/1", "").StatusCode)
+	assert.Equal(t, 200, send("GET", "/book/1", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/book/2", "").StatusCode)
+	assert.Equal(t, 404, send("GET", "/does/not/exist", "").StatusCode)
+
+	resp := send("GET", "/metrics", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	exposition := string(body)
+	// requests are labelled by their route template instead of their path
+	assert.Contains(t, exposition, `books_http_requests_total{method="GET",route="/book/:id",status="200"} 2`)
+	assert.Contains(t, exposition, `books_http_requests_total{method="GET",route="/book/:id",status="404"} 1`)
+	assert.Contains(t, exposition, `books_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, exposition, `books_http_request_duration_seconds_count{method="POST",route="/book",status="202"} 1`)
+	// the storage only sees the reads which missed the cache
+	assert.Contains(t, exposition, `books_storage_operation_duration_seconds_count{operation="Create"} 1`)
+	assert.Contains(t, exposition, `books_storage_operation_duration_seconds_count{operation="Get"} 2`)
+	assert.Contains(t, exposition, `books_storage_operation_errors_total{operation="Get"} 1`)
+	assert.Contains(t, exposition, "books_cache_hits_total 1")
+	assert.Contains(t, exposition, "books_cache_misses_total 2")
+	// runtime metrics
+	assert.Contains(t, exposition, "go_goroutines")
+}
+
+// fakeConnector is a database driver which answers every query with the given number of rows and every other statement with as many affected rows.
+type fakeConnector struct {
+	rows int
+}
+
+func (fc fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(fc), nil }
+func (fc fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn fakeConnector
+
+func (fc fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (fc fakeConn) Close() error                        { return nil }
+func (fc fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+func (fc fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{left: fc.rows}, nil
+}
+func (fc fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(fc.rows), nil
+}
+
+type fakeRows struct {
+	left int
+}
+
+func (fr *fakeRows) Columns() []string { return []string{"id"} }
+func (fr *fakeRows) Close() error      { return nil }
+func (fr *fakeRows) Next(dest []driver.Value) error {
+	if fr.left == 0 {
+		return io.EOF
+	}
+	fr.left--
+	dest[0] = int64(fr.left)
+	return nil
+}
+
+// fakePostgres is a database driver which plays the statements of creating a book and reading a reading list in postgres mode.
+// Like Postgres, it rejects notifications whose payload reaches 8000 bytes. It records every other statement, including transactions.
+type fakePostgres struct {
+	executed *[]fakeStatement
+}
+
+type fakeStatement struct {
+	query string
+	args  []driver.NamedValue
+}
+
+func (fp fakePostgres) Connect(context.Context) (driver.Conn, error) {
+	return fakePostgresConn(fp), nil
+}
+func (fp fakePostgres) Driver() driver.Driver { return nil }
+
+type fakePostgresConn fakePostgres
+
+func (fc fakePostgresConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (fc fakePostgresConn) Close() error                        { return nil }
+func (fc fakePostgresConn) Begin() (driver.Tx, error) {
+	*fc.executed = append(*fc.executed, fakeStatement{query: "BEGIN"})
+	return fc, nil
+}
+func (fc fakePostgresConn) Commit() error   { return nil }
+func (fc fakePostgresConn) Rollback() error { return nil }
+func (fc fakePostgresConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	*fc.executed = append(*fc.executed, fakeStatement{query: query, args: args})
+	switch {
+	case strings.Contains(query, "INTO outbox"):
+		return &valueRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}}}, nil
+	case strings.Contains(query, "FROM users"):
+		return &valueRows{columns: []string{"id", "name", "created_at"}, values: [][]driver.Value{{args[0].Value, "ada", time.Now()}}}, nil
+	case strings.Contains(query, "FROM list_entries"):
+		return &valueRows{columns: []string{"book_id", "progress", "added_at"}}, nil
+	}
+	// the inserted book, from its title, description, price and publisher
+	return &valueRows{
+		columns: []string{"id", "title", "description", "price", "publisher", "version", "rating_histogram"},
+		values:  [][]driver.Value{{int64(1), args[0].Value, args[1].Value, args[2].Value, args[3].Value, int64(1), []byte("{0,0,0,0,0}")}},
+	}, nil
+}
+func (fc fakePostgresConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "pg_notify") && len(args[1].Value.(string)) >= 8000 {
+		return nil, fmt.Errorf("pq: payload string too long")
+	}
+	*fc.executed = append(*fc.executed, fakeStatement{query: query, args: args})
+	return driver.RowsAffected(1), nil
+}
+
+type valueRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (vr *valueRows) Columns() []string { return vr.columns }
+func (vr *valueRows) Close() error      { return nil }
+func (vr *valueRows) Next(dest []driver.Value) error {
+	if len(vr.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, vr.values[0])
+	vr.values = vr.values[1:]
+	return nil
+}
+
+func Test_notifyLargeBook(t *testing.T) {
+	// books are announced to other servers with NOTIFY, whose payload Postgres limits to 8000 bytes
+	var executed []fakeStatement
+	store := storage.NewPostgresqlStorage(sql.OpenDB(fakePostgres{executed: &executed}))
+	book := testCreateBook
+	book.Description = strings.Repeat("a long description ", 540)
+	assert.Greater(t, len(book.Description), 10000)
+
+	created, err := store.Create(context.Background(), &book)
+	if assert.NoError(t, err) {
+		assert.Equal(t, book.Description, created.Description)
+	}
+	var notifications []string
+	for _, statement := range executed {
+		if strings.Contains(statement.query, "pg_notify") {
+			notifications = append(notifications, statement.args[1].Value.(string))
+		}
+	}
+	if assert.Len(t, notifications, 1) {
+		assert.JSONEq(t, `{"type": "book.created", "bookId": 1, "outboxId": 1}`, notifications[0])
+	}
+}
+
+func Test_getReadingListUnlocked(t *testing.T) {
+	// reading a list neither locks the user nor opens a transaction, so it does not wait for changes to the lists
+	var executed []fakeStatement
+	store := storage.NewPostgresqlStorage(sql.OpenDB(fakePostgres{executed: &executed}))
+	list, err := store.GetReadingList(context.Background(), 1, data.ListReading)
+	if assert.NoError(t, err) {
+		assert.Empty(t, list.Entries)
+	}
+	assert.Len(t, executed, 2)
+	for _, statement := range executed {
+		assert.NotEqual(t, "BEGIN", statement.query)
+		assert.NotContains(t, statement.query, "FOR UPDATE")
+	}
+	_, err = store.GetReadingList(context.Background(), 1, "favourites")
+	assert.ErrorIs(t, err, storage.ErrUnknownList)
+}
+
+func Test_flushViews(t *testing.T) {
+	// views are only counted while books are read, and written to the database in batches
+	var executed []fakeStatement
+	store := storage.NewPostgresqlStorage(sql.OpenDB(fakePostgres{executed: &executed}))
+	for _, id := range []int{1, 1, 2, 1} {
+		assert.NoError(t, store.RecordView(context.Background(), id))
+	}
+	assert.Empty(t, executed)
+
+	// the views are flushed once more when the flusher is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.RunViewFlusher(ctx, time.Hour, func(err error) { t.Error(err) })
+	if assert.Len(t, executed, 1) {
+		assert.Contains(t, executed[0].query, "UPDATE books")
+		ids, counts := executed[0].args[0].Value.(string), executed[0].args[1].Value.(string)
+		if ids == "{1,2}" {
+			assert.Equal(t, "{3,1}", counts)
+		} else {
+			assert.Equal(t, "{2,1}", ids)
+			assert.Equal(t, "{1,3}", counts)
+		}
+	}
+
+	// nothing is written without new views
+	store.RunViewFlusher(ctx, time.Hour, func(err error) { t.Error(err) })
+	assert.Len(t, executed, 1)
+}
+
+func Test_tracing(t *testing.T) {
+	// grab a fresh server which records its spans in memory, as well as a traced database
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithTracing(provider))
+	db := sql.OpenDB(storage.NewTracedConnector(fakeConnector{rows: 3}, provider, 0))
+	defer db.Close()
+	// register necessary routes
+	server.fiberApp.Use(server.trace)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+	server.fiberApp.Get("/query", func(c *fiber.Ctx) error {
+		rows, err := db.QueryContext(c.UserContext(), "SELECT id FROM books")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if _, err := db.ExecContext(c.UserContext(), "UPDATE books SET price = $1", 1.0); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	send := func(target string, traceparent string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		if traceparent != "" {
+			req.Header.Set("traceparent", traceparent)
+		}
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	attributes := func(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		values := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes {
+			values[kv.Key] = kv.Value
+		}
+		return values
+	}
+
+	// a request without a trace context starts a new trace, its span is named after the route template
+	assert.Equal(t, 404, send("/book/1", "").StatusCode)
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "GET /book/:id", spans[0].Name)
+		assert.False(t, spans[0].Parent.IsValid())
+		assert.Equal(t, int64(404), attributes(spans[0])["http.status_code"].AsInt64())
+		assert.Equal(t, "/book/:id", attributes(spans[0])["http.route"].AsString())
+	}
+	exporter.Reset()
+
+	assert.Equal(t, 404, send("/does/not/exist", "").StatusCode)
+	spans = exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "GET unmatched", spans[0].Name)
+	}
+	exporter.Reset()
+
+	// a request with a traceparent continues its trace, and the SQL statements of the request are children of its span
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	assert.Equal(t, 204, send("/query", traceparent).StatusCode)
+	spans = exporter.GetSpans()
+	if assert.Len(t, spans, 3) {
+		query, exec, request := spans[0], spans[1], spans[2]
+		assert.Equal(t, "GET /query", request.Name)
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", request.SpanContext.TraceID().String())
+		assert.Equal(t, "b7ad6b7169203331", request.Parent.SpanID().String())
+		assert.True(t, request.Parent.IsRemote())
+
+		assert.Equal(t, "SELECT", query.Name)
+		assert.Equal(t, request.SpanContext.SpanID(), query.Parent.SpanID())
+		assert.Equal(t, "SELECT id FROM books", attributes(query)["db.statement"].AsString())
+		assert.Equal(t, "postgresql", attributes(query)["db.system"].AsString())
+		assert.Equal(t, int64(3), attributes(query)["db.row_count"].AsInt64())
+
+		assert.Equal(t, "UPDATE", exec.Name)
+		assert.Equal(t, request.SpanContext.SpanID(), exec.Parent.SpanID())
+		assert.Equal(t, int64(3), attributes(exec)["db.row_count"].AsInt64())
+	}
+}
+
+func Test_logging(t *testing.T) {
+	// grab a fresh server which logs into a buffer
+	var logs bytes.Buffer
+	logger, err := NewLogger(&logs, LogConfig{Level: slog.LevelDebug, Format: LogFormatJSON})
+	if err != nil {
+		t.Error(err)
+	}
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithLogger(logger))
+	// register necessary routes
+	server.fiberApp.Use(server.logRequests)
+	server.fiberApp.Post("/book", server.authorize(data.ScopeBooksWrite), server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Post("/webhooks", server.authorize(data.ScopeWebhooks), validate[data.WebhookRequest](server), server.handleCreateWebhook)
+
+	key, err := IssueAPIKey(context.Background(), server.store, "admin", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, requestID string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key.Key)
+		req.Header.Set(RequestIDHeader, requestID)
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	// records returns the logged records with the given message and request ID, every line has to be valid JSON
+	records := func(msg string, requestID string) []map[string]interface{} {
+		var result []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record map[string]interface{}
+			if !assert.NoError(t, json.Unmarshal([]byte(line), &record), line) {
+				continue
+			}
+			if record["msg"] == msg && record["request_id"] == requestID {
+				result = append(result, record)
+			}
+		}
+		return result
+	}
+
+	// quotes in titles do not break the log, and the storage logs with the logger of the request
+	book := `{"title": "The \"Quoted\" Book", "description": "Test1", "price": 1.11}`
+	assert.Equal(t, 202, send("POST", "/book", "create-1", book).StatusCode)
+	requests := records("request", "create-1")
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "/book", requests[0]["route"])
+		assert.Equal(t, float64(202), requests[0]["status"])
+		assert.Equal(t, fmt.Sprintf("apikey:%v", key.ID), requests[0]["user"])
+		assert.Contains(t, requests[0]["body"], `"title":"The \"Quoted\" Book"`)
+	}
+	changes := records("changing book", "create-1")
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "DEBUG", changes[0]["level"])
+		assert.Equal(t, "/book", changes[0]["route"])
+		assert.Equal(t, fmt.Sprintf("apikey:%v", key.ID), changes[0]["user"])
+	}
+
+	// secrets are redacted from bodies
+	webhook := `{"url": "http://localhost/hook", "events": ["book.created"], "secret": "0123456789abcdef"}`
+	assert.Equal(t, 202, send("POST", "/webhooks", "webhook-1", webhook).StatusCode)
+	requests = records("request", "webhook-1")
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0]["body"], `"secret":"[REDACTED]"`)
+	}
+	assert.NotContains(t, logs.String(), "0123456789abcdef")
+
+	// large bodies are truncated, and bodies which are not JSON are not logged at all
+	long := fmt.Sprintf(`{"title": "Long", "description": "%v", "price": 1.11}`, strings.Repeat("ä", 1000))
+	assert.Equal(t, 202, send("POST", "/book", "long-1", long).StatusCode)
+	requests = records("request", "long-1")
+	if assert.Len(t, requests, 1) {
+		body := requests[0]["body"].(string)
+		assert.LessOrEqual(t, len(body), maxLoggedBody+50)
+		assert.Contains(t, body, "more bytes)")
+	}
+	assert.Equal(t, 400, send("POST", "/book", "invalid-1", "password=hunter2").StatusCode)
+	requests = records("request", "invalid-1")
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "<16 bytes>", requests[0]["body"])
+	}
+	assert.NotContains(t, logs.String(), "hunter2")
+}
+
+func Test_correlation(t *testing.T) {
+	// grab a fresh server which logs into a buffer, as well as a database on which every statement is slow
+	var logs, audit bytes.Buffer
+	logger, err := NewLogger(&logs, LogConfig{Level: slog.LevelInfo, Format: LogFormatJSON})
+	if err != nil {
+		t.Error(err)
+	}
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithLogger(logger), WithAuditLog(&audit))
+	db := sql.OpenDB(storage.NewTracedConnector(fakeConnector{rows: 1}, sdktrace.NewTracerProvider(), time.Nanosecond))
+	defer db.Close()
+	// register necessary routes
+	server.fiberApp.Use(server.correlate, server.logRequests)
+	server.fiberApp.Post("/book", server.authorize(data.ScopeBooksWrite), server.ValidateBook, server.handleCreateBook)
+	server.fiberApp.Get("/book/:id", server.handleGetBookById)
+	server.fiberApp.Get("/query", func(c *fiber.Ctx) error {
+		if _, err := db.ExecContext(c.UserContext(), "SELECT 1"); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	key, err := IssueAPIKey(context.Background(), server.store, "admin", data.Scopes)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(method string, target string, headers map[string]string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, _ := server.fiberApp.Test(req, -1)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the request ID of the client is echoed in the response and in the body of errors
+	resp := send("GET", "/book/1", map[string]string{RequestIDHeader: "client-42"}, "")
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, "client-42", resp.Header.Get(RequestIDHeader))
+	var failure errorResponse
+	decode(resp, &failure)
+	assert.Equal(t, "client-42", failure.RequestID)
+	assert.NotEmpty(t, failure.Error)
+
+	// requests without a valid ID get a random one
+	for _, header := range []map[string]string{nil, {RequestIDHeader: "not a valid id"}} {
+		resp = send("GET", "/book/1", header, "")
+		assert.Regexp(t, "^[0-9a-f]{32}$", resp.Header.Get(RequestIDHeader))
+		decode(resp, &failure)
+		assert.Equal(t, resp.Header.Get(RequestIDHeader), failure.RequestID)
+	}
+
+	// the trace context is passed on and echoed, even if the server does not trace itself
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	resp = send("GET", "/query", map[string]string{RequestIDHeader: "query-1", "traceparent": traceparent}, "")
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, traceparent, resp.Header.Get("traceparent"))
+
+	// audit events, denials and logs of the storage carry the request ID
+	book, _ := json.Marshal(testCreateBook)
+	assert.Equal(t, 202, send("POST", "/book", map[string]string{RequestIDHeader: "create-1", APIKeyHeader: key.Key}, string(book)).StatusCode)
+	events, err := server.store.AuditEvents(context.Background(), data.AuditFilter{Page: 1, Size: 10})
+	if assert.NoError(t, err) && assert.Len(t, events.Events, 1) {
+		assert.Equal(t, "create-1", events.Events[0].RequestID)
+	}
+	assert.Equal(t, 401, send("POST", "/book", map[string]string{RequestIDHeader: "denied-1"}, string(book)).StatusCode)
+	assert.Contains(t, audit.String(), `"requestId":"denied-1"`)
+
+	var slow, request map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if assert.NoError(t, json.Unmarshal([]byte(line), &record)) && record["request_id"] == "query-1" {
+			switch record["msg"] {
+			case "slow query":
+				slow = record
+			case "request":
+				request = record
+			}
+		}
+	}
+	if assert.NotNil(t, slow) {
+		assert.Equal(t, "SELECT 1", slow["statement"])
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", slow["trace_id"])
+	}
+	if assert.NotNil(t, request) {
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", request["trace_id"])
+	}
+}
+
+func Test_probes(t *testing.T) {
+	// a cache is unready until it has been warmed up
+	cache := storage.NewCachedStorage(storage.NewInMemoryStorage(), 10, time.Minute)
+	if _, err := cache.Create(context.Background(), &testCreateBook); err != nil {
+		t.Error(err)
+	}
+	var broken atomic.Bool
+	checkers := []Checker{
+		{Name: "cache", Check: cache.CheckWarm, Required: true},
+		{Name: "database", Required: true, Check: func(ctx context.Context) error {
+			if broken.Load() {
+				return fmt.Errorf("connection refused")
+			}
+			return nil
+		}},
+		{Name: "optional", Check: func(ctx context.Context) error {
+			return fmt.Errorf("not configured")
+		}},
+		{Name: "slow", Required: true, Timeout: 10 * time.Millisecond, Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}
+	// grab a fresh server
+	server := NewServer(cache, ":3000", fiber.Config{}, WithCheckers(checkers[:3]...))
+	// register necessary routes
+	server.fiberApp.Get("/livez", server.handleLivez)
+	server.fiberApp.Get("/readyz", server.handleReadyz)
+
+	readyz := func() (int, data.ReadinessReport) {
+		resp, _ := server.fiberApp.Test(httptest.NewRequest("GET", "/readyz", nil), -1)
+		var report data.ReadinessReport
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(body, &report); err != nil {
+			t.Error(err)
+		}
+		return resp.StatusCode, report
+	}
+
+	status, report := readyz()
+	assert.Equal(t, 503, status)
+	assert.Equal(t, data.StatusUnready, report.Status)
+	if assert.Len(t, report.Checks, 3) {
+		assert.Equal(t, data.CheckResult{Name: "cache", Required: true, Status: data.CheckFailed, Error: "cache is warming up", Duration: report.Checks[0].Duration}, report.Checks[0])
+		assert.Equal(t, data.CheckOK, report.Checks[1].Status)
+	}
+
+	// failed checks which are not required are reported, but the server is ready
+	assert.NoError(t, cache.Warm(context.Background()))
+	assert.Equal(t, 1, cache.Stats().Entries)
+	status, report = readyz()
+	assert.Equal(t, 200, status)
+	assert.Equal(t, data.StatusReady, report.Status)
+	if assert.Len(t, report.Checks, 3) {
+		assert.Equal(t, data.CheckOK, report.Checks[0].Status)
+		assert.Equal(t, data.CheckFailed, report.Checks[2].Status)
+		assert.Equal(t, "not configured", report.Checks[2].Error)
+	}
+
+	// a failing dependency makes the server unready, but it is still alive
+	broken.Store(true)
+	status, report = readyz()
+	assert.Equal(t, 503, status)
+	assert.Equal(t, "connection refused", report.Checks[1].Error)
+	resp, _ := server.fiberApp.Test(httptest.NewRequest("GET", "/livez", nil), -1)
+	assert.Equal(t, 200, resp.StatusCode)
+	broken.Store(false)
+
+	// checks which take too long fail
+	WithCheckers(checkers[3])(server)
+	status, report = readyz()
+	assert.Equal(t, 503, status)
+	if assert.Len(t, report.Checks, 4) {
+		assert.Equal(t, data.CheckFailed, report.Checks[3].Status)
+	}
+}
+
+func Test_shutdown(t *testing.T) {
+	// grab a fresh server, draining needs a real listener
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{DisableStartupMessage: true}, WithShutdownDelay(100*time.Millisecond))
+	server.fiberApp.Get("/readyz", server.handleReadyz)
+	server.fiberApp.Get("/events", server.handleGetEvents)
+	server.fiberApp.Get("/slow", func(c *fiber.Ctx) error {
+		time.Sleep(300 * time.Millisecond)
+		return c.SendString("done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.fiberApp.Listener(ln) }()
+	base := "http://" + ln.Addr().String()
+
+	resp, err := http.Get(base + "/readyz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	}
+	// an event stream and a slow request are in flight when the server is shut down
+	stream, err := http.Get(base + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	// during the delay, the server still serves but reports not ready
+	time.Sleep(20 * time.Millisecond)
+	resp, err = http.Get(base + "/readyz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 503, resp.StatusCode)
+		var report data.ReadinessReport
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		resp.Body.Close()
+		if assert.Len(t, report.Checks, 1) {
+			assert.Equal(t, "shutdown", report.Checks[0].Name)
+		}
+	}
+
+	// the slow request is drained, the event stream ends and no more connections are accepted
+	assert.NoError(t, <-shutdown)
+	assert.Equal(t, "done", <-slow)
+	_, err = io.ReadAll(stream.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, <-served)
+	_, err = http.Get(base + "/readyz")
+	assert.Error(t, err)
+}
+
+// flakyConnector is a fakeConnector which refuses connections while the database is down, and counts the attempts to connect.
+type flakyConnector struct {
+	fakeConnector
+	down     *atomic.Bool
+	attempts *atomic.Int32
+}
+
+func (fc flakyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	fc.attempts.Add(1)
+	if fc.down.Load() {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return fc.fakeConnector.Connect(ctx)
+}
+
+func Test_waitForDB(t *testing.T) {
+	// a database which is down until told otherwise
+	var down atomic.Bool
+	var attempts atomic.Int32
+	down.Store(true)
+	db := sql.OpenDB(flakyConnector{down: &down, attempts: &attempts})
+	config := storage.DBConfig{Host: "db", Port: 5432, Name: "books", Retry: storage.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}}
+
+	// the database is given up on after the configured attempts
+	err := storage.WaitForDB(context.Background(), db, config)
+	var connectErr *storage.ConnectError
+	if assert.ErrorAs(t, err, &connectErr) {
+		assert.Equal(t, 3, connectErr.Attempts)
+		assert.Equal(t, "db", connectErr.Host)
+		assert.Contains(t, err.Error(), "connection refused")
+	}
+	assert.Equal(t, int32(3), attempts.Load())
+
+	// waiting stops once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	config.Retry.MaxAttempts = 0
+	err = storage.WaitForDB(ctx, db, config)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorAs(t, err, &connectErr)
+
+	// the server starts unready and becomes ready once the database is reached in the background
+	server := NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{}, WithCheckers(Checker{Name: "postgres", Check: db.PingContext, Required: true}))
+	server.fiberApp.Get("/readyz", server.handleReadyz)
+	readyz := func() int {
+		resp, _ := server.fiberApp.Test(httptest.NewRequest("GET", "/readyz", nil), -1)
+		return resp.StatusCode
+	}
+	assert.Equal(t, 503, readyz())
+	connected := make(chan error, 1)
+	go func() {
+		connected <- storage.WaitForDB(context.Background(), db, config)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	down.Store(false)
+	select {
+	case err := <-connected:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("database was not reached")
+	}
+	assert.Equal(t, 200, readyz())
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the spans of requests.
+const tracerName = "github.com/torbendury/books-go/api"
+
+// Exporters of spans, see TracingConfig.
+const (
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+	TraceExporterNone   = "none"
+)
+
+// TracingConfig configures where the spans of the server are exported to, see NewTracerProvider.
+type TracingConfig struct {
+	// Exporter is one of TraceExporterOTLP, TraceExporterStdout or TraceExporterNone.
+	Exporter string
+	// Endpoint is the host and port of the OTLP collector which receives spans over HTTP. If empty, the endpoint is
+	// taken from the standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or defaults to localhost:4318.
+	Endpoint string
+	// Insecure sends spans to the OTLP collector without TLS.
+	Insecure bool
+	// ServiceName names the server in the exported spans.
+	ServiceName string
+}
+
+// NewTracerProvider returns a tracer provider which exports spans in batches as configured.
+// Without an exporter, spans are not recorded at all, but trace contexts are still propagated.
+// Pass it to the server with WithTracing and to storage.OpenDB with storage.DBConfig, and shut it down on exit to flush the last spans.
+func NewTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case TraceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		otlp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	case TraceExporterStdout:
+		stdout, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		exporter = stdout
+	case TraceExporterNone, "":
+		return sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected %v, %v or %v", config.Exporter, TraceExporterOTLP, TraceExporterStdout, TraceExporterNone)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(config.ServiceName))),
+	), nil
+}
+
+// requestHeaders lets a propagator read the trace context from the headers of a request.
+// Values are copied, since the propagator may keep them beyond the request.
+type requestHeaders struct {
+	c *fiber.Ctx
+}
+
+func (h requestHeaders) Get(key string) string {
+	return utils.CopyString(h.c.Get(key))
+}
+
+func (h requestHeaders) Set(key string, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h requestHeaders) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// trace is a middleware handler which records a span for every request, named after its method and the template of its route, e.g. GET /book/:id.
+// If the request carries a W3C traceparent header, the span continues that trace. The context of the span becomes the user context of the request,
+// so the spans of the SQL statements of the request are its children.
+func (s *Server) trace(c *fiber.Ctx) error {
+	ctx := propagation.TraceContext{}.Extract(c.UserContext(), requestHeaders{c})
+	method := utils.CopyString(c.Method())
+	ctx, span := s.tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethod(method), semconv.HTTPTarget(string(c.Request().RequestURI()))),
+	)
+	defer span.End()
+	c.SetUserContext(ctx)
+
+	middleware := c.Route()
+	err := c.Next()
+	route := routeTemplate(c, middleware)
+	status := responseStatus(c, err)
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+		if err != nil {
+			span.RecordError(err)
+		}
+	}
+	return err
+}
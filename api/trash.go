@@ -0,0 +1,33 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/storage"
+)
+
+// handleGetTrash returns all deleted books which have not been purged yet, most recently deleted first.
+func (s *Server) handleGetTrash(c *fiber.Ctx) error {
+	books, err := s.store.Trash(c.UserContext())
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(books)
+}
+
+// handleRestoreBook moves a deleted book out of the trash and returns it. Its reviews, stock, copies and reading list entries
+// are restored with it. Books which have already been purged or were never deleted are answered with 404 Not Found,
+// failures of the storage with 500 Internal Server Error.
+func (s *Server) handleRestoreBook(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	book, err := s.store.Restore(s.storageContext(c), id)
+	if storage.IsNotFound(err) {
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+	return c.JSON(book)
+}
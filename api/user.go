@@ -0,0 +1,147 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// userError maps errors of the user storage to HTTP errors. Adding a book twice is answered with 409 Conflict,
+// an order which does not match the list with 400 Bad Request and missing users, lists, books or entries with 404 Not Found.
+// Everything else, e.g. a database which can not be reached, is a failure of the server.
+func userError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrDuplicateEntry):
+		return fiber.NewError(fiber.ErrConflict.Code, err.Error())
+	case errors.Is(err, storage.ErrInvalidOrder):
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	case errors.Is(err, storage.ErrUnknownList) || storage.IsNotFound(err):
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	default:
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+}
+
+// listParams reads the user ID and the name of the reading list from the request path.
+// The name is copied, since fiber reuses the underlying buffer once the request is done and the storage may keep the name as a key.
+func listParams(c *fiber.Ctx) (int, string, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, "", fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	return id, utils.CopyString(c.Params("list")), nil
+}
+
+// handleCreateUser creates a new user with empty reading lists.
+func (s *Server) handleCreateUser(c *fiber.Ctx) error {
+	user := new(data.User)
+	if err := c.BodyParser(user); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	user, err := s.store.CreateUser(c.UserContext(), user)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(user)
+}
+
+// handleGetUser returns the requested user.
+func (s *Server) handleGetUser(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	user, err := s.store.GetUser(c.UserContext(), id)
+	if err != nil {
+		return userError(err)
+	}
+	return c.JSON(user)
+}
+
+// handleGetReadingList returns the requested reading list of a user in list order.
+func (s *Server) handleGetReadingList(c *fiber.Ctx) error {
+	id, name, err := listParams(c)
+	if err != nil {
+		return err
+	}
+	list, err := s.store.GetReadingList(c.UserContext(), id, name)
+	if err != nil {
+		return userError(err)
+	}
+	return c.JSON(list)
+}
+
+// handleAddListEntry appends a book to the end of a reading list.
+func (s *Server) handleAddListEntry(c *fiber.Ctx) error {
+	id, name, err := listParams(c)
+	if err != nil {
+		return err
+	}
+	entry := new(data.ListEntry)
+	if err := c.BodyParser(entry); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	list, err := s.store.AddListEntry(c.UserContext(), id, name, *entry)
+	if err != nil {
+		return userError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(list)
+}
+
+// handleRemoveListEntry removes a book from a reading list.
+func (s *Server) handleRemoveListEntry(c *fiber.Ctx) error {
+	id, name, err := listParams(c)
+	if err != nil {
+		return err
+	}
+	bookID, err := c.ParamsInt("bookId")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	list, err := s.store.RemoveListEntry(c.UserContext(), id, name, bookID)
+	if err != nil {
+		return userError(err)
+	}
+	return c.JSON(list)
+}
+
+// handleSetListProgress updates how much of a book on a reading list the user has read.
+func (s *Server) handleSetListProgress(c *fiber.Ctx) error {
+	id, name, err := listParams(c)
+	if err != nil {
+		return err
+	}
+	bookID, err := c.ParamsInt("bookId")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	progress := new(data.ListProgress)
+	if err := c.BodyParser(progress); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	list, err := s.store.SetListProgress(c.UserContext(), id, name, bookID, progress.Progress)
+	if err != nil {
+		return userError(err)
+	}
+	return c.JSON(list)
+}
+
+// handleReorderList puts the entries of a reading list into the requested order.
+func (s *Server) handleReorderList(c *fiber.Ctx) error {
+	id, name, err := listParams(c)
+	if err != nil {
+		return err
+	}
+	order := new(data.ListOrder)
+	if err := c.BodyParser(order); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	list, err := s.store.ReorderList(c.UserContext(), id, name, order.BookIDs)
+	if err != nil {
+		return userError(err)
+	}
+	return c.JSON(list)
+}
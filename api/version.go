@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+)
+
+// versionError maps errors of books and their versions to HTTP errors. Changes based on an outdated version are answered with
+// 412 Precondition Failed and missing books or versions with 404 Not Found. Everything else, e.g. a database which can not be reached,
+// is a failure of the server.
+func versionError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrVersionConflict):
+		return fiber.NewError(fiber.StatusPreconditionFailed, err.Error())
+	case storage.IsNotFound(err):
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	default:
+		return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+	}
+}
+
+// setETag sets the version of the book as entity tag of the response, so clients can send it back in If-Match.
+func setETag(c *fiber.Ctx, book *data.Book) {
+	c.Set(fiber.HeaderETag, fmt.Sprintf("%q", strconv.Itoa(book.Version)))
+}
+
+// ifMatch reads the version a change is based on from the If-Match header, which carries an entity tag as set by setETag.
+// It returns 0 if the header is missing, so the change is applied unconditionally.
+func ifMatch(c *fiber.Ctx) (int, error) {
+	tag := c.Get(fiber.HeaderIfMatch)
+	if tag == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(tag, "W/"), `"`))
+	if err != nil || version < 1 {
+		return 0, fiber.NewError(fiber.ErrBadRequest.Code, fmt.Sprintf("invalid If-Match header %q", tag))
+	}
+	return version, nil
+}
+
+// handleGetBookAsOf returns the book with the requested ID as it was at the time given by the `asOf` query parameter in RFC 3339 format.
+func (s *Server) handleGetBookAsOf(c *fiber.Ctx, id int) error {
+	at, err := time.Parse(time.RFC3339, c.Query("asOf"))
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	book, err := s.store.GetAsOf(c.UserContext(), id, at)
+	if err != nil {
+		return versionError(err)
+	}
+	return c.JSON(book)
+}
+
+// handleGetBookVersions returns a page of the versions of the requested book, newest first.
+func (s *Server) handleGetBookVersions(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	page, size, err := pagination(c)
+	if err != nil {
+		return err
+	}
+	versions, err := s.store.Versions(c.UserContext(), id, page, size)
+	if err != nil {
+		return versionError(err)
+	}
+	return c.JSON(versions)
+}
+
+// handleGetBookVersion returns a single version of the requested book.
+func (s *Server) handleGetBookVersion(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	n, err := c.ParamsInt("n")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	version, err := s.store.Version(c.UserContext(), id, n)
+	if err != nil {
+		return versionError(err)
+	}
+	return c.JSON(version)
+}
+
+// handleRevertBook writes a former version of the requested book as its new version and returns the book.
+// If the If-Match header is set, the revert is rejected unless the book is still at that version, just like updates.
+func (s *Server) handleRevertBook(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	n, err := c.ParamsInt("n")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	expected, err := ifMatch(c)
+	if err != nil {
+		return err
+	}
+	book, err := s.store.Revert(s.storageContext(c), id, n, expected)
+	if err != nil {
+		return versionError(err)
+	}
+	setETag(c, book)
+	return c.JSON(book)
+}
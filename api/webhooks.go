@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/storage"
+	"github.com/torbendury/books-go/utilities"
+)
+
+// webhookError maps errors of the webhook storage to HTTP errors. Missing webhooks are answered with 404 Not Found.
+// Everything else, e.g. a database which can not be reached, is a failure of the server.
+func webhookError(err error) error {
+	if storage.IsNotFound(err) {
+		return fiber.NewError(fiber.ErrNotFound.Code, err.Error())
+	}
+	return fiber.NewError(fiber.ErrInternalServerError.Code, err.Error())
+}
+
+// handleCreateWebhook subscribes a webhook to the requested event types. The secret is only accepted, it is never returned.
+func (s *Server) handleCreateWebhook(c *fiber.Ctx) error {
+	request := new(data.WebhookRequest)
+	if err := c.BodyParser(request); err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	hook, err := s.store.CreateWebhook(c.UserContext(), &data.Webhook{URL: request.URL, Events: request.Events, Secret: request.Secret})
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(hook)
+}
+
+// handleGetWebhooks returns all webhooks without their secrets.
+func (s *Server) handleGetWebhooks(c *fiber.Ctx) error {
+	hooks, err := s.store.ListWebhooks(c.UserContext())
+	if err != nil {
+		return err
+	}
+	return c.JSON(hooks)
+}
+
+// handleDeleteWebhook unsubscribes the requested webhook and drops its delivery log.
+func (s *Server) handleDeleteWebhook(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	if err := s.store.DeleteWebhook(c.UserContext(), id); err != nil {
+		return webhookError(err)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// handleGetWebhookDeliveries returns a page of the delivery log of the requested webhook, newest first.
+func (s *Server) handleGetWebhookDeliveries(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(fiber.ErrBadRequest.Code, err.Error())
+	}
+	page, size, err := pagination(c)
+	if err != nil {
+		return err
+	}
+	deliveries, err := s.store.Deliveries(c.UserContext(), id, page, size)
+	if err != nil {
+		return webhookError(err)
+	}
+	return c.JSON(deliveries)
+}
+
+// Headers which are sent with every webhook delivery.
+const (
+	HeaderWebhookEvent     = "X-Books-Event"
+	HeaderWebhookDelivery  = "X-Books-Delivery"
+	HeaderWebhookTimestamp = "X-Books-Timestamp"
+	HeaderWebhookSignature = "X-Books-Signature"
+)
+
+// SignWebhook returns the signature of a delivery as sent in the X-Books-Signature header: the hex encoded HMAC-SHA256 of
+// the Unix timestamp, a dot and the payload, keyed with the secret of the webhook and prefixed by "sha256=".
+// Receivers should compare it in constant time and reject old timestamps to prevent replays.
+func SignWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookConfig configures how a WebhookDispatcher delivers. Zero values are replaced by the defaults noted next to them.
+type WebhookConfig struct {
+	// MaxAttempts is the number of failed attempts after which a delivery is given up as dead, 8 by default.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles with every further failure. 10 seconds by default.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries, 1 hour by default.
+	MaxDelay time.Duration
+	// Timeout limits every single attempt, 10 seconds by default.
+	Timeout time.Duration
+	// PollInterval is how often due deliveries are looked for, 1 second by default.
+	PollInterval time.Duration
+}
+
+// webhookBatchSize is the maximum number of deliveries which are claimed at once.
+const webhookBatchSize = 16
+
+// maxDeliveryErrorLength is the maximum length of the error which is recorded for a failed attempt.
+const maxDeliveryErrorLength = 1000
+
+// WebhookDispatcher turns change events into deliveries for all subscribed webhooks and delivers them.
+// Deliveries are kept in the storage, so they survive restarts and are retried until they succeed or are given up as dead.
+type WebhookDispatcher struct {
+	store  storage.WebhookStorage
+	config WebhookConfig
+	client *http.Client
+	wake   chan struct{}
+}
+
+// NewWebhookDispatcher returns a dispatcher which keeps its deliveries in the given storage. It is idle until Run is called.
+func NewWebhookDispatcher(store storage.WebhookStorage, config WebhookConfig) *WebhookDispatcher {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 8
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 10 * time.Second
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = time.Hour
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	return &WebhookDispatcher{
+		store:  store,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue records a pending delivery of the event for every webhook which is subscribed to its type.
+func (d *WebhookDispatcher) Enqueue(event data.Event) error {
+	ctx := context.Background()
+	hooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	enqueued := false
+	for _, hook := range hooks {
+		if !contains(hook.Events, event.Type) {
+			continue
+		}
+		_, err := d.store.CreateDelivery(ctx, &data.WebhookDelivery{WebhookID: hook.ID, EventType: event.Type, Payload: payload})
+		if err != nil {
+			return fmt.Errorf("enqueueing event %v for webhook %v: %w", event.Sequence, hook.ID, err)
+		}
+		enqueued = true
+	}
+	if enqueued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run enqueues the change events of the storage and delivers due deliveries until the context is done. If events is nil, Run only delivers
+// and events have to be passed to Enqueue by other means, e.g. as a sink of the outbox relay, see storage.OutboxSinkFunc.
+// Once the context is done, attempts in flight are finished and the deliveries which are due are attempted one last time, for at most the timeout of an attempt.
+// Failures of the dispatcher itself are passed to report, failed attempts are recorded in the delivery log instead.
+func (d *WebhookDispatcher) Run(ctx context.Context, events storage.EventStorage, report func(error)) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if events != nil {
+			d.consume(ctx, events, report)
+		}
+	}()
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.deliverDue(ctx); err != nil {
+			report(fmt.Errorf("delivering webhooks: %w", err))
+		}
+		select {
+		case <-ctx.Done():
+			<-done
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.config.Timeout)
+			defer cancel()
+			if err := d.deliverDue(flushCtx); err != nil {
+				report(fmt.Errorf("delivering webhooks: %w", err))
+			}
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// consume enqueues events until the context is done, starting with the earliest event which is still available, so changes made
+// before the dispatcher was started are not missed. If the subscription is dropped because the dispatcher fell behind,
+// it resumes after the last enqueued event. Events which are not available anymore are reported as lost.
+// Events which have been published before the context is done are enqueued before consume returns.
+func (d *WebhookDispatcher) consume(ctx context.Context, events storage.EventStorage, report func(error)) {
+	after := int64(0)
+	for {
+		sub, err := events.Subscribe(after)
+		if errors.Is(err, storage.ErrEventsLost) {
+			report(fmt.Errorf("webhook events after %v were lost: %w", after, err))
+			after = storage.LiveEvents
+			continue
+		}
+		if err != nil {
+			report(fmt.Errorf("subscribing to events: %w", err))
+			return
+		}
+		for dropped := false; !dropped; {
+			select {
+			case <-ctx.Done():
+				d.enqueuePending(sub, report)
+				sub.Close()
+				return
+			case event, ok := <-sub.Events:
+				if !ok {
+					dropped = true
+					break
+				}
+				if err := d.Enqueue(event); err != nil {
+					report(err)
+				}
+				after = event.Sequence
+			}
+		}
+	}
+}
+
+// enqueuePending enqueues the events which have been published to the subscription but not received yet.
+func (d *WebhookDispatcher) enqueuePending(sub *storage.Subscription, report func(error)) {
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			if err := d.Enqueue(event); err != nil {
+				report(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliverDue claims batches of due deliveries and attempts them until none are due anymore or the context is done.
+// Claims last a little longer than an attempt may take, so deliveries of a crashed server are picked up again.
+// Claimed deliveries are attempted even if the context is done in the meantime, so their outcome is recorded.
+func (d *WebhookDispatcher) deliverDue(ctx context.Context) error {
+	for ctx.Err() == nil {
+		deliveries, err := d.store.ClaimDeliveries(ctx, time.Now().UTC(), 2*d.config.Timeout, webhookBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range deliveries {
+			if err := d.attempt(context.WithoutCancel(ctx), &deliveries[i]); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// attempt sends a delivery to its webhook and records the outcome. Every response other than 2xx counts as a failure,
+// which is retried with exponential backoff until the maximum number of attempts is reached.
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery *data.WebhookDelivery) error {
+	hook, err := d.store.GetWebhook(ctx, delivery.WebhookID)
+	if err != nil {
+		// the webhook has been deleted in the meantime, and its deliveries with it
+		return nil
+	}
+	delivery.Attempts++
+	delivery.LastStatusCode, err = d.send(ctx, hook, delivery)
+	if err == nil {
+		delivery.Status = data.DeliverySucceeded
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if len(delivery.LastError) > maxDeliveryErrorLength {
+			delivery.LastError = delivery.LastError[:maxDeliveryErrorLength]
+		}
+		if delivery.Attempts >= d.config.MaxAttempts {
+			delivery.Status = data.DeliveryDead
+		} else {
+			delivery.NextAttemptAt = time.Now().UTC().Add(utilities.Backoff(d.config.BaseDelay, d.config.MaxDelay, delivery.Attempts))
+		}
+	}
+	return d.store.UpdateDelivery(ctx, delivery)
+}
+
+// send posts the signed payload of a delivery to the URL of its webhook and returns the status code of the response.
+func (d *WebhookDispatcher) send(ctx context.Context, hook *data.Webhook, delivery *data.WebhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	request.Header.Set(HeaderWebhookEvent, delivery.EventType)
+	request.Header.Set(HeaderWebhookDelivery, strconv.Itoa(delivery.ID))
+	request.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(HeaderWebhookSignature, SignWebhook(hook.Secret, timestamp, delivery.Payload))
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status %v", response.Status)
+	}
+	return response.StatusCode, nil
+}
@@ -2,8 +2,14 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -14,6 +20,26 @@ import (
 // main acts as a firestarter and configuration holder for the web server application.
 // Besides creating a new server and starting it up, no actual logic should be placed here.
 func main() {
+	if err := run(); err != nil {
+		var code exitCode
+		if !errors.As(err, &code) {
+			slog.Error("exiting", "error", err)
+			code = 1
+		}
+		os.Exit(int(code))
+	}
+}
+
+// exitCode is returned for failures which have already been reported to the user, and only sets the exit status.
+type exitCode int
+
+func (code exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(code))
+}
+
+// run parses the flags and runs the server or the keys command until it is done. Failures are returned instead of exiting,
+// so the deferred calls, e.g. flushing the last spans, run before main exits.
+func run() error {
 	postgresMode := flag.Bool("postgres", false, "start server in postgres mode")
 
 	postgresHost := flag.String("pghost", "localhost", "hostname (or IP) of postgres DB - only in postgres mode")
@@ -21,36 +47,186 @@ func main() {
 	postgresUser := flag.String("pguser", "postgres", "user for postgres DB - only in postgres mode")
 	postgresPass := flag.String("pgpass", "changeme", "password for postgres DB - only in postgres mode")
 	postgresDb := flag.String("pgdatabase", "postgres", "database name of postgres DB - only in postgres mode")
+	postgresAttempts := flag.Int("pg-connect-attempts", 10, "failed attempts to reach the postgres DB after which the server gives up on starting - 0 tries forever, only in postgres mode")
+	postgresBaseDelay := flag.Duration("pg-connect-base-delay", 500*time.Millisecond, "delay before the second attempt to reach the postgres DB, doubled with every further failure - only in postgres mode")
+	postgresMaxDelay := flag.Duration("pg-connect-max-delay", 30*time.Second, "maximum delay between attempts to reach the postgres DB - only in postgres mode")
+	postgresTimeout := flag.Duration("pg-connect-timeout", 5*time.Second, "timeout of a single attempt to reach the postgres DB - only in postgres mode")
+	postgresUnready := flag.Bool("pg-start-unready", false, "start the server right away, unready until the postgres DB can be reached, and keep trying to reach it in the background - only in postgres mode")
+
+	jwks := flag.String("jwks", "", "path or URL of a JWKS to validate bearer tokens against - bearer tokens are rejected if empty")
+	jwtIssuer := flag.String("jwt-issuer", "", "required iss claim of bearer tokens")
+	jwtAudience := flag.String("jwt-audience", "books-go", "required aud claim of bearer tokens")
+	jwtLeeway := flag.Duration("jwt-leeway", 30*time.Second, "tolerated clock skew when checking exp and nbf of bearer tokens")
+
+	policyFile := flag.String("policy", "", "JSON file which maps roles to permissions - the built-in viewer, editor and admin roles are used if empty")
+
+	trashRetention := flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted books are kept in the trash before they are purged - 0 keeps them forever")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "how often the trash is checked for books to purge")
+
+	webhookAttempts := flag.Int("webhook-max-attempts", 8, "failed attempts after which a webhook delivery is given up as dead")
+	webhookBaseDelay := flag.Duration("webhook-base-delay", 10*time.Second, "delay before the first retry of a webhook delivery, doubled with every further failure")
+	webhookMaxDelay := flag.Duration("webhook-max-delay", time.Hour, "maximum delay between retries of a webhook delivery")
+	webhookTimeout := flag.Duration("webhook-timeout", 10*time.Second, "timeout of a single webhook delivery")
+
+	cacheSize := flag.Int("cache-size", 1000, "number of books which are cached for reads - 0 disables the cache")
+	cacheTTL := flag.Duration("cache-ttl", time.Minute, "how long a book is cached at most")
+
+	outboxInterval := flag.Duration("outbox-interval", time.Second, "how often the outbox is checked for events of other servers and failed events - only in postgres mode")
+	viewFlushInterval := flag.Duration("view-flush-interval", 10*time.Second, "how often the views of books, which rank suggestions, are written to the database - only in postgres mode")
+	outboxFile := flag.String("outbox-file", "", "file to append every change event to as a line of JSON - only in postgres mode")
 
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level of logged records - debug, info, warn or error")
+	logFormat := flag.String("log-format", api.LogFormatJSON, "format of the logs - json or text")
+
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "how long the server keeps serving on shutdown after reporting not ready, so load balancers stop routing to it")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long requests in flight and background tasks may take to finish on shutdown, including the delay")
+
+	slowQuery := flag.Duration("slow-query", 500*time.Millisecond, "SQL statements taking at least this long are logged with the ID of their request - 0 disables it, only in postgres mode")
+
+	traceExporter := flag.String("trace-exporter", api.TraceExporterNone, "where spans of requests and SQL statements are exported to - otlp, stdout or none")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "host and port of the OTLP collector which receives spans over HTTP - taken from OTEL_EXPORTER_OTLP_ENDPOINT if empty")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "send spans to the OTLP collector without TLS")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [keys issue|list|rotate|revoke [flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	var server *api.Server
+	logger, err := api.NewLogger(os.Stdout, api.LogConfig{Level: logLevel, Format: *logFormat})
+	if err != nil {
+		return fmt.Errorf("creating logger failed: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	tracerProvider, err := api.NewTracerProvider(api.TracingConfig{
+		Exporter:    *traceExporter,
+		Endpoint:    *otlpEndpoint,
+		Insecure:    *otlpInsecure,
+		ServiceName: "books-go",
+	})
+	if err != nil {
+		return fmt.Errorf("creating tracer provider failed: %w", err)
+	}
+	defer tracerProvider.Shutdown(context.Background())
+
+	opts := []api.Option{api.WithTracing(tracerProvider), api.WithLogger(logger), api.WithShutdownDelay(*shutdownDelay)}
+	if *policyFile != "" {
+		policy, err := api.LoadPolicy(*policyFile)
+		if err != nil {
+			return fmt.Errorf("loading policy failed: %w", err)
+		}
+		opts = append(opts, api.WithPolicy(policy))
+	}
+	if *jwks != "" {
+		verifier, err := api.NewJWTVerifier(api.JWTConfig{
+			JWKS:     *jwks,
+			Issuer:   *jwtIssuer,
+			Audience: *jwtAudience,
+			Leeway:   *jwtLeeway,
+		})
+		if err != nil {
+			return fmt.Errorf("creating JWT verifier failed: %w", err)
+		}
+		opts = append(opts, api.WithJWTVerifier(verifier))
+	}
+
+	config := api.AppConfig{
+		Addr:    ":3000",
+		Options: opts,
+		Fiber: fiber.Config{
+			ServerHeader: "books-go 0.0.1-inmem-test",
+			AppName:      "books-go 0.0.1-inmem-test",
+			IdleTimeout:  time.Duration(time.Second),
+			ReadTimeout:  time.Duration(time.Second),
+		},
+		Postgres: *postgresMode,
+		DB: storage.DBConfig{
+			Host:      *postgresHost,
+			Port:      *postgresPort,
+			User:      *postgresUser,
+			Password:  *postgresPass,
+			Name:      *postgresDb,
+			Tracer:    tracerProvider,
+			SlowQuery: *slowQuery,
+			Retry: storage.RetryConfig{
+				MaxAttempts: *postgresAttempts,
+				BaseDelay:   *postgresBaseDelay,
+				MaxDelay:    *postgresMaxDelay,
+				Timeout:     *postgresTimeout,
+			},
+		},
+		StartUnready:   *postgresUnready,
+		TrashRetention: *trashRetention,
+		PurgeInterval:  *purgeInterval,
+		Webhooks: api.WebhookConfig{
+			MaxAttempts: *webhookAttempts,
+			BaseDelay:   *webhookBaseDelay,
+			MaxDelay:    *webhookMaxDelay,
+			Timeout:     *webhookTimeout,
+		},
+		CacheSize:         *cacheSize,
+		CacheTTL:          *cacheTTL,
+		OutboxInterval:    *outboxInterval,
+		ViewFlushInterval: *viewFlushInterval,
+		ShutdownTimeout:   *shutdownTimeout,
+	}
 	if *postgresMode {
-		db := storage.OpenDB(*postgresHost, *postgresPort, *postgresUser, *postgresPass, *postgresDb)
-		server = api.NewServer(storage.NewPostgresqlStorage(db), ":3000", fiber.Config{
+		config.Fiber = fiber.Config{
 			ServerHeader:          "books-go 0.0.1",
 			AppName:               "books-go 0.0.1",
 			IdleTimeout:           time.Duration(time.Second * 5),
 			ReadTimeout:           time.Duration(time.Second * 5),
 			DisableStartupMessage: true,
-		})
-		defer func(db *sql.DB) {
-			err := db.Close()
+		}
+		if *outboxFile != "" {
+			file, err := os.OpenFile(*outboxFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("opening outbox file failed: %w", err)
 			}
-		}(db)
-	} else {
-		server = api.NewServer(storage.NewInMemoryStorage(), ":3000", fiber.Config{
-			ServerHeader: "books-go 0.0.1-inmem-test",
-			AppName:      "books-go 0.0.1-inmem-test",
-			IdleTimeout:  time.Duration(time.Second),
-			ReadTimeout:  time.Duration(time.Second),
-		})
+			defer file.Close()
+			config.OutboxSinks = append(config.OutboxSinks, storage.NewFileSink(file))
+		}
+	}
+
+	// the server is shut down gracefully on the first SIGINT or SIGTERM, a second one kills it right away
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	context.AfterFunc(signals, stopSignals)
+
+	if flag.Arg(0) == "keys" {
+		return runKeyCommand(signals, config, flag.Args()[1:])
+	}
+	app, err := api.NewApp(signals, config)
+	if err != nil {
+		return fmt.Errorf("starting server failed: %w", err)
+	}
+	if key := app.BootstrapKey(); key != "" {
+		fmt.Printf("bootstrap api key: %v\n", key)
+	}
+	if err := app.Run(signals); err != nil {
+		return fmt.Errorf("running server failed: %w", err)
 	}
+	// the last spans are flushed by the deferred calls
+	return nil
+}
 
-	err := server.Start()
+// runKeyCommand manages the API keys in the configured database instead of starting the server, see api.RunKeyCommand.
+// Keys are only stored in postgres mode, the in-memory storage starts out with a bootstrap key instead.
+func runKeyCommand(ctx context.Context, config api.AppConfig, args []string) error {
+	if !config.Postgres {
+		fmt.Fprintln(os.Stderr, "keys commands are only available in postgres mode")
+		return exitCode(2)
+	}
+	db, err := storage.OpenDB(ctx, config.DB)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening database failed: %w", err)
+	}
+	defer db.Close()
+	if err := api.RunKeyCommand(ctx, storage.NewPostgresqlStorage(db), args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(1)
 	}
+	return nil
 }
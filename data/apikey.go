@@ -0,0 +1,40 @@
+package data
+
+import "time"
+
+// Scopes which can be granted to API keys. Every route of the server requires exactly one of them.
+const (
+	ScopeBooksRead  = "books:read"
+	ScopeBooksWrite = "books:write"
+	ScopeKeysAdmin  = "keys:admin"
+	ScopeAuditRead  = "audit:read"
+	ScopeWebhooks   = "webhooks:admin"
+)
+
+// Scopes lists all scopes which can be granted to API keys.
+var Scopes = []string{ScopeBooksRead, ScopeBooksWrite, ScopeKeysAdmin, ScopeAuditRead, ScopeWebhooks}
+
+// APIKey describes an API key without its secret. Only a hash of the secret is stored, Prefix is kept to tell keys apart.
+// A revoked key can not be used or rotated anymore.
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// IssuedAPIKey is an API key together with its secret. It is only returned when a key is issued or rotated,
+// since the secret can not be recovered afterwards.
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// APIKeyRequest is the request body for issuing a new API key.
+type APIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,min=1,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=books:read books:write keys:admin audit:read webhooks:admin"`
+}
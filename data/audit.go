@@ -0,0 +1,64 @@
+package data
+
+import "time"
+
+// Actions which are recorded in the audit log.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// AuditEntityBook is the entity name of audit events about books.
+const AuditEntityBook = "book"
+
+// FieldChange is the value of a single field before and after a change. Before is null for creates, After is null for deletes.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEvent is an immutable record of a change to an entity, who made it and in which request.
+type AuditEvent struct {
+	ID        int64         `json:"id"`
+	Time      time.Time     `json:"time"`
+	Actor     string        `json:"actor"`
+	RequestID string        `json:"requestId"`
+	Action    string        `json:"action"`
+	Entity    string        `json:"entity"`
+	EntityID  int           `json:"entityId"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// AuditFilter selects audit events. Zero values do not filter, Since is inclusive and Until is exclusive. Pages start at 1.
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Entity   string
+	EntityID int
+	Since    time.Time
+	Until    time.Time
+	Page     int
+	Size     int
+}
+
+// Matches reports whether the event is selected by the filter, ignoring pagination.
+func (f AuditFilter) Matches(event AuditEvent) bool {
+	return (f.Actor == "" || event.Actor == f.Actor) &&
+		(f.Action == "" || event.Action == f.Action) &&
+		(f.Entity == "" || event.Entity == f.Entity) &&
+		(f.EntityID == 0 || event.EntityID == f.EntityID) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until))
+}
+
+// AuditPage is a single page of audit events, newest first.
+type AuditPage struct {
+	Events []AuditEvent `json:"events"`
+	Page   int          `json:"page"`
+	Size   int          `json:"size"`
+	Total  int          `json:"total"`
+}
@@ -2,15 +2,28 @@
 // Changes in the data structures will probably cause API to break without also changing the logic itself.
 package data
 
+import "time"
+
 // Struct book is a public struct which described a single book and its JSON representation.
 type Book struct {
 	ID          int     `json:"id" validate:"numeric,min=0"`
 	Title       string  `json:"title" validate:"required,min=1"`
 	Description string  `json:"description" validate:"required,min=1"`
 	Price       float64 `json:"price" validate:"required,numeric,min=0"`
+	Publisher   string  `json:"publisher,omitempty" validate:"max=100"`
+
+	// Version is the revision of the book, counted from 1 by the storage. Clients send the version they have read with changes,
+	// which are rejected if the book has been changed in between. Changes without a version are applied unconditionally.
+	Version int `json:"version" validate:"min=0"`
+
+	// Rating is maintained by the storage and therefore ignored when sent by clients. It is omitted as long as a book has no reviews.
+	Rating *RatingSummary `json:"rating,omitempty"`
+	// DeletedAt is maintained by the storage as well. It is only set for books in the trash.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
-type BookValidationError struct {
+// ValidationError describes a single field of a request body which failed schema validation.
+type ValidationError struct {
 	Field string
 	Tag   string
 	Value string
@@ -0,0 +1,21 @@
+package data
+
+import "time"
+
+// Types of the events which are published when books change. Restored books are announced as created, since they reappear for readers.
+const (
+	EventBookCreated = "book.created"
+	EventBookUpdated = "book.updated"
+	EventBookDeleted = "book.deleted"
+)
+
+// Event announces a change of a book. Sequence numbers increase monotonically, so clients can resume a stream after the last event they have seen.
+// Sequence numbers are assigned by the event bus of each server, only the sinks of an outbox receive the ID of the outbox entry instead.
+// Book is the book as it was written, it is omitted for deletions.
+type Event struct {
+	Sequence int64     `json:"sequence"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	BookID   int       `json:"bookId"`
+	Book     *Book     `json:"book,omitempty"`
+}
@@ -0,0 +1,85 @@
+package data
+
+import "time"
+
+// Reasons of stock movements, as recorded in the stock ledger.
+const (
+	StockIncrement = "increment"
+	StockDecrement = "decrement"
+	StockReserve   = "reserve"
+	StockRelease   = "release"
+	StockFulfil    = "fulfil"
+	StockExpire    = "expire"
+)
+
+// States of a reservation. Only active reservations count towards the reserved stock of a book.
+const (
+	ReservationActive    = "active"
+	ReservationReleased  = "released"
+	ReservationFulfilled = "fulfilled"
+	ReservationExpired   = "expired"
+)
+
+// StockLevel describes the inventory of a single book. Available is the quantity on hand minus all active reservations,
+// LowStock is set as soon as the available quantity drops to the configured threshold.
+type StockLevel struct {
+	BookID            int  `json:"bookId"`
+	Quantity          int  `json:"quantity"`
+	Reserved          int  `json:"reserved"`
+	Available         int  `json:"available"`
+	LowStockThreshold int  `json:"lowStockThreshold"`
+	LowStock          bool `json:"lowStock"`
+}
+
+// NewStockLevel calculates the derived fields of a StockLevel. A threshold of zero disables low-stock reporting.
+func NewStockLevel(bookID int, quantity int, reserved int, threshold int) *StockLevel {
+	available := quantity - reserved
+	return &StockLevel{
+		BookID:            bookID,
+		Quantity:          quantity,
+		Reserved:          reserved,
+		Available:         available,
+		LowStockThreshold: threshold,
+		LowStock:          threshold > 0 && available <= threshold,
+	}
+}
+
+// StockMovement is a single, immutable entry of the stock ledger. Delta is the change of the quantity on hand,
+// ReservedDelta the change of the reserved quantity.
+type StockMovement struct {
+	ID            int64     `json:"id"`
+	BookID        int       `json:"bookId"`
+	Reason        string    `json:"reason"`
+	Delta         int       `json:"delta"`
+	ReservedDelta int       `json:"reservedDelta"`
+	QuantityAfter int       `json:"quantityAfter"`
+	ReservationID *int      `json:"reservationId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Reservation is a hold on a number of copies of a book which expires if it is neither fulfilled nor released in time.
+type Reservation struct {
+	ID        int       `json:"id"`
+	BookID    int       `json:"bookId"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// StockAdjustment is the request body for incrementing or decrementing the stock of a book. A single adjustment is bounded,
+// so the stock can not be pushed beyond what the database stores with a few requests.
+type StockAdjustment struct {
+	Quantity int `json:"quantity" validate:"required,min=1,max=100000"`
+}
+
+// StockThreshold is the request body for configuring the low-stock threshold of a book.
+type StockThreshold struct {
+	Threshold int `json:"threshold" validate:"min=0"`
+}
+
+// ReservationRequest is the request body for reserving copies of a book. TTLSeconds defaults to 15 minutes if omitted.
+type ReservationRequest struct {
+	Quantity   int `json:"quantity" validate:"required,min=1"`
+	TTLSeconds int `json:"ttlSeconds" validate:"omitempty,min=1,max=86400"`
+}
@@ -0,0 +1,58 @@
+package data
+
+import "time"
+
+// States of a copy. A copy on hold is reserved for the borrower at the head of the hold queue until they check it out.
+const (
+	CopyAvailable = "available"
+	CopyOnLoan    = "on_loan"
+	CopyOnHold    = "on_hold"
+)
+
+// States of a hold. Waiting holds are served first-come first-served whenever a copy becomes available.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+)
+
+// Copy is a single physical copy of a book which can be lent to borrowers.
+type Copy struct {
+	ID      int    `json:"id"`
+	BookID  int    `json:"bookId"`
+	Status  string `json:"status"`
+	HeldFor string `json:"heldFor,omitempty"`
+}
+
+// Loan is the lending of a copy to a borrower. ReturnedAt is unset as long as the copy has not been returned.
+type Loan struct {
+	ID         int        `json:"id"`
+	CopyID     int        `json:"copyId"`
+	BookID     int        `json:"bookId"`
+	Borrower   string     `json:"borrower"`
+	LoanedAt   time.Time  `json:"loanedAt"`
+	DueAt      time.Time  `json:"dueAt"`
+	ReturnedAt *time.Time `json:"returnedAt,omitempty"`
+	Renewals   int        `json:"renewals"`
+}
+
+// Hold is a borrower's place in the queue for a book. Once a copy is returned, it is put aside for the oldest waiting hold.
+type Hold struct {
+	ID        int        `json:"id"`
+	BookID    int        `json:"bookId"`
+	Borrower  string     `json:"borrower"`
+	Status    string     `json:"status"`
+	CopyID    *int       `json:"copyId,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadyAt   *time.Time `json:"readyAt,omitempty"`
+}
+
+// CopiesRequest is the request body for adding copies of a book to the library.
+type CopiesRequest struct {
+	Count int `json:"count" validate:"required,min=1,max=100"`
+}
+
+// BorrowerRequest is the request body for checking out a book or placing a hold on it.
+type BorrowerRequest struct {
+	Borrower string `json:"borrower" validate:"required,min=1,max=100"`
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"math"
+	"time"
+)
+
+// States of an order. New orders are pending, see CanTransitionOrder for the allowed transitions.
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderCancelled = "cancelled"
+)
+
+// orderTransitions lists the states an order can move to from a given state. Shipped and cancelled orders are final.
+var orderTransitions = map[string][]string{
+	OrderPending: {OrderPaid, OrderCancelled},
+	OrderPaid:    {OrderShipped, OrderCancelled},
+}
+
+// CanTransitionOrder reports whether an order may move from one state to another.
+func CanTransitionOrder(from string, to string) bool {
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderLine is a single position of an order. Title and UnitPrice are captured from the book when the order is created,
+// so later changes of the book do not change existing orders.
+type OrderLine struct {
+	BookID    int     `json:"bookId" validate:"required,min=1"`
+	Quantity  int     `json:"quantity" validate:"required,min=1,max=1000"`
+	Title     string  `json:"title"`
+	UnitPrice float64 `json:"unitPrice"`
+	LineTotal float64 `json:"lineTotal"`
+}
+
+// Order is a customer's order of one or more books.
+type Order struct {
+	ID         int         `json:"id"`
+	CustomerID string      `json:"customerId" validate:"required,min=1,max=100"`
+	Status     string      `json:"status"`
+	Lines      []OrderLine `json:"lines" validate:"required,min=1,dive"`
+	Total      float64     `json:"total"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+}
+
+// PriceLine captures title and price of a book for an order line and calculates the line total.
+func (l *OrderLine) PriceLine(b *Book) {
+	l.Title = b.Title
+	l.UnitPrice = b.Price
+	l.LineTotal = roundCents(b.Price * float64(l.Quantity))
+}
+
+// CalculateTotal sums up the totals of all lines of the order.
+func (o *Order) CalculateTotal() {
+	total := 0.0
+	for _, line := range o.Lines {
+		total += line.LineTotal
+	}
+	o.Total = roundCents(total)
+}
+
+// OrderStatusChange is the request body for moving an order into another state.
+type OrderStatusChange struct {
+	Status string `json:"status" validate:"required,oneof=pending paid shipped cancelled"`
+}
+
+// roundCents rounds an amount of money to whole cents.
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,44 @@
+package data
+
+import "time"
+
+// Review is a single rating of a book, written by a reader. It is always nested below the book it belongs to.
+type Review struct {
+	ID        int       `json:"id"`
+	BookID    int       `json:"bookId"`
+	Rating    int       `json:"rating" validate:"required,min=1,max=5"`
+	Text      string    `json:"text" validate:"max=2000"`
+	Author    string    `json:"author" validate:"required,min=1,max=100"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RatingSummary is the aggregate over all reviews of a book. It is maintained by the storage whenever reviews are added or removed.
+// Histogram[0] holds the number of one-star ratings, Histogram[4] the number of five-star ratings.
+type RatingSummary struct {
+	Average   float64 `json:"average"`
+	Count     int     `json:"count"`
+	Histogram [5]int  `json:"histogram"`
+}
+
+// NewRatingSummary calculates a RatingSummary from a rating histogram. It returns nil if there are no ratings at all.
+func NewRatingSummary(histogram [5]int) *RatingSummary {
+	summary := RatingSummary{Histogram: histogram}
+	sum := 0
+	for i, count := range histogram {
+		summary.Count += count
+		sum += (i + 1) * count
+	}
+	if summary.Count == 0 {
+		return nil
+	}
+	summary.Average = float64(sum) / float64(summary.Count)
+	return &summary
+}
+
+// ReviewPage is a single page of reviews, newest first. Total is the number of reviews over all pages.
+type ReviewPage struct {
+	Reviews []Review `json:"reviews"`
+	Page    int      `json:"page"`
+	Size    int      `json:"size"`
+	Total   int      `json:"total"`
+}
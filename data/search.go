@@ -0,0 +1,9 @@
+package data
+
+// SearchResult is a single hit of a full-text search. Besides the matching book itself, it carries
+// the relevance rank which was used for ordering and a snippet with the matched terms highlighted.
+type SearchResult struct {
+	Book    Book    `json:"book"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
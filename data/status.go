@@ -3,3 +3,26 @@ package data
 type HealthStatus struct {
 	Message string `json:"message"`
 }
+
+// Outcomes of readiness checks, see ReadinessReport.
+const (
+	StatusReady   = "ready"
+	StatusUnready = "unready"
+	CheckOK       = "ok"
+	CheckFailed   = "failed"
+)
+
+// ReadinessReport is the outcome of all readiness checks of a server. The server is unready if any required check failed.
+type ReadinessReport struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
@@ -0,0 +1,9 @@
+package data
+
+// Suggestion is a single autocomplete suggestion for a book title.
+// Popularity is the signal which is used for ranking suggestions with the same closeness to the typed prefix.
+type Suggestion struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	Popularity int64  `json:"popularity"`
+}
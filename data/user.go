@@ -0,0 +1,48 @@
+package data
+
+import "time"
+
+// Names of the reading lists every user has.
+const (
+	ListWishlist = "wishlist"
+	ListReading  = "reading"
+	ListFinished = "finished"
+)
+
+// IsReadingList reports whether the given name is one of the reading lists every user has.
+func IsReadingList(name string) bool {
+	return name == ListWishlist || name == ListReading || name == ListFinished
+}
+
+// User is an end user of the catalogue who keeps personal reading lists.
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name" validate:"required,min=1,max=100"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ListEntry is a reference to a book on a reading list. Position is the zero-based place of the entry within its list,
+// Progress is the percentage of the book the user has read so far.
+type ListEntry struct {
+	BookID   int       `json:"bookId" validate:"required,min=1"`
+	Position int       `json:"position"`
+	Progress int       `json:"progress" validate:"min=0,max=100"`
+	AddedAt  time.Time `json:"addedAt"`
+}
+
+// ReadingList is one of the named, ordered lists of books of a user.
+type ReadingList struct {
+	UserID  int         `json:"userId"`
+	Name    string      `json:"name"`
+	Entries []ListEntry `json:"entries"`
+}
+
+// ListOrder is the request body for reordering a reading list. It has to contain every book of the list exactly once.
+type ListOrder struct {
+	BookIDs []int `json:"bookIds" validate:"required,dive,min=1"`
+}
+
+// ListProgress is the request body for updating the reading progress of a list entry.
+type ListProgress struct {
+	Progress int `json:"progress" validate:"min=0,max=100"`
+}
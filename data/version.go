@@ -0,0 +1,20 @@
+package data
+
+import "time"
+
+// BookVersion is a full snapshot of a book as it was written by a single revision.
+// The rating of the snapshot is always empty, since it is maintained by the storage and not part of a revision.
+type BookVersion struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Actor     string    `json:"actor"`
+	Book      Book      `json:"book"`
+}
+
+// BookVersionPage is a single page of the versions of a book, newest first. Total is the number of versions over all pages.
+type BookVersionPage struct {
+	Versions []BookVersion `json:"versions"`
+	Page     int           `json:"page"`
+	Size     int           `json:"size"`
+	Total    int           `json:"total"`
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Statuses of webhook deliveries. Pending deliveries are retried until they succeed or are given up as dead.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// Webhook is a subscription of a partner system to changes of books. Events lists the event types which are delivered, see Event.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Secret signs the deliveries of the webhook. It is set by the client and never returned.
+	Secret string `json:"-"`
+}
+
+// WebhookRequest is the request body for subscribing a webhook.
+type WebhookRequest struct {
+	URL    string   `json:"url" validate:"required,url,max=2000"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=book.created book.updated book.deleted"`
+	Secret string   `json:"secret" validate:"required,min=16,max=200"`
+}
+
+// WebhookDelivery is a single event which is delivered to a webhook, together with the outcome of the latest attempt.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhookId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// WebhookDeliveryPage is a single page of the deliveries of a webhook, newest first. Total is the number of deliveries over all pages.
+type WebhookDeliveryPage struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	Page       int               `json:"page"`
+	Size       int               `json:"size"`
+	Total      int               `json:"total"`
+}
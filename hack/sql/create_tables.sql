@@ -1,3 +1,20 @@
+DROP TABLE IF EXISTS outbox;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS book_versions;
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS list_entries;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS holds;
+DROP TABLE IF EXISTS loans;
+DROP TABLE IF EXISTS copies;
+DROP TABLE IF EXISTS order_lines;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS stock_ledger;
+DROP TABLE IF EXISTS reservations;
+DROP TABLE IF EXISTS inventory;
+DROP TABLE IF EXISTS reviews;
 DROP TABLE IF EXISTS books;
 
 CREATE TABLE IF NOT EXISTS books(
@@ -5,5 +22,244 @@ CREATE TABLE IF NOT EXISTS books(
     title VARCHAR(250) NOT NULL,
     description VARCHAR(250) NOT NULL,
     price NUMERIC NOT NULL,
+    publisher VARCHAR(100) NOT NULL DEFAULT '',
+    version INTEGER NOT NULL DEFAULT 1,
+    views BIGINT NOT NULL DEFAULT 0,
+    rating_histogram INTEGER[5] NOT NULL DEFAULT '{0,0,0,0,0}',
+    -- books are deleted softly: they stay in the trash until they are purged, see storage.TrashStorage
+    deleted_at TIMESTAMPTZ,
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', description), 'B')
+    ) STORED,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS books_search_vector_idx ON books USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS books_deleted_at_idx ON books (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS reviews(
+    id SERIAL,
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    text VARCHAR(2000) NOT NULL,
+    author VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_book_id_created_at_idx ON reviews (book_id, created_at DESC, id DESC);
+
+CREATE TABLE IF NOT EXISTS inventory(
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    low_stock_threshold INTEGER NOT NULL DEFAULT 0 CHECK (low_stock_threshold >= 0),
+    PRIMARY KEY (book_id)
+);
+
+CREATE TABLE IF NOT EXISTS reservations(
+    id SERIAL,
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS reservations_active_book_id_idx ON reservations (book_id) WHERE status = 'active';
+
+-- The stock ledger deliberately has no foreign key to books: it keeps the history of deleted books, too.
+CREATE TABLE IF NOT EXISTS stock_ledger(
+    id BIGSERIAL,
+    book_id INTEGER NOT NULL,
+    reason VARCHAR(16) NOT NULL,
+    delta INTEGER NOT NULL,
+    reserved_delta INTEGER NOT NULL,
+    quantity_after INTEGER NOT NULL,
+    reservation_id INTEGER,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS stock_ledger_book_id_idx ON stock_ledger (book_id, id);
+
+CREATE OR REPLACE FUNCTION stock_ledger_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'stock_ledger is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER stock_ledger_append_only
+    BEFORE UPDATE OR DELETE ON stock_ledger
+    FOR EACH ROW EXECUTE FUNCTION stock_ledger_append_only();
+
+CREATE TABLE IF NOT EXISTS orders(
+    id SERIAL,
+    customer_id VARCHAR(100) NOT NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('pending', 'paid', 'shipped', 'cancelled')),
+    total NUMERIC(12, 2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id, id);
+
+-- Order lines capture title and price at order time and keep no foreign key to books, so orders survive deleted books.
+CREATE TABLE IF NOT EXISTS order_lines(
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    book_id INTEGER NOT NULL,
+    title VARCHAR(250) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price NUMERIC NOT NULL,
+    line_total NUMERIC(12, 2) NOT NULL,
+    PRIMARY KEY (order_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS copies(
+    id SERIAL,
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('available', 'on_loan', 'on_hold')),
+    held_for VARCHAR(100),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS copies_book_id_status_idx ON copies (book_id, status);
+
+CREATE TABLE IF NOT EXISTS loans(
+    id SERIAL,
+    copy_id INTEGER NOT NULL REFERENCES copies(id) ON DELETE CASCADE,
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    borrower VARCHAR(100) NOT NULL,
+    loaned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    due_at TIMESTAMPTZ NOT NULL,
+    returned_at TIMESTAMPTZ,
+    renewals INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+
+-- A copy can only be part of a single open loan, no matter how the application behaves.
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_copy_id_idx ON loans (copy_id) WHERE returned_at IS NULL;
+CREATE INDEX IF NOT EXISTS loans_open_due_at_idx ON loans (due_at) WHERE returned_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS holds(
+    id SERIAL,
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    borrower VARCHAR(100) NOT NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('waiting', 'ready', 'fulfilled')),
+    copy_id INTEGER REFERENCES copies(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ready_at TIMESTAMPTZ,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS holds_open_borrower_idx ON holds (book_id, borrower) WHERE status IN ('waiting', 'ready');
+
+CREATE TABLE IF NOT EXISTS users(
+    id SERIAL,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS list_entries(
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    list_name VARCHAR(16) NOT NULL CHECK (list_name IN ('wishlist', 'reading', 'finished')),
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    progress SMALLINT NOT NULL DEFAULT 0 CHECK (progress BETWEEN 0 AND 100),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, list_name, book_id)
+);
+
+CREATE INDEX IF NOT EXISTS list_entries_book_id_idx ON list_entries (book_id);
+
+CREATE TABLE IF NOT EXISTS api_keys(
+    id SERIAL,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    rotated_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_events(
+    id BIGSERIAL,
+    occurred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor VARCHAR(250) NOT NULL,
+    request_id VARCHAR(100) NOT NULL,
+    action VARCHAR(16) NOT NULL CHECK (action IN ('create', 'update', 'delete', 'restore', 'purge')),
+    entity VARCHAR(32) NOT NULL,
+    -- no foreign key, the history of an entity outlives the entity itself
+    entity_id INTEGER NOT NULL,
+    changes JSONB NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_entity_idx ON audit_events (entity, entity_id, id);
+CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor, id);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+-- Full snapshot of every revision of a book. The rating is maintained separately and therefore not part of a revision.
+CREATE TABLE IF NOT EXISTS book_versions(
+    book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor VARCHAR(250) NOT NULL,
+    title VARCHAR(250) NOT NULL,
+    description VARCHAR(250) NOT NULL,
+    price NUMERIC NOT NULL,
+    publisher VARCHAR(100) NOT NULL,
+    PRIMARY KEY (book_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks(
+    id SERIAL,
+    url VARCHAR(2000) NOT NULL,
+    events TEXT[] NOT NULL,
+    secret VARCHAR(200) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    id SERIAL,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(32) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_status_code INTEGER NOT NULL DEFAULT 0,
+    last_error VARCHAR(1000) NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+
+-- Change events are written here in the same transaction as the change and removed once they have been relayed.
+-- The outbox deliberately has no foreign key to books: events about a book must outlive it until they are relayed.
+CREATE TABLE IF NOT EXISTS outbox(
+    id BIGSERIAL,
+    event_type VARCHAR(32) NOT NULL,
+    book_id INTEGER NOT NULL,
+    book JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     PRIMARY KEY (id)
 );
@@ -3,3 +3,7 @@ INSERT INTO books(title, description, price) VALUES ('How to attract people to r
 INSERT INTO books(title, description, price) VALUES ('My second book', 'And why the first one was mostly bs', 47.11);
 INSERT INTO books(title, description, price) VALUES ('The price is hot', 'It is definitely worth reading!', 6.66);
 INSERT INTO books(title, description, price) VALUES ('Bitter tears of software architects', 'Make project managers grow and thrive', 42.42);
+INSERT INTO book_versions(book_id, version, actor, title, description, price, publisher) SELECT id, version, 'seed', title, description, price, publisher FROM books;
+
+-- API key for local development with all scopes. The secret is bgo_local_development_key, see test.http. Never use it anywhere else.
+INSERT INTO api_keys(name, prefix, key_hash, scopes) VALUES ('development', 'bgo_local_de', '9edded2bd72cdff47af68ff642fdedd1ab18aef088809109094843b256c5330a', '{books:read,books:write,keys:admin,audit:read,webhooks:admin}');
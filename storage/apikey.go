@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrKeyRevoked is returned if a revoked API key is rotated or revoked again.
+var ErrKeyRevoked = errors.New("api key is revoked")
+
+// KeyStorage is implemented by every storage which keeps API keys. Keys are only ever stored and looked up by the hash of their secret.
+type KeyStorage interface {
+	CreateAPIKey(ctx context.Context, key *data.APIKey, hash string) (*data.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (*data.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]data.APIKey, error)
+	RotateAPIKey(ctx context.Context, id int, prefix string, hash string) (*data.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int) (*data.APIKey, error)
+}
+
+// apiKeyRecord is an API key as kept by the InMemoryStorage.
+type apiKeyRecord struct {
+	key  data.APIKey
+	hash string
+}
+
+// copyAPIKey returns a deep copy of an API key, so callers can not modify the stored scopes and timestamps.
+func copyAPIKey(k *data.APIKey) *data.APIKey {
+	result := *k
+	result.Scopes = append([]string(nil), k.Scopes...)
+	if k.RotatedAt != nil {
+		rotatedAt := *k.RotatedAt
+		result.RotatedAt = &rotatedAt
+	}
+	if k.RevokedAt != nil {
+		revokedAt := *k.RevokedAt
+		result.RevokedAt = &revokedAt
+	}
+	return &result
+}
+
+// CreateAPIKey stores a new API key with the hash of its secret.
+func (ims *InMemoryStorage) CreateAPIKey(ctx context.Context, k *data.APIKey, hash string) (*data.APIKey, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	ims.apiKeySerial++
+	record := &apiKeyRecord{key: *copyAPIKey(k), hash: hash}
+	record.key.ID = ims.apiKeySerial
+	record.key.CreatedAt = time.Now().UTC()
+	record.key.RotatedAt = nil
+	record.key.RevokedAt = nil
+	ims.apiKeys[record.key.ID] = record
+	return copyAPIKey(&record.key), nil
+}
+
+// GetAPIKeyByHash returns the API key whose secret has the given hash. Revoked keys are not found.
+func (ims *InMemoryStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*data.APIKey, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	for _, record := range ims.apiKeys {
+		if record.hash == hash && record.key.RevokedAt == nil {
+			return copyAPIKey(&record.key), nil
+		}
+	}
+	return nil, fmt.Errorf("api key %w", ErrNotFound)
+}
+
+// ListAPIKeys returns all API keys, including revoked ones, ordered by ID.
+func (ims *InMemoryStorage) ListAPIKeys(ctx context.Context) ([]data.APIKey, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	keys := make([]data.APIKey, 0, len(ims.apiKeys))
+	for id := 1; id <= ims.apiKeySerial; id++ {
+		if record, ok := ims.apiKeys[id]; ok {
+			keys = append(keys, *copyAPIKey(&record.key))
+		}
+	}
+	return keys, nil
+}
+
+// RotateAPIKey replaces the secret of an API key. The old secret stops working immediately, name and scopes are kept.
+func (ims *InMemoryStorage) RotateAPIKey(ctx context.Context, id int, prefix string, hash string) (*data.APIKey, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, ok := ims.apiKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("api key id %v %w", id, ErrNotFound)
+	}
+	if record.key.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: api key id %v", ErrKeyRevoked, id)
+	}
+	now := time.Now().UTC()
+	record.key.Prefix = prefix
+	record.key.RotatedAt = &now
+	record.hash = hash
+	return copyAPIKey(&record.key), nil
+}
+
+// RevokeAPIKey revokes an API key for good. The key is kept, so it still shows up when listing keys.
+func (ims *InMemoryStorage) RevokeAPIKey(ctx context.Context, id int) (*data.APIKey, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, ok := ims.apiKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("api key id %v %w", id, ErrNotFound)
+	}
+	if record.key.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: api key id %v", ErrKeyRevoked, id)
+	}
+	now := time.Now().UTC()
+	record.key.RevokedAt = &now
+	return copyAPIKey(&record.key), nil
+}
+
+// apiKeyColumns are the columns of the api_keys table which make up a data.APIKey, in the order expected by scanAPIKey.
+const apiKeyColumns = "id, name, prefix, scopes, created_at, rotated_at, revoked_at"
+
+// scanAPIKey scans a row of apiKeyColumns into an API key.
+func scanAPIKey(row rowScanner) (*data.APIKey, error) {
+	var key data.APIKey
+	if err := row.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.RotatedAt, &key.RevokedAt); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// CreateAPIKey stores a new API key with the hash of its secret.
+func (psql *PostgresqlStorage) CreateAPIKey(ctx context.Context, k *data.APIKey, hash string) (*data.APIKey, error) {
+	query := `
+		INSERT INTO api_keys(name, prefix, key_hash, scopes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + apiKeyColumns
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanAPIKey(psql.databaseConnection.QueryRowContext(ctx, query, k.Name, k.Prefix, hash, pq.Array(k.Scopes)))
+}
+
+// GetAPIKeyByHash returns the API key whose secret has the given hash. Revoked keys are not found.
+func (psql *PostgresqlStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*data.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanAPIKey(psql.databaseConnection.QueryRowContext(ctx, query, hash))
+}
+
+// ListAPIKeys returns all API keys, including revoked ones, ordered by ID.
+func (psql *PostgresqlStorage) ListAPIKeys(ctx context.Context) ([]data.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]data.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// changeAPIKey applies an update to a single API key which has not been revoked yet and returns the key afterwards.
+func (psql *PostgresqlStorage) changeAPIKey(ctx context.Context, id int, update string, args ...any) (*data.APIKey, error) {
+	var key *data.APIKey
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		current, err := scanAPIKey(tx.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			return err
+		}
+		if current.RevokedAt != nil {
+			return fmt.Errorf("%w: api key id %v", ErrKeyRevoked, id)
+		}
+		key, err = scanAPIKey(tx.QueryRowContext(ctx, update, append([]any{id}, args...)...))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RotateAPIKey replaces the secret of an API key. The old secret stops working immediately, name and scopes are kept.
+func (psql *PostgresqlStorage) RotateAPIKey(ctx context.Context, id int, prefix string, hash string) (*data.APIKey, error) {
+	query := `
+		UPDATE api_keys
+		SET prefix = $2, key_hash = $3, rotated_at = now()
+		WHERE id = $1
+		RETURNING ` + apiKeyColumns
+	return psql.changeAPIKey(ctx, id, query, prefix, hash)
+}
+
+// RevokeAPIKey revokes an API key for good. The key is kept, so it still shows up when listing keys.
+func (psql *PostgresqlStorage) RevokeAPIKey(ctx context.Context, id int) (*data.APIKey, error) {
+	query := `
+		UPDATE api_keys
+		SET revoked_at = now()
+		WHERE id = $1
+		RETURNING ` + apiKeyColumns
+	return psql.changeAPIKey(ctx, id, query)
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// AuditStorage is implemented by every storage which records changes to books in an audit log.
+// Events are written by Create, Update, Delete, Restore and Purge together with the change itself, using the actor and request ID of their context.
+type AuditStorage interface {
+	AuditEvents(ctx context.Context, filter data.AuditFilter) (*data.AuditPage, error)
+}
+
+// bookAuditSkip lists the fields of a book which are maintained by the storage and therefore not part of its audit trail.
+var bookAuditSkip = []string{"id", "version", "rating", "deletedAt"}
+
+// newBookAuditEvent describes a change of a book. Before is nil for creates and restores, after is nil for deletes and purges.
+func newBookAuditEvent(ctx context.Context, action string, id int, before *data.Book, after *data.Book) data.AuditEvent {
+	var b, a interface{}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	changes := diffFields(b, a, bookAuditSkip...)
+	LoggerFrom(ctx).Debug("changing book", "action", action, "book_id", id, "changed_fields", len(changes))
+	return data.AuditEvent{
+		Time:      time.Now().UTC(),
+		Actor:     ActorFrom(ctx),
+		RequestID: RequestIDFrom(ctx),
+		Action:    action,
+		Entity:    data.AuditEntityBook,
+		EntityID:  id,
+		Changes:   changes,
+	}
+}
+
+// diffFields compares two pointers to structs of the same type field by field and returns the fields which differ, named by their JSON names.
+// Either side may be nil, in which case every field is reported with a null value on that side.
+func diffFields(before interface{}, after interface{}, skip ...string) []data.FieldChange {
+	changes := make([]data.FieldChange, 0)
+	var b, a reflect.Value
+	if before != nil {
+		b = reflect.ValueOf(before).Elem()
+	}
+	if after != nil {
+		a = reflect.ValueOf(after).Elem()
+	}
+	var t reflect.Type
+	if b.IsValid() {
+		t = b.Type()
+	} else {
+		t = a.Type()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == name
+		}
+		if skipped {
+			continue
+		}
+		change := data.FieldChange{Field: name}
+		if b.IsValid() {
+			change.Before = b.Field(i).Interface()
+		}
+		if a.IsValid() {
+			change.After = a.Field(i).Interface()
+		}
+		if !reflect.DeepEqual(change.Before, change.After) {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// AuditEvents returns a page of the audit events selected by the filter, newest first.
+func (ims *InMemoryStorage) AuditEvents(ctx context.Context, filter data.AuditFilter) (*data.AuditPage, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	result := &data.AuditPage{
+		Events: make([]data.AuditEvent, 0, filter.Size),
+		Page:   filter.Page,
+		Size:   filter.Size,
+	}
+	skip := pageOffset(filter.Page, filter.Size)
+	for i := len(ims.auditLog) - 1; i >= 0; i-- {
+		event := ims.auditLog[i]
+		if !filter.Matches(event) {
+			continue
+		}
+		result.Total++
+		if result.Total > skip && len(result.Events) < filter.Size {
+			event.Changes = append([]data.FieldChange(nil), event.Changes...)
+			result.Events = append(result.Events, event)
+		}
+	}
+	return result, nil
+}
+
+// record appends an event to the in-memory audit log. The caller must hold the lock.
+func (ims *InMemoryStorage) record(event data.AuditEvent) {
+	ims.auditSerial++
+	event.ID = ims.auditSerial
+	ims.auditLog = append(ims.auditLog, event)
+}
+
+// insertAuditEvent writes an audit event within the transaction of the change it describes, so changes are never left unaudited.
+func insertAuditEvent(ctx context.Context, tx *sql.Tx, event data.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events(actor, request_id, action, entity, entity_id, changes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, query, event.Actor, event.RequestID, event.Action, event.Entity, event.EntityID, changes)
+	return err
+}
+
+// AuditEvents returns a page of the audit events selected by the filter, newest first.
+func (psql *PostgresqlStorage) AuditEvents(ctx context.Context, filter data.AuditFilter) (*data.AuditPage, error) {
+	conditions := []string{"TRUE"}
+	args := make([]any, 0)
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.Entity != "" {
+		where("entity = $%d", filter.Entity)
+	}
+	if filter.EntityID != 0 {
+		where("entity_id = $%d", filter.EntityID)
+	}
+	if !filter.Since.IsZero() {
+		where("occurred_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("occurred_at < $%d", filter.Until)
+	}
+	whereClause := strings.Join(conditions, " AND ")
+	countQuery := `
+		SELECT COUNT(*)
+		FROM audit_events
+		WHERE ` + whereClause
+	query := fmt.Sprintf(`
+		SELECT id, occurred_at, actor, request_id, action, entity, entity_id, changes
+		FROM audit_events
+		WHERE %v
+		ORDER BY id DESC
+		LIMIT $%d OFFSET $%d
+	`, whereClause, len(args)+1, len(args)+2)
+
+	result := &data.AuditPage{
+		Events: make([]data.AuditEvent, 0, filter.Size),
+		Page:   filter.Page,
+		Size:   filter.Size,
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, countQuery, args...).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, append(args, filter.Size, pageOffset(filter.Page, filter.Size))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			event   data.AuditEvent
+			changes []byte
+		)
+		if err := rows.Scan(&event.ID, &event.Time, &event.Actor, &event.RequestID, &event.Action, &event.Entity, &event.EntityID, &changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &event.Changes); err != nil {
+			return nil, err
+		}
+		result.Events = append(result.Events, event)
+	}
+	return result, rows.Err()
+}
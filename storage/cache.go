@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheStats are the statistics of a CachedStorage since it has been created.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Capacity  int    `json:"capacity"`
+}
+
+// CachedStorage decorates any Storage with a read-through cache for Get. At most size books are cached, the least recently used
+// book is evicted first and every book expires after the TTL. Concurrent misses for the same book are collapsed into a single read.
+// Changes made through the decorator invalidate the changed book right away. Changes made through other servers are only noticed
+// by RunInvalidation, and changes of ratings made elsewhere only once the book expires.
+type CachedStorage struct {
+	Storage
+
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	lru     *list.List
+	epoch   uint64
+	loads   singleflight.Group
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	warm      atomic.Bool
+}
+
+// cacheEntry is a cached book together with the time it expires.
+type cacheEntry struct {
+	book    data.Book
+	expires time.Time
+}
+
+// NewCachedStorage returns a CachedStorage which caches up to size books of the given storage for the TTL.
+func NewCachedStorage(store Storage, size int, ttl time.Duration) *CachedStorage {
+	return &CachedStorage{
+		Storage: store,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[int]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// copyBook returns a copy of a book which shares nothing with the original, so cached books can not be modified by callers.
+func copyBook(b *data.Book) *data.Book {
+	book := *b
+	if b.Rating != nil {
+		rating := *b.Rating
+		book.Rating = &rating
+	}
+	return &book
+}
+
+// Get returns the book with the given ID from the cache, or reads it from the decorated storage and caches it.
+// Errors are not cached.
+func (cs *CachedStorage) Get(ctx context.Context, id int) (*data.Book, error) {
+	cs.mu.Lock()
+	if element, ok := cs.entries[id]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cs.lru.MoveToFront(element)
+			book := copyBook(&entry.book)
+			cs.mu.Unlock()
+			cs.hits.Add(1)
+			return book, nil
+		}
+		cs.remove(id)
+	}
+	epoch := cs.epoch
+	cs.mu.Unlock()
+	cs.misses.Add(1)
+
+	result, err, _ := cs.loads.Do(strconv.Itoa(id), func() (interface{}, error) {
+		book, err := cs.Storage.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		// a book which has been read before an invalidation may be outdated already
+		if cs.epoch == epoch {
+			cs.add(book)
+		}
+		return book, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBook(result.(*data.Book)), nil
+}
+
+// add caches a book and evicts the least recently used books beyond the size. The caller must hold the lock.
+func (cs *CachedStorage) add(book *data.Book) {
+	cs.remove(book.ID)
+	cs.entries[book.ID] = cs.lru.PushFront(&cacheEntry{book: *copyBook(book), expires: time.Now().Add(cs.ttl)})
+	for cs.lru.Len() > cs.size {
+		oldest := cs.lru.Back()
+		cs.remove(oldest.Value.(*cacheEntry).book.ID)
+		cs.evictions.Add(1)
+	}
+}
+
+// remove drops a book from the cache. The caller must hold the lock.
+func (cs *CachedStorage) remove(id int) {
+	if element, ok := cs.entries[id]; ok {
+		cs.lru.Remove(element)
+		delete(cs.entries, id)
+	}
+}
+
+// Invalidate drops a book from the cache, reads which are in flight for it are not cached anymore.
+func (cs *CachedStorage) Invalidate(id int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.epoch++
+	cs.remove(id)
+	cs.loads.Forget(strconv.Itoa(id))
+}
+
+// Clear drops all books from the cache.
+func (cs *CachedStorage) Clear() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.epoch++
+	for id := range cs.entries {
+		cs.loads.Forget(strconv.Itoa(id))
+	}
+	cs.entries = make(map[int]*list.Element)
+	cs.lru.Init()
+}
+
+// Stats returns the statistics of the cache.
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mu.Lock()
+	entries := cs.lru.Len()
+	cs.mu.Unlock()
+	return CacheStats{
+		Hits:      cs.hits.Load(),
+		Misses:    cs.misses.Load(),
+		Evictions: cs.evictions.Load(),
+		Entries:   entries,
+		Capacity:  cs.size,
+	}
+}
+
+// Warm fills the cache with up to size books of the decorated storage and marks it as warm, see CheckWarm.
+func (cs *CachedStorage) Warm(ctx context.Context) error {
+	cs.mu.Lock()
+	epoch := cs.epoch
+	cs.mu.Unlock()
+	books, err := cs.Storage.GetAll(ctx)
+	if err != nil {
+		return fmt.Errorf("warming up cache: %w", err)
+	}
+	cs.mu.Lock()
+	// books which have been read before an invalidation may be outdated already, they are cached once they are read again
+	if cs.epoch == epoch {
+		for i := 0; i < len(books) && i < cs.size; i++ {
+			cs.add(&books[i])
+		}
+	}
+	cs.mu.Unlock()
+	cs.warm.Store(true)
+	return nil
+}
+
+// CheckWarm fails until the cache has been warmed up, see Warm.
+func (cs *CachedStorage) CheckWarm(ctx context.Context) error {
+	if !cs.warm.Load() {
+		return errors.New("cache is warming up")
+	}
+	return nil
+}
+
+// RunInvalidation invalidates every book for which the decorated storage publishes a change event, until the context is done.
+// If the subscription ends because events may have been missed, the whole cache is cleared before subscribing again.
+// Failures are passed to report.
+func (cs *CachedStorage) RunInvalidation(ctx context.Context, report func(error)) {
+	for {
+		sub, err := cs.Storage.Subscribe(LiveEvents)
+		if err != nil {
+			report(err)
+			return
+		}
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+				return
+			case event, ok := <-sub.Events:
+				if ok {
+					cs.Invalidate(event.BookID)
+				}
+				open = ok
+			}
+		}
+		cs.Clear()
+	}
+}
+
+// Update updates the book in the decorated storage and invalidates it.
+func (cs *CachedStorage) Update(ctx context.Context, b *data.Book) (*data.Book, error) {
+	defer cs.Invalidate(b.ID)
+	return cs.Storage.Update(ctx, b)
+}
+
+// Delete deletes the book from the decorated storage and invalidates it.
+func (cs *CachedStorage) Delete(ctx context.Context, id int) error {
+	defer cs.Invalidate(id)
+	return cs.Storage.Delete(ctx, id)
+}
+
+// Revert reverts the book in the decorated storage and invalidates it.
+func (cs *CachedStorage) Revert(ctx context.Context, bookID int, version int, expected int) (*data.Book, error) {
+	defer cs.Invalidate(bookID)
+	return cs.Storage.Revert(ctx, bookID, version, expected)
+}
+
+// CreateReview stores the review in the decorated storage and invalidates its book, whose rating changes.
+func (cs *CachedStorage) CreateReview(ctx context.Context, r *data.Review) (*data.Review, error) {
+	defer cs.Invalidate(r.BookID)
+	return cs.Storage.CreateReview(ctx, r)
+}
+
+// DeleteReview deletes the review from the decorated storage and invalidates its book, whose rating changes.
+func (cs *CachedStorage) DeleteReview(ctx context.Context, bookID int, reviewID int) error {
+	defer cs.Invalidate(bookID)
+	return cs.Storage.DeleteReview(ctx, bookID, reviewID)
+}
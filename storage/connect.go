@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/utilities"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DBConfig configures the connection to a PostgreSQL database, see OpenDB.
+type DBConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	// Tracer traces every SQL statement, and statements which take at least SlowQuery are logged, see NewTracedConnector.
+	Tracer    trace.TracerProvider
+	SlowQuery time.Duration
+	// Retry configures how the database is waited for, see WaitForDB.
+	Retry RetryConfig
+}
+
+// ConnectionString returns the URL of the database. A listener needs it to open its own connection, see RunListener.
+func (config DBConfig) ConnectionString() string {
+	return fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable", config.User, config.Password, config.Host, config.Port, config.Name)
+}
+
+// RetryConfig configures how often and how fast a database which can not be reached is tried again. Zero values are replaced by the defaults noted next to them.
+type RetryConfig struct {
+	// MaxAttempts is the number of failed attempts after which the database is given up on. 0 tries forever.
+	MaxAttempts int
+	// BaseDelay is the delay before the second attempt, it doubles with every further failure. 500 milliseconds by default.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts, 30 seconds by default.
+	MaxDelay time.Duration
+	// Timeout limits every single attempt, 5 seconds by default.
+	Timeout time.Duration
+}
+
+// withDefaults returns the config with its zero values replaced by the defaults.
+func (config RetryConfig) withDefaults() RetryConfig {
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 500 * time.Millisecond
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = 30 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	return config
+}
+
+// ConnectError is returned when a database could not be reached. It wraps the error of the last attempt.
+// The password is left out, so the error can be logged.
+type ConnectError struct {
+	Host     string
+	Port     int
+	Name     string
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connecting to postgres database %v at %v:%v failed after %v attempts: %v", e.Name, e.Host, e.Port, e.Attempts, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// NewDB returns a pool of connections to the configured database without connecting to it yet, so it only fails if the configuration is invalid.
+// Connections are opened as they are needed, so the pool recovers on its own once the database can be reached. See WaitForDB.
+func NewDB(config DBConfig) (*sql.DB, error) {
+	connector, err := pq.NewConnector(config.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("configuring postgres database %v at %v:%v: %w", config.Name, config.Host, config.Port, err)
+	}
+	tracer := config.Tracer
+	if tracer == nil {
+		tracer = trace.NewNoopTracerProvider()
+	}
+	return sql.OpenDB(NewTracedConnector(connector, tracer, config.SlowQuery)), nil
+}
+
+// OpenDB returns a pool of connections to the configured database once it can be reached. The database is tried again with
+// exponential backoff as configured, so the server may start before it. If it can not be reached, the error is a ConnectError.
+func OpenDB(ctx context.Context, config DBConfig) (*sql.DB, error) {
+	db, err := NewDB(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := WaitForDB(ctx, db, config); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// WaitForDB pings the configured database until it answers, it has failed the configured number of attempts or the context is done.
+// Between attempts, it waits with exponential backoff and jitter. Every failed attempt is logged, and the error of the last one is
+// returned wrapped in a ConnectError.
+func WaitForDB(ctx context.Context, db *sql.DB, config DBConfig) error {
+	retry := config.Retry.withDefaults()
+	for attempts := 1; ; attempts++ {
+		pingCtx, cancel := context.WithTimeout(ctx, retry.Timeout)
+		err := db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			if attempts > 1 {
+				LoggerFrom(ctx).Info("connected to postgres", "host", config.Host, "port", config.Port, "attempts", attempts)
+			}
+			return nil
+		}
+		connectErr := &ConnectError{Host: config.Host, Port: config.Port, Name: config.Name, Attempts: attempts, Err: err}
+		if retry.MaxAttempts > 0 && attempts >= retry.MaxAttempts {
+			return connectErr
+		}
+		delay := utilities.Backoff(retry.BaseDelay, retry.MaxDelay, attempts)
+		LoggerFrom(ctx).Warn("postgres is not reachable yet", "host", config.Host, "port", config.Port, "attempts", attempts, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			connectErr.Err = fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+			return connectErr
+		case <-time.After(delay):
+		}
+	}
+}
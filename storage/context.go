@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+)
+
+// contextKey is the type of the keys under which the storage reads request metadata from a context.
+type contextKey int
+
+const (
+	actorKey contextKey = iota
+	requestIDKey
+	loggerKey
+)
+
+// WithActor returns a context which names the actor on whose behalf the storage is changed. It is recorded in the audit log.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// ActorFrom returns the actor of the context, or an empty string if there is none.
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey).(string)
+	return actor
+}
+
+// WithRequestID returns a context which carries the ID of the request on whose behalf the storage is used. It is recorded in the audit log.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFrom returns the request ID of the context, or an empty string if there is none.
+func RequestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithLogger returns a context which carries the logger of the request on whose behalf the storage is used, so the logs of the storage
+// can be correlated with the request.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// LoggerFrom returns the logger of the context, or the default logger if there is none.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
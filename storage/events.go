@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrEventsLost is returned when a subscription should resume after an event which is not in the replay buffer anymore,
+// or which has never been published by this process. Clients have to read the current state again and subscribe without resuming.
+var ErrEventsLost = errors.New("events are no longer available")
+
+// LiveEvents can be passed to Subscribe to only receive events published from now on.
+const LiveEvents int64 = -1
+
+const (
+	// eventReplaySize is the number of events which are kept to replay them to resuming subscribers.
+	eventReplaySize = 1024
+	// subscriptionBufferSize is the number of events which may be queued for a subscriber before it is considered too slow.
+	subscriptionBufferSize = 64
+)
+
+// EventStorage is implemented by every storage which publishes changes of books as events, see data.Event.
+// Events are published by Create, Update, Revert, Delete and Restore once the change has been made. PostgresqlStorage announces them
+// to all servers sharing the database instead, they are published when they are received, see RunListener.
+type EventStorage interface {
+	Subscribe(after int64) (*Subscription, error)
+}
+
+// EventBus distributes events to subscribers and keeps the latest events in a bounded buffer, so subscribers can resume.
+// Sequence numbers are assigned by the bus and start over with every process.
+type EventBus struct {
+	mu          sync.Mutex
+	sequence    int64
+	replay      []data.Event
+	capacity    int
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events of an EventBus. Events is closed when the subscription is closed or if the subscriber
+// fell too far behind, in which case it should resume after the last event it has received.
+type Subscription struct {
+	Events <-chan data.Event
+	events chan data.Event
+	bus    *EventBus
+}
+
+// NewEventBus returns an EventBus which keeps the given number of events for replay.
+func NewEventBus(capacity int) *EventBus {
+	return &EventBus{
+		replay:      make([]data.Event, 0, capacity),
+		capacity:    capacity,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// publish hands an event about the given book to all subscribers, see Publish.
+func (eb *EventBus) publish(eventType string, bookID int, book *data.Book) {
+	event := data.Event{
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		BookID: bookID,
+	}
+	if book != nil {
+		b := *book
+		event.Book = &b
+	}
+	_ = eb.Publish(event)
+}
+
+// Publish assigns the next sequence number to the event and hands it to all subscribers. It implements OutboxSink and never fails.
+// Subscribers whose buffer is full are dropped instead of blocking the change which published the event.
+func (eb *EventBus) Publish(event data.Event) error {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.sequence++
+	event.Sequence = eb.sequence
+	if len(eb.replay) == eb.capacity {
+		eb.replay = append(eb.replay[:0], eb.replay[1:]...)
+	}
+	eb.replay = append(eb.replay, event)
+	for sub := range eb.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			delete(eb.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a subscription which first replays all buffered events after the given sequence number and then receives new events.
+// Pass LiveEvents to skip the replay. If events after the given sequence number have been lost, ErrEventsLost is returned.
+func (eb *EventBus) Subscribe(after int64) (*Subscription, error) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if after == LiveEvents {
+		after = eb.sequence
+	}
+	oldest := eb.sequence - int64(len(eb.replay)) + 1
+	if after < 0 || after > eb.sequence || after+1 < oldest {
+		return nil, ErrEventsLost
+	}
+	missed := eb.replay[len(eb.replay)-int(eb.sequence-after):]
+	events := make(chan data.Event, len(missed)+subscriptionBufferSize)
+	for _, event := range missed {
+		events <- event
+	}
+	sub := &Subscription{Events: events, events: events, bus: eb}
+	eb.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+// reset drops all subscribers and the replay buffer after events may have been missed. A sequence number is skipped,
+// so subscribers can not resume across the gap and get ErrEventsLost instead.
+func (eb *EventBus) reset() {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.sequence++
+	eb.replay = eb.replay[:0]
+	for sub := range eb.subscribers {
+		delete(eb.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Close ends the subscription and closes its channel. It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Subscribe subscribes to the changes of books, see EventBus.Subscribe.
+func (ims *InMemoryStorage) Subscribe(after int64) (*Subscription, error) {
+	return ims.events.Subscribe(after)
+}
+
+// Subscribe subscribes to the changes of books which are made through any server sharing the database, see RunListener and EventBus.Subscribe.
+func (psql *PostgresqlStorage) Subscribe(after int64) (*Subscription, error) {
+	return psql.events.Subscribe(after)
+}
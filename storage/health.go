@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// schemaTables are the tables which hack/sql/create_tables.sql creates and the PostgresqlStorage relies on.
+var schemaTables = []string{
+	"books", "reviews", "inventory", "reservations", "stock_ledger", "orders", "order_lines", "copies", "loans", "holds",
+	"users", "list_entries", "api_keys", "audit_events", "book_versions", "webhooks", "webhook_deliveries", "outbox",
+}
+
+// Ping checks that the database can be reached.
+func (psql *PostgresqlStorage) Ping(ctx context.Context) error {
+	return psql.databaseConnection.PingContext(ctx)
+}
+
+// CheckSchema checks that the schema of the database has been created, i.e. that all tables of the storage exist.
+// The error names the missing tables.
+func (psql *PostgresqlStorage) CheckSchema(ctx context.Context) error {
+	query := `
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = ANY($1)
+	`
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, pq.Array(schemaTables))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		existing[table] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var missing []string
+	for _, table := range schemaTables {
+		if !existing[table] {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// OperationObserver is told about every operation of an InstrumentedStorage: its name, e.g. "Get", how long it took and its error, if any.
+type OperationObserver func(operation string, duration time.Duration, err error)
+
+// InstrumentedStorage decorates any Storage and passes the latency and outcome of every operation to an observer, e.g. to export metrics.
+// Subscriptions are long-lived and therefore not observed.
+type InstrumentedStorage struct {
+	Storage
+	observer OperationObserver
+}
+
+// NewInstrumentedStorage returns an InstrumentedStorage which observes the operations of the given storage.
+func NewInstrumentedStorage(store Storage, observer OperationObserver) *InstrumentedStorage {
+	return &InstrumentedStorage{Storage: store, observer: observer}
+}
+
+// record passes an operation which started at the given time to the observer.
+func (is *InstrumentedStorage) record(operation string, start time.Time, err error) {
+	is.observer(operation, time.Since(start), err)
+}
+
+// observe runs an operation which only returns an error and records it.
+func (is *InstrumentedStorage) observe(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	is.record(operation, start, err)
+	return err
+}
+
+// observe runs an operation which returns a result and an error and records it.
+func observe[T any](is *InstrumentedStorage, operation string, fn func() (T, error)) (T, error) {
+	start := time.Now()
+	result, err := fn()
+	is.record(operation, start, err)
+	return result, err
+}
+
+// Create instruments Storage.Create.
+func (is *InstrumentedStorage) Create(ctx context.Context, b *data.Book) (*data.Book, error) {
+	return observe(is, "Create", func() (*data.Book, error) { return is.Storage.Create(ctx, b) })
+}
+
+// Get instruments Storage.Get.
+func (is *InstrumentedStorage) Get(ctx context.Context, id int) (*data.Book, error) {
+	return observe(is, "Get", func() (*data.Book, error) { return is.Storage.Get(ctx, id) })
+}
+
+// GetAll instruments Storage.GetAll.
+func (is *InstrumentedStorage) GetAll(ctx context.Context) ([]data.Book, error) {
+	return observe(is, "GetAll", func() ([]data.Book, error) { return is.Storage.GetAll(ctx) })
+}
+
+// Update instruments Storage.Update.
+func (is *InstrumentedStorage) Update(ctx context.Context, b *data.Book) (*data.Book, error) {
+	return observe(is, "Update", func() (*data.Book, error) { return is.Storage.Update(ctx, b) })
+}
+
+// Delete instruments Storage.Delete.
+func (is *InstrumentedStorage) Delete(ctx context.Context, id int) error {
+	return is.observe("Delete", func() error { return is.Storage.Delete(ctx, id) })
+}
+
+// CreateAPIKey instruments Storage.CreateAPIKey.
+func (is *InstrumentedStorage) CreateAPIKey(ctx context.Context, key *data.APIKey, hash string) (*data.APIKey, error) {
+	return observe(is, "CreateAPIKey", func() (*data.APIKey, error) { return is.Storage.CreateAPIKey(ctx, key, hash) })
+}
+
+// GetAPIKeyByHash instruments Storage.GetAPIKeyByHash.
+func (is *InstrumentedStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*data.APIKey, error) {
+	return observe(is, "GetAPIKeyByHash", func() (*data.APIKey, error) { return is.Storage.GetAPIKeyByHash(ctx, hash) })
+}
+
+// ListAPIKeys instruments Storage.ListAPIKeys.
+func (is *InstrumentedStorage) ListAPIKeys(ctx context.Context) ([]data.APIKey, error) {
+	return observe(is, "ListAPIKeys", func() ([]data.APIKey, error) { return is.Storage.ListAPIKeys(ctx) })
+}
+
+// RotateAPIKey instruments Storage.RotateAPIKey.
+func (is *InstrumentedStorage) RotateAPIKey(ctx context.Context, id int, prefix string, hash string) (*data.APIKey, error) {
+	return observe(is, "RotateAPIKey", func() (*data.APIKey, error) { return is.Storage.RotateAPIKey(ctx, id, prefix, hash) })
+}
+
+// RevokeAPIKey instruments Storage.RevokeAPIKey.
+func (is *InstrumentedStorage) RevokeAPIKey(ctx context.Context, id int) (*data.APIKey, error) {
+	return observe(is, "RevokeAPIKey", func() (*data.APIKey, error) { return is.Storage.RevokeAPIKey(ctx, id) })
+}
+
+// AuditEvents instruments Storage.AuditEvents.
+func (is *InstrumentedStorage) AuditEvents(ctx context.Context, filter data.AuditFilter) (*data.AuditPage, error) {
+	return observe(is, "AuditEvents", func() (*data.AuditPage, error) { return is.Storage.AuditEvents(ctx, filter) })
+}
+
+// GetStock instruments Storage.GetStock.
+func (is *InstrumentedStorage) GetStock(ctx context.Context, bookID int) (*data.StockLevel, error) {
+	return observe(is, "GetStock", func() (*data.StockLevel, error) { return is.Storage.GetStock(ctx, bookID) })
+}
+
+// AdjustStock instruments Storage.AdjustStock.
+func (is *InstrumentedStorage) AdjustStock(ctx context.Context, bookID int, delta int) (*data.StockLevel, error) {
+	return observe(is, "AdjustStock", func() (*data.StockLevel, error) { return is.Storage.AdjustStock(ctx, bookID, delta) })
+}
+
+// SetLowStockThreshold instruments Storage.SetLowStockThreshold.
+func (is *InstrumentedStorage) SetLowStockThreshold(ctx context.Context, bookID int, threshold int) (*data.StockLevel, error) {
+	return observe(is, "SetLowStockThreshold", func() (*data.StockLevel, error) { return is.Storage.SetLowStockThreshold(ctx, bookID, threshold) })
+}
+
+// LowStock instruments Storage.LowStock.
+func (is *InstrumentedStorage) LowStock(ctx context.Context) ([]data.StockLevel, error) {
+	return observe(is, "LowStock", func() ([]data.StockLevel, error) { return is.Storage.LowStock(ctx) })
+}
+
+// Reserve instruments Storage.Reserve.
+func (is *InstrumentedStorage) Reserve(ctx context.Context, bookID int, quantity int, ttl time.Duration) (*data.Reservation, error) {
+	return observe(is, "Reserve", func() (*data.Reservation, error) { return is.Storage.Reserve(ctx, bookID, quantity, ttl) })
+}
+
+// ReleaseReservation instruments Storage.ReleaseReservation.
+func (is *InstrumentedStorage) ReleaseReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return observe(is, "ReleaseReservation", func() (*data.Reservation, error) { return is.Storage.ReleaseReservation(ctx, id) })
+}
+
+// FulfilReservation instruments Storage.FulfilReservation.
+func (is *InstrumentedStorage) FulfilReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return observe(is, "FulfilReservation", func() (*data.Reservation, error) { return is.Storage.FulfilReservation(ctx, id) })
+}
+
+// GetStockLedger instruments Storage.GetStockLedger.
+func (is *InstrumentedStorage) GetStockLedger(ctx context.Context, bookID int) ([]data.StockMovement, error) {
+	return observe(is, "GetStockLedger", func() ([]data.StockMovement, error) { return is.Storage.GetStockLedger(ctx, bookID) })
+}
+
+// AddCopies instruments Storage.AddCopies.
+func (is *InstrumentedStorage) AddCopies(ctx context.Context, bookID int, count int) ([]data.Copy, error) {
+	return observe(is, "AddCopies", func() ([]data.Copy, error) { return is.Storage.AddCopies(ctx, bookID, count) })
+}
+
+// ListCopies instruments Storage.ListCopies.
+func (is *InstrumentedStorage) ListCopies(ctx context.Context, bookID int) ([]data.Copy, error) {
+	return observe(is, "ListCopies", func() ([]data.Copy, error) { return is.Storage.ListCopies(ctx, bookID) })
+}
+
+// CheckOut instruments Storage.CheckOut.
+func (is *InstrumentedStorage) CheckOut(ctx context.Context, bookID int, borrower string, period time.Duration) (*data.Loan, error) {
+	return observe(is, "CheckOut", func() (*data.Loan, error) { return is.Storage.CheckOut(ctx, bookID, borrower, period) })
+}
+
+// ReturnLoan instruments Storage.ReturnLoan.
+func (is *InstrumentedStorage) ReturnLoan(ctx context.Context, loanID int) (*data.Loan, error) {
+	return observe(is, "ReturnLoan", func() (*data.Loan, error) { return is.Storage.ReturnLoan(ctx, loanID) })
+}
+
+// RenewLoan instruments Storage.RenewLoan.
+func (is *InstrumentedStorage) RenewLoan(ctx context.Context, loanID int, period time.Duration, maxRenewals int) (*data.Loan, error) {
+	return observe(is, "RenewLoan", func() (*data.Loan, error) { return is.Storage.RenewLoan(ctx, loanID, period, maxRenewals) })
+}
+
+// PlaceHold instruments Storage.PlaceHold.
+func (is *InstrumentedStorage) PlaceHold(ctx context.Context, bookID int, borrower string) (*data.Hold, error) {
+	return observe(is, "PlaceHold", func() (*data.Hold, error) { return is.Storage.PlaceHold(ctx, bookID, borrower) })
+}
+
+// ListHolds instruments Storage.ListHolds.
+func (is *InstrumentedStorage) ListHolds(ctx context.Context, bookID int) ([]data.Hold, error) {
+	return observe(is, "ListHolds", func() ([]data.Hold, error) { return is.Storage.ListHolds(ctx, bookID) })
+}
+
+// OverdueLoans instruments Storage.OverdueLoans.
+func (is *InstrumentedStorage) OverdueLoans(ctx context.Context, now time.Time) ([]data.Loan, error) {
+	return observe(is, "OverdueLoans", func() ([]data.Loan, error) { return is.Storage.OverdueLoans(ctx, now) })
+}
+
+// CreateOrder instruments Storage.CreateOrder.
+func (is *InstrumentedStorage) CreateOrder(ctx context.Context, o *data.Order) (*data.Order, error) {
+	return observe(is, "CreateOrder", func() (*data.Order, error) { return is.Storage.CreateOrder(ctx, o) })
+}
+
+// GetOrder instruments Storage.GetOrder.
+func (is *InstrumentedStorage) GetOrder(ctx context.Context, id int) (*data.Order, error) {
+	return observe(is, "GetOrder", func() (*data.Order, error) { return is.Storage.GetOrder(ctx, id) })
+}
+
+// UpdateOrderStatus instruments Storage.UpdateOrderStatus.
+func (is *InstrumentedStorage) UpdateOrderStatus(ctx context.Context, id int, status string) (*data.Order, error) {
+	return observe(is, "UpdateOrderStatus", func() (*data.Order, error) { return is.Storage.UpdateOrderStatus(ctx, id, status) })
+}
+
+// ListOrders instruments Storage.ListOrders.
+func (is *InstrumentedStorage) ListOrders(ctx context.Context, customerID string) ([]data.Order, error) {
+	return observe(is, "ListOrders", func() ([]data.Order, error) { return is.Storage.ListOrders(ctx, customerID) })
+}
+
+// CreateReview instruments Storage.CreateReview.
+func (is *InstrumentedStorage) CreateReview(ctx context.Context, r *data.Review) (*data.Review, error) {
+	return observe(is, "CreateReview", func() (*data.Review, error) { return is.Storage.CreateReview(ctx, r) })
+}
+
+// GetReviews instruments Storage.GetReviews.
+func (is *InstrumentedStorage) GetReviews(ctx context.Context, bookID int, page int, size int) (*data.ReviewPage, error) {
+	return observe(is, "GetReviews", func() (*data.ReviewPage, error) { return is.Storage.GetReviews(ctx, bookID, page, size) })
+}
+
+// DeleteReview instruments Storage.DeleteReview.
+func (is *InstrumentedStorage) DeleteReview(ctx context.Context, bookID int, reviewID int) error {
+	return is.observe("DeleteReview", func() error { return is.Storage.DeleteReview(ctx, bookID, reviewID) })
+}
+
+// Search instruments Storage.Search.
+func (is *InstrumentedStorage) Search(ctx context.Context, query string) ([]data.SearchResult, error) {
+	return observe(is, "Search", func() ([]data.SearchResult, error) { return is.Storage.Search(ctx, query) })
+}
+
+// Suggest instruments Storage.Suggest.
+func (is *InstrumentedStorage) Suggest(ctx context.Context, prefix string, limit int) ([]data.Suggestion, error) {
+	return observe(is, "Suggest", func() ([]data.Suggestion, error) { return is.Storage.Suggest(ctx, prefix, limit) })
+}
+
+// RecordView instruments Storage.RecordView.
+func (is *InstrumentedStorage) RecordView(ctx context.Context, id int) error {
+	return is.observe("RecordView", func() error { return is.Storage.RecordView(ctx, id) })
+}
+
+// Trash instruments Storage.Trash.
+func (is *InstrumentedStorage) Trash(ctx context.Context) ([]data.Book, error) {
+	return observe(is, "Trash", func() ([]data.Book, error) { return is.Storage.Trash(ctx) })
+}
+
+// Restore instruments Storage.Restore.
+func (is *InstrumentedStorage) Restore(ctx context.Context, id int) (*data.Book, error) {
+	return observe(is, "Restore", func() (*data.Book, error) { return is.Storage.Restore(ctx, id) })
+}
+
+// Purge instruments Storage.Purge.
+func (is *InstrumentedStorage) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	return observe(is, "Purge", func() (int, error) { return is.Storage.Purge(ctx, deletedBefore) })
+}
+
+// CreateUser instruments Storage.CreateUser.
+func (is *InstrumentedStorage) CreateUser(ctx context.Context, u *data.User) (*data.User, error) {
+	return observe(is, "CreateUser", func() (*data.User, error) { return is.Storage.CreateUser(ctx, u) })
+}
+
+// GetUser instruments Storage.GetUser.
+func (is *InstrumentedStorage) GetUser(ctx context.Context, id int) (*data.User, error) {
+	return observe(is, "GetUser", func() (*data.User, error) { return is.Storage.GetUser(ctx, id) })
+}
+
+// GetReadingList instruments Storage.GetReadingList.
+func (is *InstrumentedStorage) GetReadingList(ctx context.Context, userID int, name string) (*data.ReadingList, error) {
+	return observe(is, "GetReadingList", func() (*data.ReadingList, error) { return is.Storage.GetReadingList(ctx, userID, name) })
+}
+
+// AddListEntry instruments Storage.AddListEntry.
+func (is *InstrumentedStorage) AddListEntry(ctx context.Context, userID int, name string, entry data.ListEntry) (*data.ReadingList, error) {
+	return observe(is, "AddListEntry", func() (*data.ReadingList, error) { return is.Storage.AddListEntry(ctx, userID, name, entry) })
+}
+
+// RemoveListEntry instruments Storage.RemoveListEntry.
+func (is *InstrumentedStorage) RemoveListEntry(ctx context.Context, userID int, name string, bookID int) (*data.ReadingList, error) {
+	return observe(is, "RemoveListEntry", func() (*data.ReadingList, error) { return is.Storage.RemoveListEntry(ctx, userID, name, bookID) })
+}
+
+// ReorderList instruments Storage.ReorderList.
+func (is *InstrumentedStorage) ReorderList(ctx context.Context, userID int, name string, bookIDs []int) (*data.ReadingList, error) {
+	return observe(is, "ReorderList", func() (*data.ReadingList, error) { return is.Storage.ReorderList(ctx, userID, name, bookIDs) })
+}
+
+// SetListProgress instruments Storage.SetListProgress.
+func (is *InstrumentedStorage) SetListProgress(ctx context.Context, userID int, name string, bookID int, progress int) (*data.ReadingList, error) {
+	return observe(is, "SetListProgress", func() (*data.ReadingList, error) {
+		return is.Storage.SetListProgress(ctx, userID, name, bookID, progress)
+	})
+}
+
+// Versions instruments Storage.Versions.
+func (is *InstrumentedStorage) Versions(ctx context.Context, bookID int, page int, size int) (*data.BookVersionPage, error) {
+	return observe(is, "Versions", func() (*data.BookVersionPage, error) { return is.Storage.Versions(ctx, bookID, page, size) })
+}
+
+// Version instruments Storage.Version.
+func (is *InstrumentedStorage) Version(ctx context.Context, bookID int, version int) (*data.BookVersion, error) {
+	return observe(is, "Version", func() (*data.BookVersion, error) { return is.Storage.Version(ctx, bookID, version) })
+}
+
+// GetAsOf instruments Storage.GetAsOf.
+func (is *InstrumentedStorage) GetAsOf(ctx context.Context, bookID int, at time.Time) (*data.Book, error) {
+	return observe(is, "GetAsOf", func() (*data.Book, error) { return is.Storage.GetAsOf(ctx, bookID, at) })
+}
+
+// Revert instruments Storage.Revert.
+func (is *InstrumentedStorage) Revert(ctx context.Context, bookID int, version int, expected int) (*data.Book, error) {
+	return observe(is, "Revert", func() (*data.Book, error) { return is.Storage.Revert(ctx, bookID, version, expected) })
+}
+
+// CreateWebhook instruments Storage.CreateWebhook.
+func (is *InstrumentedStorage) CreateWebhook(ctx context.Context, hook *data.Webhook) (*data.Webhook, error) {
+	return observe(is, "CreateWebhook", func() (*data.Webhook, error) { return is.Storage.CreateWebhook(ctx, hook) })
+}
+
+// GetWebhook instruments Storage.GetWebhook.
+func (is *InstrumentedStorage) GetWebhook(ctx context.Context, id int) (*data.Webhook, error) {
+	return observe(is, "GetWebhook", func() (*data.Webhook, error) { return is.Storage.GetWebhook(ctx, id) })
+}
+
+// ListWebhooks instruments Storage.ListWebhooks.
+func (is *InstrumentedStorage) ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	return observe(is, "ListWebhooks", func() ([]data.Webhook, error) { return is.Storage.ListWebhooks(ctx) })
+}
+
+// DeleteWebhook instruments Storage.DeleteWebhook.
+func (is *InstrumentedStorage) DeleteWebhook(ctx context.Context, id int) error {
+	return is.observe("DeleteWebhook", func() error { return is.Storage.DeleteWebhook(ctx, id) })
+}
+
+// CreateDelivery instruments Storage.CreateDelivery.
+func (is *InstrumentedStorage) CreateDelivery(ctx context.Context, delivery *data.WebhookDelivery) (*data.WebhookDelivery, error) {
+	return observe(is, "CreateDelivery", func() (*data.WebhookDelivery, error) { return is.Storage.CreateDelivery(ctx, delivery) })
+}
+
+// ClaimDeliveries instruments Storage.ClaimDeliveries.
+func (is *InstrumentedStorage) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]data.WebhookDelivery, error) {
+	return observe(is, "ClaimDeliveries", func() ([]data.WebhookDelivery, error) { return is.Storage.ClaimDeliveries(ctx, now, lease, limit) })
+}
+
+// UpdateDelivery instruments Storage.UpdateDelivery.
+func (is *InstrumentedStorage) UpdateDelivery(ctx context.Context, delivery *data.WebhookDelivery) error {
+	return is.observe("UpdateDelivery", func() error { return is.Storage.UpdateDelivery(ctx, delivery) })
+}
+
+// Deliveries instruments Storage.Deliveries.
+func (is *InstrumentedStorage) Deliveries(ctx context.Context, webhookID int, page int, size int) (*data.WebhookDeliveryPage, error) {
+	return observe(is, "Deliveries", func() (*data.WebhookDeliveryPage, error) { return is.Storage.Deliveries(ctx, webhookID, page, size) })
+}
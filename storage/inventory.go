@@ -0,0 +1,588 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrInsufficientStock is returned if a decrement or reservation would let the available stock of a book drop below zero.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ErrReservationNotActive is returned if a reservation is released or fulfilled which has already been released, fulfilled or has expired.
+var ErrReservationNotActive = errors.New("reservation is not active")
+
+// InventoryStorage is implemented by every storage which tracks stock levels of books.
+// Every change of the stock is recorded in an append-only ledger. Stock can never drop below zero,
+// and reserved copies can neither be decremented nor reserved a second time.
+type InventoryStorage interface {
+	GetStock(ctx context.Context, bookID int) (*data.StockLevel, error)
+	AdjustStock(ctx context.Context, bookID int, delta int) (*data.StockLevel, error)
+	SetLowStockThreshold(ctx context.Context, bookID int, threshold int) (*data.StockLevel, error)
+	LowStock(ctx context.Context) ([]data.StockLevel, error)
+	Reserve(ctx context.Context, bookID int, quantity int, ttl time.Duration) (*data.Reservation, error)
+	ReleaseReservation(ctx context.Context, id int) (*data.Reservation, error)
+	FulfilReservation(ctx context.Context, id int) (*data.Reservation, error)
+	GetStockLedger(ctx context.Context, bookID int) ([]data.StockMovement, error)
+}
+
+// stockRecord is the inventory of a single book in the InMemoryStorage.
+type stockRecord struct {
+	quantity  int
+	threshold int
+}
+
+// adjustmentReason returns the ledger reason for a stock adjustment.
+func adjustmentReason(delta int) string {
+	if delta < 0 {
+		return data.StockDecrement
+	}
+	return data.StockIncrement
+}
+
+// stock returns the inventory record of a book and creates an empty one if the book has no inventory yet.
+// The caller must hold the lock.
+func (ims *InMemoryStorage) stock(bookID int) (*stockRecord, error) {
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	record, ok := ims.inventory[bookID]
+	if !ok {
+		record = &stockRecord{}
+		ims.inventory[bookID] = record
+	}
+	return record, nil
+}
+
+// reserved sums up the quantity of all active reservations of a book which have not expired yet. The caller must hold the lock.
+func (ims *InMemoryStorage) reserved(bookID int, now time.Time) int {
+	reserved := 0
+	for _, reservation := range ims.reservations {
+		if reservation.BookID == bookID && reservation.Status == data.ReservationActive && reservation.ExpiresAt.After(now) {
+			reserved += reservation.Quantity
+		}
+	}
+	return reserved
+}
+
+// stockLevel returns the current stock level of a book. The caller must hold the lock.
+func (ims *InMemoryStorage) stockLevel(bookID int, record *stockRecord) *data.StockLevel {
+	return data.NewStockLevel(bookID, record.quantity, ims.reserved(bookID, time.Now()), record.threshold)
+}
+
+// expireReservations marks all active reservations of a book which ran out of time as expired and records that in the ledger.
+// The caller must hold the write lock.
+func (ims *InMemoryStorage) expireReservations(bookID int, record *stockRecord, now time.Time) {
+	for _, reservation := range ims.reservations {
+		if reservation.BookID == bookID && reservation.Status == data.ReservationActive && !reservation.ExpiresAt.After(now) {
+			reservation.Status = data.ReservationExpired
+			ims.appendLedger(bookID, data.StockExpire, 0, -reservation.Quantity, record.quantity, &reservation.ID)
+		}
+	}
+}
+
+// appendLedger records a stock movement. The caller must hold the write lock.
+func (ims *InMemoryStorage) appendLedger(bookID int, reason string, delta int, reservedDelta int, quantityAfter int, reservationID *int) {
+	ims.ledgerSerial++
+	movement := data.StockMovement{
+		ID:            ims.ledgerSerial,
+		BookID:        bookID,
+		Reason:        reason,
+		Delta:         delta,
+		ReservedDelta: reservedDelta,
+		QuantityAfter: quantityAfter,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if reservationID != nil {
+		id := *reservationID
+		movement.ReservationID = &id
+	}
+	ims.ledger = append(ims.ledger, movement)
+}
+
+// GetStock returns the stock level of a book. Books without any inventory have a stock of zero.
+func (ims *InMemoryStorage) GetStock(ctx context.Context, bookID int) (*data.StockLevel, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, err := ims.stock(bookID)
+	if err != nil {
+		return nil, err
+	}
+	return ims.stockLevel(bookID, record), nil
+}
+
+// AdjustStock increments (positive delta) or decrements (negative delta) the quantity on hand of a book.
+// Decrements which would exceed the available, unreserved stock are rejected with ErrInsufficientStock.
+func (ims *InMemoryStorage) AdjustStock(ctx context.Context, bookID int, delta int) (*data.StockLevel, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, err := ims.stock(bookID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ims.expireReservations(bookID, record, now)
+	if record.quantity+delta-ims.reserved(bookID, now) < 0 {
+		return nil, fmt.Errorf("%w: book id %v", ErrInsufficientStock, bookID)
+	}
+	record.quantity += delta
+	ims.appendLedger(bookID, adjustmentReason(delta), delta, 0, record.quantity, nil)
+	return ims.stockLevel(bookID, record), nil
+}
+
+// SetLowStockThreshold configures below which available quantity a book is reported as low on stock.
+func (ims *InMemoryStorage) SetLowStockThreshold(ctx context.Context, bookID int, threshold int) (*data.StockLevel, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, err := ims.stock(bookID)
+	if err != nil {
+		return nil, err
+	}
+	record.threshold = threshold
+	return ims.stockLevel(bookID, record), nil
+}
+
+// LowStock returns the stock levels of all books which are low on stock.
+func (ims *InMemoryStorage) LowStock(ctx context.Context) ([]data.StockLevel, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	levels := make([]data.StockLevel, 0)
+	for _, book := range ims.Database {
+		record, ok := ims.inventory[book.ID]
+		if !ok {
+			continue
+		}
+		if level := ims.stockLevel(book.ID, record); level.LowStock {
+			levels = append(levels, *level)
+		}
+	}
+	return levels, nil
+}
+
+// Reserve holds the given quantity of a book for the given duration. Only available, unreserved copies can be reserved.
+func (ims *InMemoryStorage) Reserve(ctx context.Context, bookID int, quantity int, ttl time.Duration) (*data.Reservation, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	record, err := ims.stock(bookID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ims.expireReservations(bookID, record, now)
+	if record.quantity-ims.reserved(bookID, now) < quantity {
+		return nil, fmt.Errorf("%w: book id %v", ErrInsufficientStock, bookID)
+	}
+	ims.reservationSerial++
+	reservation := &data.Reservation{
+		ID:        ims.reservationSerial,
+		BookID:    bookID,
+		Quantity:  quantity,
+		Status:    data.ReservationActive,
+		ExpiresAt: now.Add(ttl).UTC(),
+		CreatedAt: now.UTC(),
+	}
+	ims.reservations[reservation.ID] = reservation
+	ims.appendLedger(bookID, data.StockReserve, 0, quantity, record.quantity, &reservation.ID)
+	result := *reservation
+	return &result, nil
+}
+
+// finishReservation moves an active reservation into its final state. Fulfilled reservations also decrement the quantity on hand.
+func (ims *InMemoryStorage) finishReservation(id int, status string) (*data.Reservation, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	reservation, ok := ims.reservations[id]
+	if !ok {
+		return nil, fmt.Errorf("reservation id %v %w", id, ErrNotFound)
+	}
+	record, err := ims.stock(reservation.BookID)
+	if err != nil {
+		return nil, err
+	}
+	ims.expireReservations(reservation.BookID, record, time.Now())
+	if reservation.Status != data.ReservationActive {
+		return nil, fmt.Errorf("%w: reservation id %v is %v", ErrReservationNotActive, id, reservation.Status)
+	}
+	reservation.Status = status
+	if status == data.ReservationFulfilled {
+		record.quantity -= reservation.Quantity
+		ims.appendLedger(reservation.BookID, data.StockFulfil, -reservation.Quantity, -reservation.Quantity, record.quantity, &reservation.ID)
+	} else {
+		ims.appendLedger(reservation.BookID, data.StockRelease, 0, -reservation.Quantity, record.quantity, &reservation.ID)
+	}
+	result := *reservation
+	return &result, nil
+}
+
+// ReleaseReservation gives the reserved copies of an active reservation back to the available stock.
+func (ims *InMemoryStorage) ReleaseReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return ims.finishReservation(id, data.ReservationReleased)
+}
+
+// FulfilReservation turns an active reservation into an actual decrement of the quantity on hand.
+func (ims *InMemoryStorage) FulfilReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return ims.finishReservation(id, data.ReservationFulfilled)
+}
+
+// GetStockLedger returns all stock movements of a book, oldest first.
+func (ims *InMemoryStorage) GetStockLedger(ctx context.Context, bookID int) ([]data.StockMovement, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	movements := make([]data.StockMovement, 0)
+	for _, movement := range ims.ledger {
+		if movement.BookID == bookID {
+			movements = append(movements, movement)
+		}
+	}
+	return movements, nil
+}
+
+// lockStock locks the inventory row of a book for the rest of the transaction, creating it if the book has no inventory yet.
+// Expired reservations are marked as such, and the current quantity, threshold and reserved quantity are returned.
+func lockStock(ctx context.Context, tx *sql.Tx, bookID int) (int, int, int, error) {
+	createStock := `
+		INSERT INTO inventory(book_id)
+		SELECT id FROM books WHERE id = $1 AND deleted_at IS NULL
+		ON CONFLICT DO NOTHING
+	`
+	selectStock := `
+		SELECT i.quantity, i.low_stock_threshold
+		FROM inventory i
+		JOIN books b ON b.id = i.book_id
+		WHERE i.book_id = $1 AND b.deleted_at IS NULL
+		FOR UPDATE OF i
+	`
+	expireReservations := `
+		UPDATE reservations
+		SET status = 'expired'
+		WHERE book_id = $1 AND status = 'active' AND expires_at <= now()
+		RETURNING id, quantity
+	`
+	selectReserved := `
+		SELECT COALESCE(SUM(quantity), 0)
+		FROM reservations
+		WHERE book_id = $1 AND status = 'active'
+	`
+	var quantity, threshold, reserved int
+	if _, err := tx.ExecContext(ctx, createStock, bookID); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := tx.QueryRowContext(ctx, selectStock, bookID).Scan(&quantity, &threshold); err != nil {
+		return 0, 0, 0, err
+	}
+	rows, err := tx.QueryContext(ctx, expireReservations, bookID)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	expired := make(map[int]int)
+	for rows.Next() {
+		var id, reservedQuantity int
+		if err := rows.Scan(&id, &reservedQuantity); err != nil {
+			rows.Close()
+			return 0, 0, 0, err
+		}
+		expired[id] = reservedQuantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	for id, reservedQuantity := range expired {
+		id := id
+		if err := appendLedger(ctx, tx, bookID, data.StockExpire, 0, -reservedQuantity, quantity, &id); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if err := tx.QueryRowContext(ctx, selectReserved, bookID).Scan(&reserved); err != nil {
+		return 0, 0, 0, err
+	}
+	return quantity, threshold, reserved, nil
+}
+
+// appendLedger records a stock movement within the given transaction.
+func appendLedger(ctx context.Context, tx *sql.Tx, bookID int, reason string, delta int, reservedDelta int, quantityAfter int, reservationID *int) error {
+	query := `
+		INSERT INTO stock_ledger(book_id, reason, delta, reserved_delta, quantity_after, reservation_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := tx.ExecContext(ctx, query, bookID, reason, delta, reservedDelta, quantityAfter, reservationID)
+	return err
+}
+
+// GetStock returns the stock level of a book. Books without any inventory have a stock of zero.
+// Reservations which ran out of time are not counted, even if they have not been marked as expired yet.
+func (psql *PostgresqlStorage) GetStock(ctx context.Context, bookID int) (*data.StockLevel, error) {
+	query := `
+		SELECT b.id, COALESCE(i.quantity, 0), COALESCE(i.low_stock_threshold, 0), (
+			SELECT COALESCE(SUM(r.quantity), 0)
+			FROM reservations r
+			WHERE r.book_id = b.id AND r.status = 'active' AND r.expires_at > now()
+		)
+		FROM books b
+		LEFT JOIN inventory i ON i.book_id = b.id
+		WHERE b.id = $1 AND b.deleted_at IS NULL
+	`
+	var id, quantity, threshold, reserved int
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, query, bookID).Scan(&id, &quantity, &threshold, &reserved); err != nil {
+		return nil, err
+	}
+	return data.NewStockLevel(id, quantity, reserved, threshold), nil
+}
+
+// AdjustStock increments (positive delta) or decrements (negative delta) the quantity on hand of a book.
+// The inventory row is locked for the duration of the transaction, so concurrent adjustments are serialized
+// and the available stock can never drop below zero.
+func (psql *PostgresqlStorage) AdjustStock(ctx context.Context, bookID int, delta int) (*data.StockLevel, error) {
+	query := `
+		UPDATE inventory
+		SET quantity = quantity + $2
+		WHERE book_id = $1
+		RETURNING quantity
+	`
+	var level *data.StockLevel
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		quantity, threshold, reserved, err := lockStock(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if quantity+delta-reserved < 0 {
+			return fmt.Errorf("%w: book id %v", ErrInsufficientStock, bookID)
+		}
+		if err := tx.QueryRowContext(ctx, query, bookID, delta).Scan(&quantity); err != nil {
+			return err
+		}
+		if err := appendLedger(ctx, tx, bookID, adjustmentReason(delta), delta, 0, quantity, nil); err != nil {
+			return err
+		}
+		level = data.NewStockLevel(bookID, quantity, reserved, threshold)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return level, nil
+}
+
+// SetLowStockThreshold configures below which available quantity a book is reported as low on stock.
+func (psql *PostgresqlStorage) SetLowStockThreshold(ctx context.Context, bookID int, threshold int) (*data.StockLevel, error) {
+	query := `
+		UPDATE inventory
+		SET low_stock_threshold = $2
+		WHERE book_id = $1
+	`
+	var level *data.StockLevel
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		quantity, _, reserved, err := lockStock(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, bookID, threshold); err != nil {
+			return err
+		}
+		level = data.NewStockLevel(bookID, quantity, reserved, threshold)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return level, nil
+}
+
+// LowStock returns the stock levels of all books which are low on stock.
+func (psql *PostgresqlStorage) LowStock(ctx context.Context) ([]data.StockLevel, error) {
+	query := `
+		SELECT book_id, quantity, low_stock_threshold, reserved
+		FROM (
+			SELECT i.book_id, i.quantity, i.low_stock_threshold, (
+				SELECT COALESCE(SUM(r.quantity), 0)
+				FROM reservations r
+				WHERE r.book_id = i.book_id AND r.status = 'active' AND r.expires_at > now()
+			) AS reserved
+			FROM inventory i
+			JOIN books b ON b.id = i.book_id
+			WHERE i.low_stock_threshold > 0 AND b.deleted_at IS NULL
+		) levels
+		WHERE quantity - reserved <= low_stock_threshold
+		ORDER BY book_id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	levels := make([]data.StockLevel, 0)
+	for rows.Next() {
+		var bookID, quantity, threshold, reserved int
+		if err := rows.Scan(&bookID, &quantity, &threshold, &reserved); err != nil {
+			return nil, err
+		}
+		levels = append(levels, *data.NewStockLevel(bookID, quantity, reserved, threshold))
+	}
+	return levels, rows.Err()
+}
+
+// Reserve holds the given quantity of a book for the given duration. Only available, unreserved copies can be reserved.
+func (psql *PostgresqlStorage) Reserve(ctx context.Context, bookID int, quantity int, ttl time.Duration) (*data.Reservation, error) {
+	query := `
+		INSERT INTO reservations(book_id, quantity, status, expires_at)
+		VALUES ($1, $2, 'active', now() + $3 * interval '1 millisecond')
+		RETURNING id, book_id, quantity, status, expires_at, created_at
+	`
+	var reservation data.Reservation
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		onHand, _, reserved, err := lockStock(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if onHand-reserved < quantity {
+			return fmt.Errorf("%w: book id %v", ErrInsufficientStock, bookID)
+		}
+		if err := tx.QueryRowContext(ctx, query, bookID, quantity, ttl.Milliseconds()).Scan(
+			&reservation.ID,
+			&reservation.BookID,
+			&reservation.Quantity,
+			&reservation.Status,
+			&reservation.ExpiresAt,
+			&reservation.CreatedAt,
+		); err != nil {
+			return err
+		}
+		return appendLedger(ctx, tx, bookID, data.StockReserve, 0, quantity, onHand, &reservation.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// finishReservation moves an active reservation into its final state. Fulfilled reservations also decrement the quantity on hand.
+// The inventory row of the book is locked first, which serializes this with every other stock movement of the book.
+func (psql *PostgresqlStorage) finishReservation(ctx context.Context, id int, status string) (*data.Reservation, error) {
+	selectBook := `
+		SELECT book_id
+		FROM reservations
+		WHERE id = $1
+	`
+	updateReservation := `
+		UPDATE reservations
+		SET status = $2
+		WHERE id = $1 AND status = 'active'
+		RETURNING id, book_id, quantity, status, expires_at, created_at
+	`
+	updateStock := `
+		UPDATE inventory
+		SET quantity = quantity - $2
+		WHERE book_id = $1
+		RETURNING quantity
+	`
+	var reservation data.Reservation
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var bookID int
+		if err := tx.QueryRowContext(ctx, selectBook, id).Scan(&bookID); err != nil {
+			return err
+		}
+		quantity, _, _, err := lockStock(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, updateReservation, id, status).Scan(
+			&reservation.ID,
+			&reservation.BookID,
+			&reservation.Quantity,
+			&reservation.Status,
+			&reservation.ExpiresAt,
+			&reservation.CreatedAt,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: reservation id %v", ErrReservationNotActive, id)
+		}
+		if err != nil {
+			return err
+		}
+		if status != data.ReservationFulfilled {
+			return appendLedger(ctx, tx, bookID, data.StockRelease, 0, -reservation.Quantity, quantity, &reservation.ID)
+		}
+		if err := tx.QueryRowContext(ctx, updateStock, bookID, reservation.Quantity).Scan(&quantity); err != nil {
+			return err
+		}
+		return appendLedger(ctx, tx, bookID, data.StockFulfil, -reservation.Quantity, -reservation.Quantity, quantity, &reservation.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// ReleaseReservation gives the reserved copies of an active reservation back to the available stock.
+func (psql *PostgresqlStorage) ReleaseReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return psql.finishReservation(ctx, id, data.ReservationReleased)
+}
+
+// FulfilReservation turns an active reservation into an actual decrement of the quantity on hand.
+func (psql *PostgresqlStorage) FulfilReservation(ctx context.Context, id int) (*data.Reservation, error) {
+	return psql.finishReservation(ctx, id, data.ReservationFulfilled)
+}
+
+// GetStockLedger returns all stock movements of a book, oldest first.
+func (psql *PostgresqlStorage) GetStockLedger(ctx context.Context, bookID int) ([]data.StockMovement, error) {
+	query := `
+		SELECT id, book_id, reason, delta, reserved_delta, quantity_after, reservation_id, created_at
+		FROM stock_ledger
+		WHERE book_id = $1
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if _, err := psql.Get(ctx, bookID); err != nil {
+		return nil, err
+	}
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	movements := make([]data.StockMovement, 0)
+	for rows.Next() {
+		var (
+			movement      data.StockMovement
+			reservationID sql.NullInt32
+		)
+		if err := rows.Scan(
+			&movement.ID,
+			&movement.BookID,
+			&movement.Reason,
+			&movement.Delta,
+			&movement.ReservedDelta,
+			&movement.QuantityAfter,
+			&reservationID,
+			&movement.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if reservationID.Valid {
+			id := int(reservationID.Int32)
+			movement.ReservationID = &id
+		}
+		movements = append(movements, movement)
+	}
+	return movements, rows.Err()
+}
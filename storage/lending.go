@@ -0,0 +1,786 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+var (
+	// ErrNoCopyAvailable is returned if a book is checked out while all of its copies are on loan or on hold for other borrowers.
+	ErrNoCopyAvailable = errors.New("no copy available")
+	// ErrLoanReturned is returned if a loan is returned or renewed after it has already been returned.
+	ErrLoanReturned = errors.New("loan has already been returned")
+	// ErrRenewalDenied is returned if a loan has been renewed too often or other borrowers are waiting for the book.
+	ErrRenewalDenied = errors.New("renewal denied")
+	// ErrDuplicateHold is returned if a borrower places a second hold on a book while the first one is still open.
+	ErrDuplicateHold = errors.New("borrower already holds this book")
+)
+
+// LendingStorage is implemented by every storage which is able to lend copies of books to borrowers.
+// All state transitions are enforced by the storage itself, so a copy can never be lent to two borrowers at the same time.
+type LendingStorage interface {
+	AddCopies(ctx context.Context, bookID int, count int) ([]data.Copy, error)
+	ListCopies(ctx context.Context, bookID int) ([]data.Copy, error)
+	CheckOut(ctx context.Context, bookID int, borrower string, period time.Duration) (*data.Loan, error)
+	ReturnLoan(ctx context.Context, loanID int) (*data.Loan, error)
+	RenewLoan(ctx context.Context, loanID int, period time.Duration, maxRenewals int) (*data.Loan, error)
+	PlaceHold(ctx context.Context, bookID int, borrower string) (*data.Hold, error)
+	ListHolds(ctx context.Context, bookID int) ([]data.Hold, error)
+	OverdueLoans(ctx context.Context, now time.Time) ([]data.Loan, error)
+}
+
+// lendingState holds copies, loans and holds of the InMemoryStorage.
+type lendingState struct {
+	copies     map[int]*data.Copy
+	copySerial int
+	loans      map[int]*data.Loan
+	loanSerial int
+	holds      map[int]*data.Hold
+	holdSerial int
+}
+
+func newLendingState() *lendingState {
+	return &lendingState{
+		copies: make(map[int]*data.Copy),
+		loans:  make(map[int]*data.Loan),
+		holds:  make(map[int]*data.Hold),
+	}
+}
+
+// deleteBook removes all copies, loans and holds of a book.
+func (ls *lendingState) deleteBook(bookID int) {
+	for id, c := range ls.copies {
+		if c.BookID == bookID {
+			delete(ls.copies, id)
+		}
+	}
+	for id, loan := range ls.loans {
+		if loan.BookID == bookID {
+			delete(ls.loans, id)
+		}
+	}
+	for id, hold := range ls.holds {
+		if hold.BookID == bookID {
+			delete(ls.holds, id)
+		}
+	}
+}
+
+// serveHolds puts available copies of a book aside for waiting holds, oldest hold first.
+func (ls *lendingState) serveHolds(bookID int) {
+	for holdID := 1; holdID <= ls.holdSerial; holdID++ {
+		hold, ok := ls.holds[holdID]
+		if !ok || hold.BookID != bookID || hold.Status != data.HoldWaiting {
+			continue
+		}
+		var available *data.Copy
+		for copyID := 1; copyID <= ls.copySerial; copyID++ {
+			if c, ok := ls.copies[copyID]; ok && c.BookID == bookID && c.Status == data.CopyAvailable {
+				available = c
+				break
+			}
+		}
+		if available == nil {
+			return
+		}
+		now := time.Now().UTC()
+		available.Status = data.CopyOnHold
+		available.HeldFor = hold.Borrower
+		hold.Status = data.HoldReady
+		hold.CopyID = &available.ID
+		hold.ReadyAt = &now
+	}
+}
+
+// copyLoan returns a copy of a loan, so callers can not modify loans held by the InMemoryStorage.
+func copyLoan(l *data.Loan) *data.Loan {
+	loan := *l
+	if l.ReturnedAt != nil {
+		returnedAt := *l.ReturnedAt
+		loan.ReturnedAt = &returnedAt
+	}
+	return &loan
+}
+
+// copyHold returns a copy of a hold, so callers can not modify holds held by the InMemoryStorage.
+func copyHold(h *data.Hold) *data.Hold {
+	hold := *h
+	if h.CopyID != nil {
+		copyID := *h.CopyID
+		hold.CopyID = &copyID
+	}
+	if h.ReadyAt != nil {
+		readyAt := *h.ReadyAt
+		hold.ReadyAt = &readyAt
+	}
+	return &hold
+}
+
+// AddCopies adds the given number of copies of a book to the library. New copies are handed to waiting holds first.
+func (ims *InMemoryStorage) AddCopies(ctx context.Context, bookID int, count int) ([]data.Copy, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	added := make([]*data.Copy, 0, count)
+	for i := 0; i < count; i++ {
+		ims.lending.copySerial++
+		c := &data.Copy{ID: ims.lending.copySerial, BookID: bookID, Status: data.CopyAvailable}
+		ims.lending.copies[c.ID] = c
+		added = append(added, c)
+	}
+	ims.lending.serveHolds(bookID)
+	copies := make([]data.Copy, 0, count)
+	for _, c := range added {
+		copies = append(copies, *c)
+	}
+	return copies, nil
+}
+
+// ListCopies returns all copies of a book.
+func (ims *InMemoryStorage) ListCopies(ctx context.Context, bookID int) ([]data.Copy, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	copies := make([]data.Copy, 0)
+	for id := 1; id <= ims.lending.copySerial; id++ {
+		if c, ok := ims.lending.copies[id]; ok && c.BookID == bookID {
+			copies = append(copies, *c)
+		}
+	}
+	return copies, nil
+}
+
+// CheckOut lends a copy of a book to a borrower. A copy which is on hold for the borrower is preferred,
+// otherwise any available copy is used.
+func (ims *InMemoryStorage) CheckOut(ctx context.Context, bookID int, borrower string, period time.Duration) (*data.Loan, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	var lent *data.Copy
+	for _, hold := range ims.lending.holds {
+		if hold.BookID == bookID && hold.Borrower == borrower && hold.Status == data.HoldReady {
+			hold.Status = data.HoldFulfilled
+			lent = ims.lending.copies[*hold.CopyID]
+			break
+		}
+	}
+	for id := 1; lent == nil && id <= ims.lending.copySerial; id++ {
+		if c, ok := ims.lending.copies[id]; ok && c.BookID == bookID && c.Status == data.CopyAvailable {
+			lent = c
+		}
+	}
+	if lent == nil {
+		return nil, fmt.Errorf("%w: book id %v", ErrNoCopyAvailable, bookID)
+	}
+	lent.Status = data.CopyOnLoan
+	lent.HeldFor = ""
+	now := time.Now().UTC()
+	ims.lending.loanSerial++
+	loan := &data.Loan{
+		ID:       ims.lending.loanSerial,
+		CopyID:   lent.ID,
+		BookID:   bookID,
+		Borrower: borrower,
+		LoanedAt: now,
+		DueAt:    now.Add(period),
+	}
+	ims.lending.loans[loan.ID] = loan
+	return copyLoan(loan), nil
+}
+
+// ReturnLoan closes a loan. The returned copy is put aside for the oldest waiting hold or becomes available again.
+func (ims *InMemoryStorage) ReturnLoan(ctx context.Context, loanID int) (*data.Loan, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	loan, ok := ims.lending.loans[loanID]
+	if !ok {
+		return nil, fmt.Errorf("loan id %v %w", loanID, ErrNotFound)
+	}
+	if loan.ReturnedAt != nil {
+		return nil, fmt.Errorf("%w: loan id %v", ErrLoanReturned, loanID)
+	}
+	now := time.Now().UTC()
+	loan.ReturnedAt = &now
+	ims.lending.copies[loan.CopyID].Status = data.CopyAvailable
+	ims.lending.serveHolds(loan.BookID)
+	return copyLoan(loan), nil
+}
+
+// RenewLoan extends the due date of an open loan by the given period. Loans can not be renewed more than maxRenewals times
+// or while other borrowers are waiting for the book.
+func (ims *InMemoryStorage) RenewLoan(ctx context.Context, loanID int, period time.Duration, maxRenewals int) (*data.Loan, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	loan, ok := ims.lending.loans[loanID]
+	if !ok {
+		return nil, fmt.Errorf("loan id %v %w", loanID, ErrNotFound)
+	}
+	if loan.ReturnedAt != nil {
+		return nil, fmt.Errorf("%w: loan id %v", ErrLoanReturned, loanID)
+	}
+	if loan.Renewals >= maxRenewals {
+		return nil, fmt.Errorf("%w: loan id %v has been renewed %v times already", ErrRenewalDenied, loanID, loan.Renewals)
+	}
+	for _, hold := range ims.lending.holds {
+		if hold.BookID == loan.BookID && hold.Status == data.HoldWaiting {
+			return nil, fmt.Errorf("%w: other borrowers are waiting for book id %v", ErrRenewalDenied, loan.BookID)
+		}
+	}
+	loan.Renewals++
+	loan.DueAt = loan.DueAt.Add(period)
+	return copyLoan(loan), nil
+}
+
+// PlaceHold queues a borrower for a book. If a copy is available right away, it is put aside for the borrower immediately.
+func (ims *InMemoryStorage) PlaceHold(ctx context.Context, bookID int, borrower string) (*data.Hold, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	for _, hold := range ims.lending.holds {
+		if hold.BookID == bookID && hold.Borrower == borrower && (hold.Status == data.HoldWaiting || hold.Status == data.HoldReady) {
+			return nil, fmt.Errorf("%w: hold id %v", ErrDuplicateHold, hold.ID)
+		}
+	}
+	ims.lending.holdSerial++
+	hold := &data.Hold{
+		ID:        ims.lending.holdSerial,
+		BookID:    bookID,
+		Borrower:  borrower,
+		Status:    data.HoldWaiting,
+		CreatedAt: time.Now().UTC(),
+	}
+	ims.lending.holds[hold.ID] = hold
+	ims.lending.serveHolds(bookID)
+	return copyHold(hold), nil
+}
+
+// ListHolds returns all open holds of a book in queue order.
+func (ims *InMemoryStorage) ListHolds(ctx context.Context, bookID int) ([]data.Hold, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	holds := make([]data.Hold, 0)
+	for id := 1; id <= ims.lending.holdSerial; id++ {
+		if hold, ok := ims.lending.holds[id]; ok && hold.BookID == bookID && hold.Status != data.HoldFulfilled {
+			holds = append(holds, *copyHold(hold))
+		}
+	}
+	return holds, nil
+}
+
+// OverdueLoans returns all open loans which were due before the given time, the longest overdue first.
+func (ims *InMemoryStorage) OverdueLoans(ctx context.Context, now time.Time) ([]data.Loan, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	loans := make([]data.Loan, 0)
+	for id := 1; id <= ims.lending.loanSerial; id++ {
+		if loan, ok := ims.lending.loans[id]; ok && loan.ReturnedAt == nil && loan.DueAt.Before(now) {
+			loans = append(loans, *copyLoan(loan))
+		}
+	}
+	sortLoansByDueDate(loans)
+	return loans, nil
+}
+
+// sortLoansByDueDate orders loans by their due date, the earliest first.
+func sortLoansByDueDate(loans []data.Loan) {
+	sort.SliceStable(loans, func(i, j int) bool {
+		return loans[i].DueAt.Before(loans[j].DueAt)
+	})
+}
+
+// loanColumns are the columns which make up a data.Loan, in the order scanLoan reads them.
+const loanColumns = "id, copy_id, book_id, borrower, loaned_at, due_at, returned_at, renewals"
+
+// scanLoan reads a loan from a row which consists of loanColumns.
+func scanLoan(row rowScanner) (*data.Loan, error) {
+	var (
+		loan       data.Loan
+		returnedAt sql.NullTime
+	)
+	if err := row.Scan(
+		&loan.ID,
+		&loan.CopyID,
+		&loan.BookID,
+		&loan.Borrower,
+		&loan.LoanedAt,
+		&loan.DueAt,
+		&returnedAt,
+		&loan.Renewals,
+	); err != nil {
+		return nil, err
+	}
+	if returnedAt.Valid {
+		loan.ReturnedAt = &returnedAt.Time
+	}
+	return &loan, nil
+}
+
+// holdColumns are the columns which make up a data.Hold, in the order scanHold reads them.
+const holdColumns = "id, book_id, borrower, status, copy_id, created_at, ready_at"
+
+// scanHold reads a hold from a row which consists of holdColumns.
+func scanHold(row rowScanner) (*data.Hold, error) {
+	var (
+		hold    data.Hold
+		copyID  sql.NullInt32
+		readyAt sql.NullTime
+	)
+	if err := row.Scan(
+		&hold.ID,
+		&hold.BookID,
+		&hold.Borrower,
+		&hold.Status,
+		&copyID,
+		&hold.CreatedAt,
+		&readyAt,
+	); err != nil {
+		return nil, err
+	}
+	if copyID.Valid {
+		id := int(copyID.Int32)
+		hold.CopyID = &id
+	}
+	if readyAt.Valid {
+		hold.ReadyAt = &readyAt.Time
+	}
+	return &hold, nil
+}
+
+// lockBookForLending locks the row of a book for the rest of the transaction.
+// Every lending operation of a book takes this lock first, which serializes checkouts, returns and holds per book.
+func lockBookForLending(ctx context.Context, tx *sql.Tx, bookID int) error {
+	query := `
+		SELECT id
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR NO KEY UPDATE
+	`
+	var id int
+	return tx.QueryRowContext(ctx, query, bookID).Scan(&id)
+}
+
+// serveHolds puts available copies of a book aside for waiting holds, oldest hold first. The book must be locked.
+func serveHolds(ctx context.Context, tx *sql.Tx, bookID int) error {
+	nextHold := `
+		SELECT id, borrower
+		FROM holds
+		WHERE book_id = $1 AND status = 'waiting'
+		ORDER BY id
+		LIMIT 1
+	`
+	nextCopy := `
+		SELECT id
+		FROM copies
+		WHERE book_id = $1 AND status = 'available'
+		ORDER BY id
+		LIMIT 1
+	`
+	holdCopy := `
+		UPDATE copies
+		SET status = 'on_hold', held_for = $2
+		WHERE id = $1
+	`
+	readyHold := `
+		UPDATE holds
+		SET status = 'ready', copy_id = $2, ready_at = now()
+		WHERE id = $1
+	`
+	for {
+		var (
+			holdID, copyID int
+			borrower       string
+		)
+		err := tx.QueryRowContext(ctx, nextHold, bookID).Scan(&holdID, &borrower)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, nextCopy, bookID).Scan(&copyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, holdCopy, copyID, borrower); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, readyHold, holdID, copyID); err != nil {
+			return err
+		}
+	}
+}
+
+// AddCopies adds the given number of copies of a book to the library. New copies are handed to waiting holds first.
+func (psql *PostgresqlStorage) AddCopies(ctx context.Context, bookID int, count int) ([]data.Copy, error) {
+	insertCopies := `
+		INSERT INTO copies(book_id, status)
+		SELECT $1, 'available'
+		FROM generate_series(1, $2)
+		RETURNING id
+	`
+	selectCopies := `
+		SELECT id, book_id, status, COALESCE(held_for, '')
+		FROM copies
+		WHERE id = ANY($1)
+		ORDER BY id
+	`
+	copies := make([]data.Copy, 0, count)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		if err := lockBookForLending(ctx, tx, bookID); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, insertCopies, bookID, count)
+		if err != nil {
+			return err
+		}
+		ids := make([]int64, 0, count)
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := serveHolds(ctx, tx, bookID); err != nil {
+			return err
+		}
+		rows, err = tx.QueryContext(ctx, selectCopies, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c data.Copy
+			if err := rows.Scan(&c.ID, &c.BookID, &c.Status, &c.HeldFor); err != nil {
+				return err
+			}
+			copies = append(copies, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+// ListCopies returns all copies of a book.
+func (psql *PostgresqlStorage) ListCopies(ctx context.Context, bookID int) ([]data.Copy, error) {
+	query := `
+		SELECT id, book_id, status, COALESCE(held_for, '')
+		FROM copies
+		WHERE book_id = $1
+		ORDER BY id
+	`
+	if _, err := psql.Get(ctx, bookID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	copies := make([]data.Copy, 0)
+	for rows.Next() {
+		var c data.Copy
+		if err := rows.Scan(&c.ID, &c.BookID, &c.Status, &c.HeldFor); err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+// CheckOut lends a copy of a book to a borrower. A copy which is on hold for the borrower is preferred,
+// otherwise any available copy is used. Besides the lock on the book, a partial unique index on open loans
+// guarantees that a copy is never lent twice.
+func (psql *PostgresqlStorage) CheckOut(ctx context.Context, bookID int, borrower string, period time.Duration) (*data.Loan, error) {
+	fulfilHold := `
+		UPDATE holds
+		SET status = 'fulfilled'
+		WHERE book_id = $1 AND borrower = $2 AND status = 'ready'
+		RETURNING copy_id
+	`
+	nextCopy := `
+		SELECT id
+		FROM copies
+		WHERE book_id = $1 AND status = 'available'
+		ORDER BY id
+		LIMIT 1
+	`
+	lendCopy := `
+		UPDATE copies
+		SET status = 'on_loan', held_for = NULL
+		WHERE id = $1
+	`
+	insertLoan := `
+		INSERT INTO loans(copy_id, book_id, borrower, due_at)
+		VALUES ($1, $2, $3, now() + $4 * interval '1 millisecond')
+		RETURNING ` + loanColumns + `
+	`
+	var loan *data.Loan
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		if err := lockBookForLending(ctx, tx, bookID); err != nil {
+			return err
+		}
+		var copyID int
+		err := tx.QueryRowContext(ctx, fulfilHold, bookID, borrower).Scan(&copyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = tx.QueryRowContext(ctx, nextCopy, bookID).Scan(&copyID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: book id %v", ErrNoCopyAvailable, bookID)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, lendCopy, copyID); err != nil {
+			return err
+		}
+		loan, err = scanLoan(tx.QueryRowContext(ctx, insertLoan, copyID, bookID, borrower, period.Milliseconds()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// lockLoan locks the book of a loan and the loan itself for the rest of the transaction and returns the loan.
+func lockLoan(ctx context.Context, tx *sql.Tx, loanID int) (*data.Loan, error) {
+	selectBook := `
+		SELECT book_id
+		FROM loans
+		WHERE id = $1
+	`
+	selectLoan := `
+		SELECT ` + loanColumns + `
+		FROM loans
+		WHERE id = $1
+		FOR UPDATE
+	`
+	var bookID int
+	if err := tx.QueryRowContext(ctx, selectBook, loanID).Scan(&bookID); err != nil {
+		return nil, err
+	}
+	if err := lockBookForLending(ctx, tx, bookID); err != nil {
+		return nil, err
+	}
+	return scanLoan(tx.QueryRowContext(ctx, selectLoan, loanID))
+}
+
+// ReturnLoan closes a loan. The returned copy is put aside for the oldest waiting hold or becomes available again.
+func (psql *PostgresqlStorage) ReturnLoan(ctx context.Context, loanID int) (*data.Loan, error) {
+	closeLoan := `
+		UPDATE loans
+		SET returned_at = now()
+		WHERE id = $1
+		RETURNING ` + loanColumns + `
+	`
+	releaseCopy := `
+		UPDATE copies
+		SET status = 'available', held_for = NULL
+		WHERE id = $1
+	`
+	var loan *data.Loan
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		current, err := lockLoan(ctx, tx, loanID)
+		if err != nil {
+			return err
+		}
+		if current.ReturnedAt != nil {
+			return fmt.Errorf("%w: loan id %v", ErrLoanReturned, loanID)
+		}
+		if loan, err = scanLoan(tx.QueryRowContext(ctx, closeLoan, loanID)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, releaseCopy, loan.CopyID); err != nil {
+			return err
+		}
+		return serveHolds(ctx, tx, loan.BookID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// RenewLoan extends the due date of an open loan by the given period. Loans can not be renewed more than maxRenewals times
+// or while other borrowers are waiting for the book.
+func (psql *PostgresqlStorage) RenewLoan(ctx context.Context, loanID int, period time.Duration, maxRenewals int) (*data.Loan, error) {
+	countWaiting := `
+		SELECT COUNT(*)
+		FROM holds
+		WHERE book_id = $1 AND status = 'waiting'
+	`
+	renewLoan := `
+		UPDATE loans
+		SET due_at = due_at + $2 * interval '1 millisecond', renewals = renewals + 1
+		WHERE id = $1
+		RETURNING ` + loanColumns + `
+	`
+	var loan *data.Loan
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		current, err := lockLoan(ctx, tx, loanID)
+		if err != nil {
+			return err
+		}
+		if current.ReturnedAt != nil {
+			return fmt.Errorf("%w: loan id %v", ErrLoanReturned, loanID)
+		}
+		if current.Renewals >= maxRenewals {
+			return fmt.Errorf("%w: loan id %v has been renewed %v times already", ErrRenewalDenied, loanID, current.Renewals)
+		}
+		var waiting int
+		if err := tx.QueryRowContext(ctx, countWaiting, current.BookID).Scan(&waiting); err != nil {
+			return err
+		}
+		if waiting > 0 {
+			return fmt.Errorf("%w: other borrowers are waiting for book id %v", ErrRenewalDenied, current.BookID)
+		}
+		loan, err = scanLoan(tx.QueryRowContext(ctx, renewLoan, loanID, period.Milliseconds()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// PlaceHold queues a borrower for a book. If a copy is available right away, it is put aside for the borrower immediately.
+func (psql *PostgresqlStorage) PlaceHold(ctx context.Context, bookID int, borrower string) (*data.Hold, error) {
+	selectOpen := `
+		SELECT id
+		FROM holds
+		WHERE book_id = $1 AND borrower = $2 AND status IN ('waiting', 'ready')
+	`
+	insertHold := `
+		INSERT INTO holds(book_id, borrower, status)
+		VALUES ($1, $2, 'waiting')
+		RETURNING id
+	`
+	selectHold := `
+		SELECT ` + holdColumns + `
+		FROM holds
+		WHERE id = $1
+	`
+	var hold *data.Hold
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		if err := lockBookForLending(ctx, tx, bookID); err != nil {
+			return err
+		}
+		var holdID int
+		err := tx.QueryRowContext(ctx, selectOpen, bookID, borrower).Scan(&holdID)
+		if err == nil {
+			return fmt.Errorf("%w: hold id %v", ErrDuplicateHold, holdID)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, insertHold, bookID, borrower).Scan(&holdID); err != nil {
+			return err
+		}
+		if err := serveHolds(ctx, tx, bookID); err != nil {
+			return err
+		}
+		hold, err = scanHold(tx.QueryRowContext(ctx, selectHold, holdID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// ListHolds returns all open holds of a book in queue order.
+func (psql *PostgresqlStorage) ListHolds(ctx context.Context, bookID int) ([]data.Hold, error) {
+	query := `
+		SELECT ` + holdColumns + `
+		FROM holds
+		WHERE book_id = $1 AND status <> 'fulfilled'
+		ORDER BY id
+	`
+	if _, err := psql.Get(ctx, bookID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	holds := make([]data.Hold, 0)
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, *hold)
+	}
+	return holds, rows.Err()
+}
+
+// OverdueLoans returns all open loans which were due before the given time, the longest overdue first.
+func (psql *PostgresqlStorage) OverdueLoans(ctx context.Context, now time.Time) ([]data.Loan, error) {
+	query := `
+		SELECT ` + loanColumns + `
+		FROM loans
+		WHERE returned_at IS NULL AND due_at < $1
+		ORDER BY due_at, id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	loans := make([]data.Loan, 0)
+	for rows.Next() {
+		loan, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, *loan)
+	}
+	return loans, rows.Err()
+}
@@ -3,76 +3,233 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/torbendury/books-go/data"
 )
 
 // InMemoryStorage holds a in-memory slice which contains Books.
 // Note: The InMemoryStorage is being thrown away when the application is stopped and therefore is not intended for any kind of usage beside testing.
+// All methods are guarded by a single mutex, so it is safe for concurrent use by the server.
 type InMemoryStorage struct {
-	Database []data.Book
-	idSerial int
+	mu           sync.RWMutex
+	Database     []data.Book
+	trash        []data.Book
+	idSerial     int
+	searchIndex  *searchIndex
+	titleTrie    *titleTrie
+	reviews      map[int][]data.Review
+	reviewSerial int
+
+	inventory         map[int]*stockRecord
+	reservations      map[int]*data.Reservation
+	reservationSerial int
+	ledger            []data.StockMovement
+	ledgerSerial      int64
+
+	orders      map[int]*data.Order
+	orderSerial int
+
+	lending *lendingState
+	users   *userState
+
+	apiKeys      map[int]*apiKeyRecord
+	apiKeySerial int
+
+	auditLog    []data.AuditEvent
+	auditSerial int64
+
+	versions map[int][]data.BookVersion
+
+	events *EventBus
+
+	webhooks       map[int]*data.Webhook
+	webhookSerial  int
+	deliveries     map[int]*data.WebhookDelivery
+	deliverySerial int
 }
 
 // NewInMemoryStorage returns a new InMemoryStorage pointer, initialized with an empty database which is represented by an empty slice of Books.
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		Database: make([]data.Book, 0),
-		idSerial: 0,
+		Database:    make([]data.Book, 0),
+		trash:       make([]data.Book, 0),
+		idSerial:    0,
+		searchIndex: newSearchIndex(),
+		titleTrie:   newTitleTrie(),
+		reviews:     make(map[int][]data.Review),
+
+		inventory:    make(map[int]*stockRecord),
+		reservations: make(map[int]*data.Reservation),
+		ledger:       make([]data.StockMovement, 0),
+
+		orders: make(map[int]*data.Order),
+
+		lending: newLendingState(),
+		users:   newUserState(),
+
+		apiKeys: make(map[int]*apiKeyRecord),
+
+		auditLog: make([]data.AuditEvent, 0),
+
+		versions: make(map[int][]data.BookVersion),
+
+		events: NewEventBus(eventReplaySize),
+
+		webhooks:   make(map[int]*data.Webhook),
+		deliveries: make(map[int]*data.WebhookDelivery),
 	}
 }
 
+// indexOf returns the position of the book with the given ID in the database, or -1 if there is no such book.
+// The caller must hold the lock.
+func (ims *InMemoryStorage) indexOf(id int) int {
+	for idx, book := range ims.Database {
+		if book.ID == id {
+			return idx
+		}
+	}
+	return -1
+}
+
 // Get iterates over the internal database and returns a book which matches the ID. If no book is found, an error is thrown.
-func (ims *InMemoryStorage) Get(id int) (*data.Book, error) {
+func (ims *InMemoryStorage) Get(ctx context.Context, id int) (*data.Book, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	return ims.get(id)
+}
+
+// get is the lock-free implementation of Get. The caller must hold the lock.
+func (ims *InMemoryStorage) get(id int) (*data.Book, error) {
 	for _, book := range ims.Database {
 		if book.ID == id {
 			return &book, nil
 		}
 	}
-	return nil, fmt.Errorf("book id %v not found", id)
+	return nil, fmt.Errorf("book id %v %w", id, ErrNotFound)
 }
 
-// GetAll returns the whole database of books.
-func (ims *InMemoryStorage) GetAll() []data.Book {
-	return ims.Database
+// GetAll returns a copy of the whole database of books.
+func (ims *InMemoryStorage) GetAll(ctx context.Context) ([]data.Book, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	return append(make([]data.Book, 0, len(ims.Database)), ims.Database...), nil
 }
 
-// Create creates a new book in the InMemoryStorage.
+// Create creates a new book in the InMemoryStorage. Like every change to a book, it is recorded in the audit log.
 // To implement the interface of a Storage, it is able to return an error.
 // TODO: Implement a friendly case in which this returns an error so we can unit-test.
-func (ims *InMemoryStorage) Create(b *data.Book) (*data.Book, error) {
+func (ims *InMemoryStorage) Create(ctx context.Context, b *data.Book) (*data.Book, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
 	ims.idSerial++
 	b.ID = ims.idSerial
+	b.Rating = nil
+	b.DeletedAt = nil
+	b.Version = 1
 	ims.Database = append(ims.Database, *b)
+	ims.searchIndex.add(b)
+	ims.titleTrie.add(b.ID, b.Title)
+	ims.snapshot(ctx, b)
+	ims.record(newBookAuditEvent(ctx, data.AuditCreate, b.ID, nil, b))
+	ims.events.publish(data.EventBookCreated, b.ID, b)
 	return b, nil
 }
 
-// Update checks if the given book exists by searching the database for its ID. If it is found, the entry in the database is replaced by the given Book.
-func (ims *InMemoryStorage) Update(b *data.Book) (*data.Book, error) {
-	if _, err := ims.Get(b.ID); err != nil {
-		return nil, fmt.Errorf("book id %v not found", b.ID)
+// Update checks if the given book exists by searching the database for its ID. If it is found, the entry in the database is replaced by the given Book
+// and a new version is stored. If the given Book names a version, it has to be the current one, otherwise ErrVersionConflict is returned.
+func (ims *InMemoryStorage) Update(ctx context.Context, b *data.Book) (*data.Book, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	return ims.update(ctx, b)
+}
+
+// update is the lock-free implementation of Update. The caller must hold the lock.
+func (ims *InMemoryStorage) update(ctx context.Context, b *data.Book) (*data.Book, error) {
+	idx := ims.indexOf(b.ID)
+	if idx < 0 {
+		return nil, fmt.Errorf("book id %v %w", b.ID, ErrNotFound)
 	}
-	for idx, book := range ims.Database {
-		if book.ID == b.ID {
-			ims.Database[idx] = *b
-			return b, nil
-		}
+	book := ims.Database[idx]
+	if b.Version != 0 && b.Version != book.Version {
+		return nil, fmt.Errorf("%w: book id %v is at version %v", ErrVersionConflict, b.ID, book.Version)
 	}
-	return nil, fmt.Errorf("book id %v not found", b.ID)
+	b.Rating = book.Rating
+	b.DeletedAt = nil
+	b.Version = book.Version + 1
+	ims.Database[idx] = *b
+	ims.searchIndex.add(b)
+	ims.titleTrie.add(b.ID, b.Title)
+	ims.snapshot(ctx, b)
+	ims.record(newBookAuditEvent(ctx, data.AuditUpdate, b.ID, &book, b))
+	ims.events.publish(data.EventBookUpdated, b.ID, b)
+	return b, nil
 }
 
-// Delete checks if the given book exists by searching the database for its ID. If the ID is found, the book is being deleted.
-// NOTE: The book is not actively being deleted. Rather than that, the last element of the slice is being put into the slice index where
-// the to-be-deleted book resides. Then, the database is being cut down by the last element, effectively "deleting" the requested element.
-// Since InMemoryStorages only purpose is for local testing, this is not an issue and allows for better DELETE performance.
-func (ims *InMemoryStorage) Delete(id int) error {
+// Delete checks if the given book exists by searching the database for its ID. If the ID is found, the book is moved to the trash.
+// Everything referring to the book is kept until it is purged, see TrashStorage.
+// NOTE: The last element of the slice is being put into the slice index where the to-be-deleted book resides. Then, the database is being cut down
+// by the last element, effectively "deleting" the requested element. Since InMemoryStorages only purpose is for local testing, this is not an issue
+// and allows for better DELETE performance.
+func (ims *InMemoryStorage) Delete(ctx context.Context, id int) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
 	for idx, book := range ims.Database {
 		if book.ID == id {
 			ims.Database[idx] = ims.Database[len(ims.Database)-1]
 			ims.Database = ims.Database[:len(ims.Database)-1]
+			ims.searchIndex.remove(id)
+			ims.titleTrie.delete(id)
+			deleted := book
+			now := time.Now().UTC()
+			deleted.DeletedAt = &now
+			ims.trash = append(ims.trash, deleted)
+			ims.record(newBookAuditEvent(ctx, data.AuditDelete, id, &book, nil))
+			ims.events.publish(data.EventBookDeleted, id, nil)
 			return nil
 		}
 	}
-	return fmt.Errorf("book id %v not found", id)
+	return fmt.Errorf("book id %v %w", id, ErrNotFound)
+}
+
+// Search looks up all books matching every term of the query in the inverted index, ranks them and builds highlighted snippets.
+func (ims *InMemoryStorage) Search(ctx context.Context, query string) ([]data.SearchResult, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	results := make([]data.SearchResult, 0)
+	for id, rank := range ims.searchIndex.search(query) {
+		book, err := ims.get(id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, data.SearchResult{
+			Book:    *book,
+			Rank:    rank,
+			Snippet: highlight(book.Title+" "+book.Description, query),
+		})
+	}
+	sortSearchResults(results)
+	if len(results) > searchResultLimit {
+		results = results[:searchResultLimit]
+	}
+	return results, nil
+}
+
+// Suggest returns title suggestions for the given prefix from the in-memory title trie.
+func (ims *InMemoryStorage) Suggest(ctx context.Context, prefix string, limit int) ([]data.Suggestion, error) {
+	return ims.titleTrie.suggest(prefix, limit), nil
+}
+
+// RecordView increases the popularity of the book with the given ID. If the book does not exist, an error is returned.
+func (ims *InMemoryStorage) RecordView(ctx context.Context, id int) error {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if _, err := ims.get(id); err != nil {
+		return err
+	}
+	ims.titleTrie.recordView(id)
+	return nil
 }
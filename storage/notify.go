@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+// changeChannel is the channel on which every change of a book is announced to all servers sharing the database.
+const changeChannel = "books_changed"
+
+const (
+	// listenerMinReconnect and listenerMaxReconnect bound the delay before the listener tries to reconnect after it lost its connection.
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	// listenerPingInterval is how often an idle listener checks its connection, so a broken connection is noticed without a change.
+	listenerPingInterval = 90 * time.Second
+)
+
+// changeNotification is the payload of a notification about a change of a book. Postgres limits payloads to 8000 bytes,
+// so the book itself is not sent along, but read by every server which receives the notification, see applyChange.
+type changeNotification struct {
+	Type     string `json:"type"`
+	BookID   int    `json:"bookId"`
+	OutboxID int64  `json:"outboxId"`
+}
+
+// notifyChange announces a change of a book to all servers within the transaction which changed it, naming the outbox entry of its event.
+// Notifications are only sent once the transaction is committed, see RunListener.
+func notifyChange(ctx context.Context, tx *sql.Tx, eventType string, bookID int, outboxID int64) error {
+	payload, err := json.Marshal(changeNotification{Type: eventType, BookID: bookID, OutboxID: outboxID})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", changeChannel, string(payload))
+	return err
+}
+
+// RunListener listens for the changes of books which are made through any server sharing the database, including this one,
+// until the context is done. Every change is applied to the in-process title trie and published to the subscribers of this server.
+// The listener reconnects on its own. Since notifications sent while it was disconnected are lost, it then resynchronizes:
+// the title trie is loaded again and all subscribers are dropped, so they read the books again before they subscribe anew.
+// Failures are passed to report.
+func (psql *PostgresqlStorage) RunListener(ctx context.Context, connectionString string, report func(error)) {
+	listener := pq.NewListener(connectionString, listenerMinReconnect, listenerMaxReconnect, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			report(fmt.Errorf("listening for changes: %w", err))
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(changeChannel); err != nil {
+		report(fmt.Errorf("listening for changes: %w", err))
+	}
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-listener.Notify:
+			// a nil notification means the connection has been re-established and notifications may have been missed
+			if notification == nil {
+				LoggerFrom(ctx).Warn("reconnected to the database, changes may have been missed and are resynchronized")
+				psql.resync()
+				continue
+			}
+			if err := psql.applyChange(ctx, notification.Extra); err != nil {
+				report(fmt.Errorf("applying change: %w", err))
+			}
+		case <-ping.C:
+			go func() {
+				_ = listener.Ping()
+			}()
+		}
+	}
+}
+
+// applyChange applies a change announced by notifyChange to the title trie and publishes it. The book is read as it is now,
+// so it may already carry later changes, whose own notifications follow. If it has been deleted since, the change is skipped,
+// since its deletion is announced as well.
+func (psql *PostgresqlStorage) applyChange(ctx context.Context, payload string) error {
+	var notification changeNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		return err
+	}
+	// the event is numbered by the bus of this server, like events published by the in-memory storage
+	event := data.Event{
+		Type:   notification.Type,
+		Time:   time.Now().UTC(),
+		BookID: notification.BookID,
+	}
+	if event.Type != data.EventBookDeleted {
+		book, err := psql.Get(ctx, event.BookID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		event.Book = book
+	}
+	psql.updateTitleTrie(func(t *titleTrie) {
+		if event.Type == data.EventBookDeleted {
+			t.delete(event.BookID)
+		} else {
+			t.add(event.Book.ID, event.Book.Title)
+		}
+	})
+	return psql.events.Publish(event)
+}
+
+// resync discards all in-process state which may have missed changes. The title trie is loaded again on its next use.
+func (psql *PostgresqlStorage) resync() {
+	psql.trieMutex.Lock()
+	psql.titleTrie = nil
+	psql.trieMutex.Unlock()
+	psql.events.reset()
+}
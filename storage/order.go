@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrInvalidTransition is returned if an order is moved into a state which is not reachable from its current state.
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// OrderStorage is implemented by every storage which keeps orders. Orders are created from the current prices of the ordered books.
+type OrderStorage interface {
+	CreateOrder(context.Context, *data.Order) (*data.Order, error)
+	GetOrder(ctx context.Context, id int) (*data.Order, error)
+	UpdateOrderStatus(ctx context.Context, id int, status string) (*data.Order, error)
+	ListOrders(ctx context.Context, customerID string) ([]data.Order, error)
+}
+
+// copyOrder returns a deep copy of an order, so callers can not modify orders held by the InMemoryStorage.
+func copyOrder(o *data.Order) *data.Order {
+	order := *o
+	order.Lines = append(make([]data.OrderLine, 0, len(o.Lines)), o.Lines...)
+	return &order
+}
+
+// CreateOrder prices every line of the order with the current price of its book and stores the order as pending.
+func (ims *InMemoryStorage) CreateOrder(ctx context.Context, o *data.Order) (*data.Order, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	order := copyOrder(o)
+	for i := range order.Lines {
+		book, err := ims.get(order.Lines[i].BookID)
+		if err != nil {
+			return nil, err
+		}
+		order.Lines[i].PriceLine(book)
+	}
+	order.CalculateTotal()
+	ims.orderSerial++
+	order.ID = ims.orderSerial
+	order.Status = data.OrderPending
+	order.CreatedAt = time.Now().UTC()
+	order.UpdatedAt = order.CreatedAt
+	ims.orders[order.ID] = order
+	return copyOrder(order), nil
+}
+
+// GetOrder returns the order with the given ID.
+func (ims *InMemoryStorage) GetOrder(ctx context.Context, id int) (*data.Order, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	order, ok := ims.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order id %v %w", id, ErrNotFound)
+	}
+	return copyOrder(order), nil
+}
+
+// UpdateOrderStatus moves an order into the given state if the transition is allowed.
+func (ims *InMemoryStorage) UpdateOrderStatus(ctx context.Context, id int, status string) (*data.Order, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	order, ok := ims.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order id %v %w", id, ErrNotFound)
+	}
+	if !data.CanTransitionOrder(order.Status, status) {
+		return nil, fmt.Errorf("%w: order id %v can not move from %v to %v", ErrInvalidTransition, id, order.Status, status)
+	}
+	order.Status = status
+	order.UpdatedAt = time.Now().UTC()
+	return copyOrder(order), nil
+}
+
+// ListOrders returns all orders of a customer, oldest first.
+func (ims *InMemoryStorage) ListOrders(ctx context.Context, customerID string) ([]data.Order, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	orders := make([]data.Order, 0)
+	for id := 1; id <= ims.orderSerial; id++ {
+		if order, ok := ims.orders[id]; ok && order.CustomerID == customerID {
+			orders = append(orders, *copyOrder(order))
+		}
+	}
+	return orders, nil
+}
+
+// CreateOrder prices every line of the order with the current price of its book and stores the order as pending.
+// The books are locked in share mode while the order is created, so their prices can not change in between.
+func (psql *PostgresqlStorage) CreateOrder(ctx context.Context, o *data.Order) (*data.Order, error) {
+	selectBook := `
+		SELECT ` + bookColumns + `
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR SHARE
+	`
+	insertOrder := `
+		INSERT INTO orders(customer_id, status, total)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`
+	insertLine := `
+		INSERT INTO order_lines(order_id, position, book_id, title, quantity, unit_price, line_total)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	order := copyOrder(o)
+	order.Status = data.OrderPending
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		for i := range order.Lines {
+			book, err := scanBook(tx.QueryRowContext(ctx, selectBook, order.Lines[i].BookID))
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("book id %v %w", order.Lines[i].BookID, ErrNotFound)
+			}
+			if err != nil {
+				return err
+			}
+			order.Lines[i].PriceLine(book)
+		}
+		order.CalculateTotal()
+		if err := tx.QueryRowContext(ctx, insertOrder, order.CustomerID, order.Status, order.Total).Scan(
+			&order.ID,
+			&order.CreatedAt,
+			&order.UpdatedAt,
+		); err != nil {
+			return err
+		}
+		for i, line := range order.Lines {
+			if _, err := tx.ExecContext(ctx, insertLine, order.ID, i, line.BookID, line.Title, line.Quantity, line.UnitPrice, line.LineTotal); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// loadOrderLines reads the lines of the given orders and attaches them in their original order.
+func loadOrderLines(ctx context.Context, db *sql.DB, orders []*data.Order) error {
+	query := `
+		SELECT order_id, book_id, title, quantity, unit_price, line_total
+		FROM order_lines
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, position
+	`
+	byID := make(map[int]*data.Order, len(orders))
+	ids := make([]int64, 0, len(orders))
+	for _, order := range orders {
+		order.Lines = make([]data.OrderLine, 0)
+		byID[order.ID] = order
+		ids = append(ids, int64(order.ID))
+	}
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			orderID int
+			line    data.OrderLine
+		)
+		if err := rows.Scan(&orderID, &line.BookID, &line.Title, &line.Quantity, &line.UnitPrice, &line.LineTotal); err != nil {
+			return err
+		}
+		byID[orderID].Lines = append(byID[orderID].Lines, line)
+	}
+	return rows.Err()
+}
+
+// GetOrder returns the order with the given ID, including its lines.
+func (psql *PostgresqlStorage) GetOrder(ctx context.Context, id int) (*data.Order, error) {
+	query := `
+		SELECT id, customer_id, status, total, created_at, updated_at
+		FROM orders
+		WHERE id = $1
+	`
+	var order data.Order
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, query, id).Scan(
+		&order.ID,
+		&order.CustomerID,
+		&order.Status,
+		&order.Total,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	if err := loadOrderLines(ctx, psql.databaseConnection, []*data.Order{&order}); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// UpdateOrderStatus moves an order into the given state if the transition is allowed.
+// The order row is locked while the transition is validated, so concurrent transitions can not skip a state.
+func (psql *PostgresqlStorage) UpdateOrderStatus(ctx context.Context, id int, status string) (*data.Order, error) {
+	selectStatus := `
+		SELECT status
+		FROM orders
+		WHERE id = $1
+		FOR UPDATE
+	`
+	updateStatus := `
+		UPDATE orders
+		SET status = $2, updated_at = now()
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var current string
+		if err := tx.QueryRowContext(ctx, selectStatus, id).Scan(&current); err != nil {
+			return err
+		}
+		if !data.CanTransitionOrder(current, status) {
+			return fmt.Errorf("%w: order id %v can not move from %v to %v", ErrInvalidTransition, id, current, status)
+		}
+		_, err := tx.ExecContext(ctx, updateStatus, id, status)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return psql.GetOrder(ctx, id)
+}
+
+// ListOrders returns all orders of a customer, oldest first.
+func (psql *PostgresqlStorage) ListOrders(ctx context.Context, customerID string) ([]data.Order, error) {
+	query := `
+		SELECT id, customer_id, status, total, created_at, updated_at
+		FROM orders
+		WHERE customer_id = $1
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]*data.Order, 0)
+	for rows.Next() {
+		var order data.Order
+		if err := rows.Scan(
+			&order.ID,
+			&order.CustomerID,
+			&order.Status,
+			&order.Total,
+			&order.CreatedAt,
+			&order.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		orders = append(orders, &order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadOrderLines(ctx, psql.databaseConnection, orders); err != nil {
+		return nil, err
+	}
+	result := make([]data.Order, 0, len(orders))
+	for _, order := range orders {
+		result = append(result, *order)
+	}
+	return result, nil
+}
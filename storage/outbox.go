@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+// OutboxSink receives the events which are relayed from the outbox. Events are relayed at least once, so sinks may see an event again
+// if relaying failed or was interrupted after they received it. Events of the same book are passed in the order they were written.
+type OutboxSink interface {
+	Publish(event data.Event) error
+}
+
+// OutboxSinkFunc lets an ordinary function act as an OutboxSink.
+type OutboxSinkFunc func(event data.Event) error
+
+// Publish calls f with the event.
+func (f OutboxSinkFunc) Publish(event data.Event) error {
+	return f(event)
+}
+
+// FileSink is an OutboxSink which appends every event as a line of JSON to a writer, e.g. a file for other processes to tail.
+type FileSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFileSink returns a FileSink which writes to w. If w can be synced, like *os.File, every event is synced to disk before it counts as relayed.
+func NewFileSink(w io.Writer) *FileSink {
+	return &FileSink{w: w}
+}
+
+// Publish appends the event to the file.
+func (fs *FileSink) Publish(event data.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, err := fs.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if syncer, ok := fs.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+const (
+	// outboxBatchSize is the maximum number of events which are relayed within one transaction.
+	outboxBatchSize = 100
+	// outboxLockKey is the key of the advisory lock which makes sure only one relay drains the outbox at a time, across all servers.
+	outboxLockKey = 0x626f6f6b73
+	// outboxFlushTimeout bounds how long the relay keeps relaying once it has been stopped, see RunOutboxRelay.
+	outboxFlushTimeout = 5 * time.Second
+)
+
+// insertOutboxEvent writes an event about the given book to the outbox within the transaction which changed the book, and announces
+// the change to all servers, see notifyChange. The event is relayed by RunOutboxRelay once the transaction has been committed, and never if it is rolled back.
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, eventType string, bookID int, book *data.Book) error {
+	query := `
+		INSERT INTO outbox(event_type, book_id, book)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`
+	var payload []byte
+	if book != nil {
+		var err error
+		if payload, err = json.Marshal(book); err != nil {
+			return err
+		}
+	}
+	var id int64
+	if err := tx.QueryRowContext(ctx, query, eventType, bookID, payload).Scan(&id); err != nil {
+		return err
+	}
+	return notifyChange(ctx, tx, eventType, bookID, id)
+}
+
+// notifyOutbox wakes up the relay after a transaction which wrote to the outbox has been committed, so events are not delayed until the next poll.
+func (psql *PostgresqlStorage) notifyOutbox() {
+	select {
+	case psql.outbox <- struct{}{}:
+	default:
+	}
+}
+
+// RunOutboxRelay drains the outbox to the given sinks whenever a change has been committed through this storage, and every interval
+// to pick up changes of other servers and events which failed before, until the context is done. Then the outbox is drained one last time,
+// so no events of this server are left behind until the next start. Failures are passed to report.
+// An event is removed from the outbox once all sinks have received it. If a sink fails, the event and all later events of the same book
+// are kept for the next run, while the events of other books are still relayed.
+func (psql *PostgresqlStorage) RunOutboxRelay(ctx context.Context, interval time.Duration, report func(error), sinks ...OutboxSink) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		psql.drainOutbox(ctx, sinks, report)
+		select {
+		case <-ctx.Done():
+			// changes which have been committed while the server was stopping are relayed before the relay stops
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxFlushTimeout)
+			defer cancel()
+			psql.drainOutbox(flushCtx, sinks, report)
+			return
+		case <-ticker.C:
+		case <-psql.outbox:
+		}
+	}
+}
+
+// drainOutbox relays batches of events until the outbox is empty or relaying fails. Failures are passed to report.
+func (psql *PostgresqlStorage) drainOutbox(ctx context.Context, sinks []OutboxSink, report func(error)) {
+	for {
+		relayed, err := psql.relayOutbox(ctx, sinks)
+		if err != nil {
+			report(fmt.Errorf("relaying outbox: %w", err))
+		}
+		if relayed > 0 {
+			LoggerFrom(ctx).Debug("relayed outbox events", "count", relayed)
+		}
+		if err != nil || relayed < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// relayOutbox passes the oldest events of the outbox to the sinks and deletes those which all sinks have received, within one transaction.
+// The outbox is locked for the transaction, if another server is relaying it already, nothing is done. It returns the number of relayed events.
+func (psql *PostgresqlStorage) relayOutbox(ctx context.Context, sinks []OutboxSink) (int, error) {
+	query := `
+		SELECT id, event_type, book_id, book, created_at
+		FROM outbox
+		ORDER BY id
+		LIMIT $1
+	`
+	deleteQuery := `
+		DELETE FROM outbox
+		WHERE id = ANY($1)
+	`
+	var (
+		relayed  []int64
+		sinkErrs []error
+	)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var locked bool
+		if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxLockKey).Scan(&locked); err != nil || !locked {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		events := make([]data.Event, 0, outboxBatchSize)
+		for rows.Next() {
+			var (
+				event data.Event
+				book  []byte
+			)
+			if err := rows.Scan(&event.Sequence, &event.Type, &event.BookID, &book, &event.Time); err != nil {
+				rows.Close()
+				return err
+			}
+			if book != nil {
+				event.Book = new(data.Book)
+				if err := json.Unmarshal(book, event.Book); err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			events = append(events, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// a failed event holds back the later events of its book, so sinks never see them out of order
+		blocked := make(map[int]bool)
+		for _, event := range events {
+			if blocked[event.BookID] {
+				continue
+			}
+			for _, sink := range sinks {
+				if err := sink.Publish(event); err != nil {
+					sinkErrs = append(sinkErrs, fmt.Errorf("event %v of book id %v: %w", event.Sequence, event.BookID, err))
+					blocked[event.BookID] = true
+					break
+				}
+			}
+			if !blocked[event.BookID] {
+				relayed = append(relayed, event.Sequence)
+			}
+		}
+		_, err = tx.ExecContext(ctx, deleteQuery, pq.Array(relayed))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(relayed), errors.Join(sinkErrs...)
+}
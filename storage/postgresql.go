@@ -4,150 +4,339 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/torbendury/books-go/data"
 )
 
 // PostgresqlStorage holds a connection to a PostgreSQL database instance.
+// The title trie for suggestions is kept in-process and loaded lazily on first use. Change events are written to an outbox, see RunOutboxRelay,
+// and the bus for subscribers as well as the title trie learn about the changes of all servers from notifications, see RunListener.
+// Views of books are counted in-process and added to the database in batches, see RunViewFlusher.
 type PostgresqlStorage struct {
 	databaseConnection *sql.DB
+	trieMutex          sync.Mutex
+	titleTrie          *titleTrie
+	events             *EventBus
+	outbox             chan struct{}
+	viewMutex          sync.Mutex
+	views              map[int]int64
 }
 
 // NewPostgresqlStorage returns a new PostgresqlStorage pointer, initialized with a database connection.
 func NewPostgresqlStorage(db *sql.DB) *PostgresqlStorage {
 	return &PostgresqlStorage{
 		databaseConnection: db,
+		events:             NewEventBus(eventReplaySize),
+		outbox:             make(chan struct{}, 1),
+		views:              make(map[int]int64),
 	}
 }
 
-// OpenDB takes connection information for a reachable PostgreSQL database, opens a connection to it and return it if the connection has been established.
-func OpenDB(dbHost string, dbPort int, dbUser string, dbPass string, dbName string) *sql.DB {
-	db, err := sql.Open("postgres", fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable", dbUser, dbPass, dbHost, dbPort, dbName))
+// withTransaction runs fn inside a database transaction. The transaction is committed if fn succeeds and rolled back otherwise.
+func (psql *PostgresqlStorage) withTransaction(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := psql.databaseConnection.BeginTx(ctx, nil)
 	if err != nil {
-		// TODO: we might later try to recover from this, but right now we want to fail.
-		panic(err)
+		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	err = db.PingContext(ctx)
-	if err != nil {
-		// TODO: again, we later might be able to escape from this by implementing retries?
-		panic(err)
+	if err := fn(tx); err != nil {
+		LoggerFrom(ctx).Debug("rolling back transaction", "error", err)
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
 	}
-	return db
+	return tx.Commit()
 }
 
-// Get returns a book pointer if a matching book was found in the PSQL database. Otherwise, an error is raised.
-func (psql *PostgresqlStorage) Get(id int) (*data.Book, error) {
-	query := `
-		SELECT id, title, description, price
-		FROM books
-		WHERE id = $1
-	`
-	var book data.Book
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	err := psql.databaseConnection.QueryRowContext(ctx, query, id).Scan(
+// bookColumns are the columns which make up a data.Book. Every query returning books selects them in this order, so scanBook can read them.
+const bookColumns = "id, title, description, price, publisher, version, rating_histogram"
+
+// queryer is implemented by both *sql.DB and *sql.Tx, so a query can run either on its own or within a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanBook reads a book from a row which starts with bookColumns. Additional columns following them are scanned into extra.
+func scanBook(row rowScanner, extra ...any) (*data.Book, error) {
+	var (
+		book      data.Book
+		histogram []int64
+	)
+	dest := append([]any{
 		&book.ID,
 		&book.Title,
 		&book.Description,
 		&book.Price,
-	)
-	if err != nil {
+		&book.Publisher,
+		&book.Version,
+		pq.Array(&histogram),
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
 		return nil, err
 	}
-	return &book, err
+	var ratings [5]int
+	for i := 0; i < len(histogram) && i < len(ratings); i++ {
+		ratings[i] = int(histogram[i])
+	}
+	book.Rating = data.NewRatingSummary(ratings)
+	return &book, nil
+}
+
+// Get returns a book pointer if a matching book was found in the PSQL database. Otherwise, an error is raised.
+func (psql *PostgresqlStorage) Get(ctx context.Context, id int) (*data.Book, error) {
+	query := `
+		SELECT ` + bookColumns + `
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanBook(psql.databaseConnection.QueryRowContext(ctx, query, id))
 }
 
 // GetAll returns all stored books from the PostgreSQL database.
 // TODO: Implement limiting and pagination.
-func (psql *PostgresqlStorage) GetAll() []data.Book {
+func (psql *PostgresqlStorage) GetAll(ctx context.Context) ([]data.Book, error) {
 	query := `
-		SELECT id, title, description, price
+		SELECT ` + bookColumns + `
 		FROM books
+		WHERE deleted_at IS NULL
 	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
 	books := make([]data.Book, 0)
-	rows, err := psql.databaseConnection.Query(query)
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var book data.Book
-		if err := rows.Scan(&book.ID, &book.Title, &book.Description, &book.Price); err != nil {
-			panic(err)
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, err
 		}
-		books = append(books, book)
+		books = append(books, *book)
 	}
-	return books
+	return books, rows.Err()
 }
 
 // Create creates a new book in the PostgreSQL database and returns it, including its ID.
-func (psql *PostgresqlStorage) Create(b *data.Book) (*data.Book, error) {
+// Its first version is stored, the creation is audited and its event is written to the outbox within the same transaction, see VersionStorage and AuditStorage.
+func (psql *PostgresqlStorage) Create(ctx context.Context, b *data.Book) (*data.Book, error) {
 	query := `
-		INSERT INTO books(title, description, price) 
-		VALUES ($1, $2, $3)
-		RETURNING id, title, description, price
+		INSERT INTO books(title, description, price, publisher)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + bookColumns + `
 	`
-	var resultBook data.Book
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	var resultBook *data.Book
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
-	err := psql.databaseConnection.QueryRowContext(ctx, query, b.Title, b.Description, b.Price).Scan(
-		&resultBook.ID,
-		&resultBook.Title,
-		&resultBook.Description,
-		&resultBook.Price,
-	)
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		resultBook, err = scanBook(tx.QueryRowContext(ctx, query, b.Title, b.Description, b.Price, b.Publisher))
+		if err != nil {
+			return err
+		}
+		if err := insertBookVersion(ctx, tx, resultBook); err != nil {
+			return err
+		}
+		if err := insertAuditEvent(ctx, tx, newBookAuditEvent(ctx, data.AuditCreate, resultBook.ID, nil, resultBook)); err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, data.EventBookCreated, resultBook.ID, resultBook)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &resultBook, nil
+	psql.updateTitleTrie(func(t *titleTrie) { t.add(resultBook.ID, resultBook.Title) })
+	psql.notifyOutbox()
+	return resultBook, nil
 }
 
-// Update checks if the given book exists by its ID. If it is found, the entry is being updated. Otherwise an error is raised.
-func (psql *PostgresqlStorage) Update(b *data.Book) (*data.Book, error) {
+// Update checks if the given book exists by its ID. If it is found, the entry is being updated and a new version is stored. Otherwise an error is raised.
+// If the given book names a version, it has to be the current one, otherwise ErrVersionConflict is returned.
+func (psql *PostgresqlStorage) Update(ctx context.Context, b *data.Book) (*data.Book, error) {
+	var resultBook *data.Book
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		resultBook, err = updateBook(ctx, tx, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	psql.updateTitleTrie(func(t *titleTrie) { t.add(resultBook.ID, resultBook.Title) })
+	psql.notifyOutbox()
+	return resultBook, nil
+}
+
+// updateBook implements Update within the given transaction. The book is locked while it is updated,
+// so both the version check and the audited difference are exactly about what the update changed.
+// Its event is written to the outbox within the same transaction.
+func updateBook(ctx context.Context, tx *sql.Tx, b *data.Book) (*data.Book, error) {
+	selectQuery := `
+		SELECT ` + bookColumns + `
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`
 	query := `
 		UPDATE books
-		SET title = $2, description = $3, price = $4
+		SET title = $2, description = $3, price = $4, publisher = $5, version = version + 1
 		WHERE id = $1
-		RETURNING id, title, description, price
+		RETURNING ` + bookColumns + `
 	`
-	var resultBook data.Book
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	err := psql.databaseConnection.QueryRowContext(ctx, query, b.ID, b.Title, b.Description, b.Price).Scan(
-		&resultBook.ID,
-		&resultBook.Title,
-		&resultBook.Description,
-		&resultBook.Price,
-	)
+	before, err := scanBook(tx.QueryRowContext(ctx, selectQuery, b.ID))
 	if err != nil {
 		return nil, err
 	}
-	return &resultBook, nil
+	if b.Version != 0 && b.Version != before.Version {
+		return nil, fmt.Errorf("%w: book id %v is at version %v", ErrVersionConflict, b.ID, before.Version)
+	}
+	book, err := scanBook(tx.QueryRowContext(ctx, query, b.ID, b.Title, b.Description, b.Price, b.Publisher))
+	if err != nil {
+		return nil, err
+	}
+	if err := insertBookVersion(ctx, tx, book); err != nil {
+		return nil, err
+	}
+	if err := insertAuditEvent(ctx, tx, newBookAuditEvent(ctx, data.AuditUpdate, b.ID, before, book)); err != nil {
+		return nil, err
+	}
+	if err := insertOutboxEvent(ctx, tx, data.EventBookUpdated, book.ID, book); err != nil {
+		return nil, err
+	}
+	return book, nil
 }
 
-// Delete looks up a book in the PostgreSQL database and deletes it. If deletion fails, an error is returned.
-// Also, if no rows are affected (i.e. because the book ID does not exist), an error is returned.
-func (psql *PostgresqlStorage) Delete(id int) error {
+// Delete looks up a book in the PostgreSQL database and moves it to the trash by setting its deletion marker. If deletion fails, an error is returned.
+// Also, if no rows are affected (i.e. because the book ID does not exist or is already deleted), an error is returned.
+// The deletion is audited and its event is written to the outbox within the same transaction, see AuditStorage.
+func (psql *PostgresqlStorage) Delete(ctx context.Context, id int) error {
 	query := `
-		DELETE FROM books
-		WHERE id = $1
+		UPDATE books
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING ` + bookColumns + `
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
-	res, err := psql.databaseConnection.ExecContext(ctx, query, id)
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		before, err := scanBook(tx.QueryRowContext(ctx, query, id))
+		if err != nil {
+			return err
+		}
+		if err := insertAuditEvent(ctx, tx, newBookAuditEvent(ctx, data.AuditDelete, id, before, nil)); err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, data.EventBookDeleted, id, nil)
+	})
 	if err != nil {
 		return err
 	}
-	rowsAffected, err := res.RowsAffected()
+	psql.updateTitleTrie(func(t *titleTrie) { t.delete(id) })
+	psql.notifyOutbox()
+	return nil
+}
+
+// Search uses the generated tsvector column of the books table to find all books matching the query.
+// Results are ranked with ts_rank and the snippet is built by ts_headline.
+func (psql *PostgresqlStorage) Search(ctx context.Context, query string) ([]data.SearchResult, error) {
+	statement := `
+		SELECT ` + bookColumns + `,
+			ts_rank(search_vector, query) AS rank,
+			ts_headline('english', title || ' ' || description, query, 'MaxWords=20, MinWords=5')
+		FROM books, plainto_tsquery('english', $1) query
+		WHERE search_vector @@ query AND deleted_at IS NULL
+		ORDER BY rank DESC, id
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, statement, query, searchResultLimit)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	defer rows.Close()
+	results := make([]data.SearchResult, 0)
+	for rows.Next() {
+		var result data.SearchResult
+		book, err := scanBook(rows, &result.Rank, &result.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		result.Book = *book
+		results = append(results, result)
 	}
-	return nil
+	return results, rows.Err()
+}
+
+// loadTitleTrie returns the title trie and loads it from the database on first use.
+// If loading fails, the next call tries again.
+func (psql *PostgresqlStorage) loadTitleTrie(ctx context.Context) (*titleTrie, error) {
+	psql.trieMutex.Lock()
+	defer psql.trieMutex.Unlock()
+	if psql.titleTrie != nil {
+		return psql.titleTrie, nil
+	}
+	query := `
+		SELECT id, title, views
+		FROM books
+		WHERE deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trie := newTitleTrie()
+	for rows.Next() {
+		var (
+			id    int
+			title string
+			views int64
+		)
+		if err := rows.Scan(&id, &title, &views); err != nil {
+			return nil, err
+		}
+		trie.add(id, title)
+		trie.setPopularity(id, views)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	psql.titleTrie = trie
+	return trie, nil
+}
+
+// updateTitleTrie applies a change to the title trie, but only if it has been loaded already.
+// Otherwise, the change is picked up when the trie is loaded from the database.
+func (psql *PostgresqlStorage) updateTitleTrie(change func(*titleTrie)) {
+	psql.trieMutex.Lock()
+	defer psql.trieMutex.Unlock()
+	if psql.titleTrie != nil {
+		change(psql.titleTrie)
+	}
+}
+
+// Suggest returns title suggestions for the given prefix. Suggestions are served from the in-process title trie,
+// the database is only queried once to load it.
+func (psql *PostgresqlStorage) Suggest(ctx context.Context, prefix string, limit int) ([]data.Suggestion, error) {
+	trie, err := psql.loadTitleTrie(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return trie.suggest(prefix, limit), nil
 }
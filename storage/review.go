@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ReviewStorage is implemented by every storage which keeps reviews of books.
+// Adding or removing a review also updates the rating aggregate of the reviewed book.
+type ReviewStorage interface {
+	CreateReview(context.Context, *data.Review) (*data.Review, error)
+	GetReviews(ctx context.Context, bookID int, page int, size int) (*data.ReviewPage, error)
+	DeleteReview(ctx context.Context, bookID int, reviewID int) error
+}
+
+// pageOffset returns the number of items before the given page. Pages start at 1. The offset of a page beyond
+// any realistic number of items saturates at the largest int instead of overflowing, so the page is just empty.
+func pageOffset(page int, size int) int {
+	if page < 1 || size < 1 {
+		return 0
+	}
+	if page-1 > math.MaxInt/size {
+		return math.MaxInt
+	}
+	return (page - 1) * size
+}
+
+// histogramOf returns the rating histogram of a summary, which is empty for books without reviews.
+func histogramOf(summary *data.RatingSummary) [5]int {
+	if summary == nil {
+		return [5]int{}
+	}
+	return summary.Histogram
+}
+
+// CreateReview adds a review to an existing book and updates the book's rating aggregate.
+func (ims *InMemoryStorage) CreateReview(ctx context.Context, r *data.Review) (*data.Review, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	idx := ims.indexOf(r.BookID)
+	if idx < 0 {
+		return nil, fmt.Errorf("book id %v %w", r.BookID, ErrNotFound)
+	}
+	ims.reviewSerial++
+	r.ID = ims.reviewSerial
+	r.CreatedAt = time.Now().UTC()
+	ims.reviews[r.BookID] = append(ims.reviews[r.BookID], *r)
+
+	histogram := histogramOf(ims.Database[idx].Rating)
+	histogram[r.Rating-1]++
+	ims.Database[idx].Rating = data.NewRatingSummary(histogram)
+	return r, nil
+}
+
+// GetReviews returns a page of reviews of a book, newest first. Pages start at 1.
+func (ims *InMemoryStorage) GetReviews(ctx context.Context, bookID int, page int, size int) (*data.ReviewPage, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	reviews := ims.reviews[bookID]
+	result := &data.ReviewPage{
+		Reviews: make([]data.Review, 0, size),
+		Page:    page,
+		Size:    size,
+		Total:   len(reviews),
+	}
+	for i := len(reviews) - 1 - pageOffset(page, size); i >= 0 && len(result.Reviews) < size; i-- {
+		result.Reviews = append(result.Reviews, reviews[i])
+	}
+	return result, nil
+}
+
+// DeleteReview removes a single review of a book and updates the book's rating aggregate.
+func (ims *InMemoryStorage) DeleteReview(ctx context.Context, bookID int, reviewID int) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	idx := ims.indexOf(bookID)
+	if idx < 0 {
+		return fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	reviews := ims.reviews[bookID]
+	for i, review := range reviews {
+		if review.ID != reviewID {
+			continue
+		}
+		ims.reviews[bookID] = append(reviews[:i:i], reviews[i+1:]...)
+		histogram := histogramOf(ims.Database[idx].Rating)
+		histogram[review.Rating-1]--
+		ims.Database[idx].Rating = data.NewRatingSummary(histogram)
+		return nil
+	}
+	return fmt.Errorf("review id %v of book id %v %w", reviewID, bookID, ErrNotFound)
+}
+
+// CreateReview inserts a review and increments the rating aggregate of the book within the same transaction.
+// Updating the book first locks its row, so concurrent reviews can not produce an inconsistent aggregate.
+func (psql *PostgresqlStorage) CreateReview(ctx context.Context, r *data.Review) (*data.Review, error) {
+	updateBook := `
+		UPDATE books
+		SET rating_histogram[$2] = rating_histogram[$2] + 1
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	insertReview := `
+		INSERT INTO reviews(book_id, rating, text, author)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, book_id, rating, text, author, created_at
+	`
+	var review data.Review
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, updateBook, r.BookID, r.Rating)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		return tx.QueryRowContext(ctx, insertReview, r.BookID, r.Rating, r.Text, r.Author).Scan(
+			&review.ID,
+			&review.BookID,
+			&review.Rating,
+			&review.Text,
+			&review.Author,
+			&review.CreatedAt,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// GetReviews returns a page of reviews of a book, newest first. Pages start at 1.
+func (psql *PostgresqlStorage) GetReviews(ctx context.Context, bookID int, page int, size int) (*data.ReviewPage, error) {
+	countQuery := `
+		SELECT COALESCE(SUM(count), 0)
+		FROM books, unnest(rating_histogram) AS count
+		WHERE id = $1 AND deleted_at IS NULL
+		GROUP BY id
+	`
+	query := `
+		SELECT id, book_id, rating, text, author, created_at
+		FROM reviews
+		WHERE book_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`
+	result := &data.ReviewPage{
+		Reviews: make([]data.Review, 0, size),
+		Page:    page,
+		Size:    size,
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, countQuery, bookID).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, bookID, size, pageOffset(page, size))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var review data.Review
+		if err := rows.Scan(
+			&review.ID,
+			&review.BookID,
+			&review.Rating,
+			&review.Text,
+			&review.Author,
+			&review.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		result.Reviews = append(result.Reviews, review)
+	}
+	return result, rows.Err()
+}
+
+// DeleteReview removes a single review and decrements the rating aggregate of the book within the same transaction.
+func (psql *PostgresqlStorage) DeleteReview(ctx context.Context, bookID int, reviewID int) error {
+	deleteReview := `
+		DELETE FROM reviews
+		WHERE id = $1 AND book_id = $2
+		RETURNING rating
+	`
+	updateBook := `
+		UPDATE books
+		SET rating_histogram[$2] = rating_histogram[$2] - 1
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var rating int
+		if err := tx.QueryRowContext(ctx, deleteReview, reviewID, bookID).Scan(&rating); err != nil {
+			return err
+		}
+		// reviews of books in the trash can not be changed, so the deletion is rolled back
+		res, err := tx.ExecContext(ctx, updateBook, bookID, rating)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// Searcher is implemented by every storage which is able to do a full-text search over titles and descriptions.
+// Results are ordered by relevance, the most relevant book first.
+type Searcher interface {
+	Search(ctx context.Context, query string) ([]data.SearchResult, error)
+}
+
+// searchResultLimit caps the number of results a single search returns, regardless of the backend.
+const searchResultLimit = 50
+
+// highlightStart and highlightStop wrap matched terms inside snippets. They match the defaults of PostgreSQL's ts_headline.
+const (
+	highlightStart = "<b>"
+	highlightStop  = "</b>"
+)
+
+// snippetWords is the maximum number of words a snippet consists of.
+const snippetWords = 20
+
+// titleWeight boosts matches in the title over matches in the description, similar to setweight() in PostgreSQL.
+const titleWeight = 2.0
+
+// stopWords contains words which are too common to carry any meaning for a search and are therefore never indexed.
+var stopWords = map[string]struct{}{
+	"a": {}, "about": {}, "an": {}, "and": {}, "are": {}, "as": {}, "at": {}, "be": {}, "but": {}, "by": {},
+	"for": {}, "from": {}, "has": {}, "have": {}, "how": {}, "i": {}, "if": {}, "in": {}, "into": {}, "is": {},
+	"it": {}, "its": {}, "of": {}, "on": {}, "or": {}, "our": {}, "so": {}, "that": {}, "the": {}, "their": {},
+	"them": {}, "then": {}, "there": {}, "these": {}, "they": {}, "this": {}, "to": {}, "was": {}, "we": {}, "were": {},
+	"what": {}, "when": {}, "which": {}, "while": {}, "who": {}, "why": {}, "will": {}, "with": {}, "you": {}, "your": {},
+}
+
+// stemSuffixes are stripped from the end of a word, first match wins. The replacement keeps stems like "stories" -> "story" readable.
+// This is a deliberately small subset of the Porter stemmer, good enough to make "reading", "reads" and "read" find each other.
+var stemSuffixes = []struct {
+	suffix      string
+	replacement string
+}{
+	{"ational", "ate"},
+	{"ization", "ize"},
+	{"fulness", "ful"},
+	{"iveness", "ive"},
+	{"ousness", "ous"},
+	{"ements", ""},
+	{"ement", ""},
+	{"ments", ""},
+	{"ment", ""},
+	{"ness", ""},
+	{"ings", ""},
+	{"ing", ""},
+	{"edly", ""},
+	{"ies", "y"},
+	{"ied", "y"},
+	{"sses", "ss"},
+	{"ed", ""},
+	{"ly", ""},
+	{"es", ""},
+	{"s", ""},
+}
+
+// stem reduces a lowercase word to its stem. Stems shorter than three characters are never produced, so short words stay untouched.
+func stem(word string) string {
+	for _, s := range stemSuffixes {
+		if !strings.HasSuffix(word, s.suffix) {
+			continue
+		}
+		stemmed := strings.TrimSuffix(word, s.suffix) + s.replacement
+		if len([]rune(stemmed)) < 3 {
+			return word
+		}
+		if s.suffix == "s" && strings.HasSuffix(stemmed, "s") {
+			return word
+		}
+		return stemmed
+	}
+	return word
+}
+
+// splitWords splits a text into its words. Everything which is neither a letter nor a digit is treated as separator.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// term returns the indexable term for a single word and whether the word should be indexed at all.
+func term(word string) (string, bool) {
+	word = strings.ToLower(word)
+	if _, ok := stopWords[word]; ok {
+		return "", false
+	}
+	return stem(word), true
+}
+
+// tokenize turns a text into the list of its indexable terms.
+func tokenize(text string) []string {
+	terms := make([]string, 0)
+	for _, word := range splitWords(text) {
+		if t, ok := term(word); ok {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// searchIndex is an in-memory inverted index which maps terms to the books containing them.
+// For each book, it remembers the weighted term frequency which is used for ranking.
+type searchIndex struct {
+	postings map[string]map[int]float64
+	terms    map[int][]string
+}
+
+// newSearchIndex returns an empty searchIndex.
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int]float64),
+		terms:    make(map[int][]string),
+	}
+}
+
+// add indexes the given book. If the book has already been indexed before, the old entry is replaced.
+func (idx *searchIndex) add(b *data.Book) {
+	idx.remove(b.ID)
+	frequencies := make(map[string]float64)
+	for _, t := range tokenize(b.Title) {
+		frequencies[t] += titleWeight
+	}
+	for _, t := range tokenize(b.Description) {
+		frequencies[t]++
+	}
+	terms := make([]string, 0, len(frequencies))
+	for t, frequency := range frequencies {
+		if idx.postings[t] == nil {
+			idx.postings[t] = make(map[int]float64)
+		}
+		idx.postings[t][b.ID] = frequency
+		terms = append(terms, t)
+	}
+	idx.terms[b.ID] = terms
+}
+
+// remove drops the book with the given ID from the index.
+func (idx *searchIndex) remove(id int) {
+	for _, t := range idx.terms[id] {
+		delete(idx.postings[t], id)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	delete(idx.terms, id)
+}
+
+// search returns the IDs of all books which contain every term of the query, together with their rank.
+// The rank is the sum of tf-idf scores of the query terms.
+func (idx *searchIndex) search(query string) map[int]float64 {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	scores := make(map[int]float64)
+	documents := float64(len(idx.terms))
+	for i, t := range terms {
+		postings := idx.postings[t]
+		if len(postings) == 0 {
+			return nil
+		}
+		idf := math.Log(1 + documents/float64(len(postings)))
+		next := make(map[int]float64)
+		for id, frequency := range postings {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+			next[id] = scores[id] + frequency*idf
+		}
+		scores = next
+	}
+	return scores
+}
+
+// highlight builds a snippet of the given text around the first matched term. Matched terms are wrapped in highlight markers.
+// It mirrors what PostgreSQL's ts_headline returns, so both backends produce comparable snippets.
+func highlight(text string, query string) string {
+	wanted := make(map[string]struct{})
+	for _, t := range tokenize(query) {
+		wanted[t] = struct{}{}
+	}
+	words := strings.Fields(text)
+	first := -1
+	for i, word := range words {
+		for _, part := range splitWords(word) {
+			if t, ok := term(part); ok {
+				if _, match := wanted[t]; match {
+					words[i] = strings.Replace(words[i], part, highlightStart+part+highlightStop, 1)
+					if first < 0 {
+						first = i
+					}
+				}
+			}
+		}
+	}
+	start := 0
+	if first > snippetWords/2 {
+		start = first - snippetWords/2
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+	return strings.Join(words[start:end], " ")
+}
+
+// sortSearchResults orders results by rank, highest first. Ties are broken by book ID to keep results stable.
+func sortSearchResults(results []data.SearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Book.ID < results[j].Book.ID
+	})
+}
@@ -1,13 +1,45 @@
 package storage
 
-import "github.com/torbendury/books-go/data"
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrNotFound is wrapped by the errors of the in-memory storage for books and other entities which do not exist.
+// The PostgreSQL storage returns sql.ErrNoRows instead, use IsNotFound to check for both.
+var ErrNotFound = errors.New("not found")
+
+// IsNotFound reports whether an error of a storage means that the requested entity does not exist, as opposed to the storage failing.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, sql.ErrNoRows)
+}
 
 // Storage is a backend agnostic interface for any kind of data store which allows CRUD operations.
 // This allows for decoupled logic between server and persistence.
+// Deleted books are moved to the trash and hidden from all reads except Trash, see TrashStorage.
+// Every operation takes the context of the request which caused it, so its SQL statements are traced as part of the request, see NewTracedConnector.
+// For changes to books, the context also names the actor and request for the audit log, see WithActor and WithRequestID.
 type Storage interface {
-	Create(*data.Book) (*data.Book, error)
-	Get(int) (*data.Book, error)
-	GetAll() []data.Book
-	Update(*data.Book) (*data.Book, error)
-	Delete(int) error
+	Create(context.Context, *data.Book) (*data.Book, error)
+	Get(context.Context, int) (*data.Book, error)
+	GetAll(context.Context) ([]data.Book, error)
+	Update(context.Context, *data.Book) (*data.Book, error)
+	Delete(context.Context, int) error
+
+	Searcher
+	Suggester
+	ReviewStorage
+	InventoryStorage
+	OrderStorage
+	LendingStorage
+	UserStorage
+	KeyStorage
+	AuditStorage
+	TrashStorage
+	VersionStorage
+	EventStorage
+	WebhookStorage
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/torbendury/books-go/data"
+	"github.com/torbendury/books-go/utilities"
+)
+
+// Suggester is implemented by every storage which is able to suggest book titles while a user is still typing.
+// RecordView feeds the popularity signal which is used to rank suggestions.
+type Suggester interface {
+	Suggest(ctx context.Context, prefix string, limit int) ([]data.Suggestion, error)
+	RecordView(ctx context.Context, id int) error
+}
+
+// maxSuggestDistance returns how many typos are tolerated for a prefix of the given length.
+// Short prefixes need to match exactly, otherwise nearly every title would be suggested.
+func maxSuggestDistance(length int) int {
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// trieNode is a single node of a titleTrie. ids contains the books whose key ends in this node.
+type trieNode struct {
+	children map[rune]*trieNode
+	ids      map[int]struct{}
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children: make(map[rune]*trieNode),
+		ids:      make(map[int]struct{}),
+	}
+}
+
+// titleTrie is a prefix index over book titles. Every title is indexed with all of its word-aligned suffixes,
+// so typing "tears" also suggests "Bitter tears of software architects". Keys are folded, making lookups case and diacritic insensitive.
+// A titleTrie is safe for concurrent use.
+type titleTrie struct {
+	mu         sync.RWMutex
+	root       *trieNode
+	titles     map[int]string
+	popularity map[int]int64
+}
+
+// newTitleTrie returns an empty titleTrie.
+func newTitleTrie() *titleTrie {
+	return &titleTrie{
+		root:       newTrieNode(),
+		titles:     make(map[int]string),
+		popularity: make(map[int]int64),
+	}
+}
+
+// titleKeys returns all keys a title is indexed with.
+func titleKeys(title string) [][]rune {
+	words := strings.Fields(utilities.Fold(title))
+	keys := make([][]rune, 0, len(words))
+	for i := range words {
+		keys = append(keys, []rune(strings.Join(words[i:], " ")))
+	}
+	return keys
+}
+
+// add indexes the given book title. If the book is already indexed, its old title is replaced while its popularity is kept.
+func (t *titleTrie) add(id int, title string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(id)
+	for _, key := range titleKeys(title) {
+		node := t.root
+		for _, r := range key {
+			child, ok := node.children[r]
+			if !ok {
+				child = newTrieNode()
+				node.children[r] = child
+			}
+			node = child
+		}
+		node.ids[id] = struct{}{}
+	}
+	t.titles[id] = title
+}
+
+// delete drops the book with the given ID from the index, including its popularity.
+func (t *titleTrie) delete(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(id)
+	delete(t.popularity, id)
+}
+
+// remove drops all keys of a book and prunes nodes which became empty. The caller must hold the write lock.
+func (t *titleTrie) remove(id int) {
+	title, ok := t.titles[id]
+	if !ok {
+		return
+	}
+	for _, key := range titleKeys(title) {
+		path := []*trieNode{t.root}
+		node := t.root
+		for _, r := range key {
+			node = node.children[r]
+			if node == nil {
+				break
+			}
+			path = append(path, node)
+		}
+		if node == nil {
+			continue
+		}
+		delete(node.ids, id)
+		for i := len(path) - 1; i > 0; i-- {
+			if len(path[i].ids) > 0 || len(path[i].children) > 0 {
+				break
+			}
+			delete(path[i-1].children, key[i-1])
+		}
+	}
+	delete(t.titles, id)
+}
+
+// setPopularity overwrites the popularity of a book, e.g. when loading it from a persistent backend.
+func (t *titleTrie) setPopularity(id int, popularity int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.popularity[id] = popularity
+}
+
+// recordView increases the popularity of an indexed book by one.
+func (t *titleTrie) recordView(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.titles[id]; ok {
+		t.popularity[id]++
+	}
+}
+
+// suggest returns up to limit books whose title (or a word-aligned part of it) starts with the given prefix, tolerating a few typos.
+// Suggestions are ordered by edit distance first and by popularity second.
+func (t *titleTrie) suggest(prefix string, limit int) []data.Suggestion {
+	query := []rune(utilities.Fold(strings.TrimSpace(prefix)))
+	if len(query) == 0 || limit <= 0 {
+		return []data.Suggestion{}
+	}
+	maxDistance := maxSuggestDistance(len(query))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	distances := make(map[int]int)
+	row := make([]int, len(query)+1)
+	for i := range row {
+		row[i] = i
+	}
+	for r, child := range t.root.children {
+		t.walk(child, r, query, row, len(query)+1, maxDistance, distances)
+	}
+
+	suggestions := make([]data.Suggestion, 0, len(distances))
+	for id := range distances {
+		suggestions = append(suggestions, data.Suggestion{
+			ID:         id,
+			Title:      t.titles[id],
+			Popularity: t.popularity[id],
+		})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if distances[a.ID] != distances[b.ID] {
+			return distances[a.ID] < distances[b.ID]
+		}
+		if a.Popularity != b.Popularity {
+			return a.Popularity > b.Popularity
+		}
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return a.ID < b.ID
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// walk computes the next row of the Levenshtein matrix between the query and the path leading to node.
+// best carries the smallest distance between the query and any prefix of that path, which is the prefix edit distance of all keys below.
+// The caller must hold the read lock.
+func (t *titleTrie) walk(node *trieNode, r rune, query []rune, previous []int, best int, maxDistance int, distances map[int]int) {
+	row := make([]int, len(previous))
+	row[0] = previous[0] + 1
+	rowMin := row[0]
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if query[i-1] == r {
+			cost = 0
+		}
+		row[i] = minOf(row[i-1]+1, previous[i]+1, previous[i-1]+cost)
+		rowMin = minOf(rowMin, row[i])
+	}
+	best = minOf(best, row[len(row)-1])
+	if best <= maxDistance {
+		for id := range node.ids {
+			if distance, ok := distances[id]; !ok || best < distance {
+				distances[id] = best
+			}
+		}
+	}
+	if rowMin > maxDistance && best > maxDistance {
+		return
+	}
+	for next, child := range node.children {
+		t.walk(child, next, query, row, best, maxDistance, distances)
+	}
+}
+
+// minOf returns the smallest of the given values.
+func minOf(first int, rest ...int) int {
+	for _, value := range rest {
+		if value < first {
+			first = value
+		}
+	}
+	return first
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the spans of SQL statements.
+const tracerName = "github.com/torbendury/books-go/storage"
+
+// rowCountKey is the attribute of a span of an SQL statement which holds the number of rows it returned or affected.
+const rowCountKey = attribute.Key("db.row_count")
+
+// NewTracedConnector wraps a database connector, so every SQL statement sent through its connections is recorded as a span.
+// The span is a child of the span in the context of the statement, e.g. the one of the request which caused it.
+// It carries the statement and, once it is done, the number of rows which have been returned or affected.
+// Statements which take at least slowQuery are also logged with the logger of their context, see LoggerFrom. 0 logs no statements.
+func NewTracedConnector(connector driver.Connector, provider trace.TracerProvider, slowQuery time.Duration) driver.Connector {
+	return &tracedConnector{Connector: connector, tracer: provider.Tracer(tracerName), slowQuery: slowQuery}
+}
+
+// tracedConnector opens traced connections, see NewTracedConnector.
+type tracedConnector struct {
+	driver.Connector
+	tracer    trace.Tracer
+	slowQuery time.Duration
+}
+
+// Connect opens a traced connection.
+func (tc *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := tc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn, tracer: tc.tracer, slowQuery: tc.slowQuery}, nil
+}
+
+// tracedConn traces the statements of a connection. database/sql only passes contexts to connections which implement
+// the context aware interfaces of driver, so all of them are implemented and delegated to the wrapped connection.
+type tracedConn struct {
+	driver.Conn
+	tracer    trace.Tracer
+	slowQuery time.Duration
+}
+
+// statement is an SQL statement which is being executed.
+type statement struct {
+	ctx       context.Context
+	span      trace.Span
+	query     string
+	start     time.Time
+	slowQuery time.Duration
+}
+
+// start starts the span of a statement.
+func (tc *tracedConn) start(ctx context.Context, query string) (context.Context, *statement) {
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	operation = strings.ToUpper(operation)
+	ctx, span := tc.tracer.Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperation(operation), semconv.DBStatement(query)),
+	)
+	return ctx, &statement{ctx: ctx, span: span, query: query, start: time.Now(), slowQuery: tc.slowQuery}
+}
+
+// finish ends the span of a statement, which returned or affected the given number of rows, and records its error, if any.
+// A row count below 0 is unknown. If the statement was slow, it is logged.
+func (st *statement) finish(rows int64, err error) {
+	if rows >= 0 {
+		st.span.SetAttributes(rowCountKey.Int64(rows))
+	}
+	if err != nil {
+		st.span.RecordError(err)
+		st.span.SetStatus(codes.Error, err.Error())
+	}
+	st.span.End()
+	if duration := time.Since(st.start); st.slowQuery > 0 && duration >= st.slowQuery {
+		LoggerFrom(st.ctx).Warn("slow query", "statement", st.query, "duration", duration, "rows", rows)
+	}
+}
+
+// QueryContext runs a query, its span ends when the returned rows are closed.
+func (tc *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := tc.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, st := tc.start(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		st.finish(-1, err)
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, statement: st}, nil
+}
+
+// ExecContext runs a statement which returns no rows.
+func (tc *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := tc.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, st := tc.start(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	affected := int64(-1)
+	if err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			affected = n
+		}
+	}
+	st.finish(affected, err)
+	return result, err
+}
+
+// PrepareContext prepares a statement, which is not traced.
+func (tc *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := tc.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return tc.Conn.Prepare(query)
+}
+
+// BeginTx starts a transaction, whose statements are traced like all others.
+func (tc *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := tc.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return tc.Conn.Begin()
+}
+
+// Ping checks the connection.
+func (tc *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := tc.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession resets the connection before it is reused.
+func (tc *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := tc.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid reports whether the connection may be reused.
+func (tc *tracedConn) IsValid() bool {
+	if validator, ok := tc.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// tracedRows counts the rows returned by a query and ends its span once they are closed.
+type tracedRows struct {
+	driver.Rows
+	statement *statement
+	count     int64
+	err       error
+}
+
+// Next reads the next row.
+func (tr *tracedRows) Next(dest []driver.Value) error {
+	err := tr.Rows.Next(dest)
+	switch {
+	case err == nil:
+		tr.count++
+	case !errors.Is(err, io.EOF):
+		tr.err = err
+	}
+	return err
+}
+
+// Close closes the rows and ends the span of the query.
+func (tr *tracedRows) Close() error {
+	err := tr.Rows.Close()
+	tr.statement.finish(tr.count, errors.Join(tr.err, err))
+	return err
+}
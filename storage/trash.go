@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// TrashStorage is implemented by every storage which deletes books softly. Delete moves a book to the trash, where it is hidden from
+// all other reads but can be restored until it is purged. Everything referring to a book, e.g. its reviews, stock, copies and reading
+// list entries, is kept while the book is in the trash and only removed when it is purged. Reading lists hide the entries of books in the trash.
+type TrashStorage interface {
+	Trash(ctx context.Context) ([]data.Book, error)
+	Restore(ctx context.Context, id int) (*data.Book, error)
+	Purge(ctx context.Context, deletedBefore time.Time) (int, error)
+}
+
+// PurgerActor is the actor which is recorded in the audit log for books purged by RunPurger.
+const PurgerActor = "purger"
+
+// RunPurger purges all books which have been in the trash for longer than the retention period, and then again every interval
+// until the context is done. Failures are passed to report, the next run tries again.
+func RunPurger(ctx context.Context, store TrashStorage, retention time.Duration, interval time.Duration, report func(error)) {
+	ctx = WithActor(ctx, PurgerActor)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := store.Purge(ctx, time.Now().Add(-retention))
+		if err != nil {
+			report(fmt.Errorf("purging trash: %w", err))
+		} else if purged > 0 {
+			LoggerFrom(ctx).Info("purged books from the trash", "count", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Trash returns all books in the trash, most recently deleted first.
+func (ims *InMemoryStorage) Trash(ctx context.Context) ([]data.Book, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	books := append(make([]data.Book, 0, len(ims.trash)), ims.trash...)
+	sort.SliceStable(books, func(i, j int) bool {
+		return books[i].DeletedAt.After(*books[j].DeletedAt)
+	})
+	return books, nil
+}
+
+// inTrash reports whether the book with the given ID is in the trash.
+func (ims *InMemoryStorage) inTrash(id int) bool {
+	for _, book := range ims.trash {
+		if book.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore moves a book from the trash back into the database, together with everything that refers to it.
+func (ims *InMemoryStorage) Restore(ctx context.Context, id int) (*data.Book, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	for idx, book := range ims.trash {
+		if book.ID == id {
+			ims.trash = append(ims.trash[:idx], ims.trash[idx+1:]...)
+			book.DeletedAt = nil
+			ims.Database = append(ims.Database, book)
+			ims.searchIndex.add(&book)
+			ims.titleTrie.add(book.ID, book.Title)
+			ims.record(newBookAuditEvent(ctx, data.AuditRestore, id, nil, &book))
+			ims.events.publish(data.EventBookCreated, id, &book)
+			return &book, nil
+		}
+	}
+	return nil, fmt.Errorf("book id %v %w in trash", id, ErrNotFound)
+}
+
+// Purge permanently deletes all books which were moved to the trash before the given time, together with their versions, their reviews,
+// their inventory, their copies and their reading list entries. The stock ledger is append-only and therefore keeps the movements of purged books.
+// It returns the number of purged books.
+func (ims *InMemoryStorage) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	kept := ims.trash[:0]
+	purged := 0
+	for _, book := range ims.trash {
+		if !book.DeletedAt.Before(deletedBefore) {
+			kept = append(kept, book)
+			continue
+		}
+		id := book.ID
+		delete(ims.reviews, id)
+		delete(ims.inventory, id)
+		delete(ims.versions, id)
+		for reservationID, reservation := range ims.reservations {
+			if reservation.BookID == id {
+				delete(ims.reservations, reservationID)
+			}
+		}
+		ims.lending.deleteBook(id)
+		ims.users.deleteBook(id)
+		book.DeletedAt = nil
+		ims.record(newBookAuditEvent(ctx, data.AuditPurge, id, &book, nil))
+		purged++
+	}
+	ims.trash = kept
+	return purged, nil
+}
+
+// Trash returns all books in the trash, most recently deleted first.
+func (psql *PostgresqlStorage) Trash(ctx context.Context) ([]data.Book, error) {
+	query := `
+		SELECT ` + bookColumns + `, deleted_at
+		FROM books
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make([]data.Book, 0)
+	for rows.Next() {
+		var deletedAt time.Time
+		book, err := scanBook(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		book.DeletedAt = &deletedAt
+		books = append(books, *book)
+	}
+	return books, rows.Err()
+}
+
+// Restore moves a book out of the trash by clearing its deletion marker. The restore is audited and its event is written to the outbox within the same transaction.
+func (psql *PostgresqlStorage) Restore(ctx context.Context, id int) (*data.Book, error) {
+	query := `
+		UPDATE books
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING ` + bookColumns + `
+	`
+	var book *data.Book
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		book, err = scanBook(tx.QueryRowContext(ctx, query, id))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("book id %v %w in trash", id, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := insertAuditEvent(ctx, tx, newBookAuditEvent(ctx, data.AuditRestore, id, nil, book)); err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, data.EventBookCreated, book.ID, book)
+	})
+	if err != nil {
+		return nil, err
+	}
+	psql.updateTitleTrie(func(t *titleTrie) { t.add(book.ID, book.Title) })
+	psql.notifyOutbox()
+	return book, nil
+}
+
+// Purge permanently deletes all books which were moved to the trash before the given time. Everything referring to them is deleted by the
+// database, except for the stock ledger which keeps the movements of purged books. The purges are audited within the same transaction.
+// It returns the number of purged books.
+func (psql *PostgresqlStorage) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	query := `
+		DELETE FROM books
+		WHERE deleted_at < $1
+		RETURNING ` + bookColumns + `
+	`
+	purged := 0
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, deletedBefore)
+		if err != nil {
+			return err
+		}
+		books := make([]*data.Book, 0)
+		for rows.Next() {
+			book, err := scanBook(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			books = append(books, book)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, book := range books {
+			if err := insertAuditEvent(ctx, tx, newBookAuditEvent(ctx, data.AuditPurge, book.ID, book, nil)); err != nil {
+				return err
+			}
+		}
+		purged = len(books)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
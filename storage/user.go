@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+var (
+	// ErrUnknownList is returned if a reading list is requested which is not one of the lists every user has.
+	ErrUnknownList = errors.New("unknown reading list")
+	// ErrDuplicateEntry is returned if a book is added to a reading list which already contains it.
+	ErrDuplicateEntry = errors.New("book is already on the list")
+	// ErrInvalidOrder is returned if a new order of a reading list does not contain every book of the list exactly once.
+	ErrInvalidOrder = errors.New("order must contain every book of the list exactly once")
+)
+
+// UserStorage is implemented by every storage which keeps users and their reading lists.
+// Entries of books in the trash are hidden from all reading lists, and removed by the storage once the books are purged, see TrashStorage.
+type UserStorage interface {
+	CreateUser(context.Context, *data.User) (*data.User, error)
+	GetUser(ctx context.Context, id int) (*data.User, error)
+	GetReadingList(ctx context.Context, userID int, name string) (*data.ReadingList, error)
+	AddListEntry(ctx context.Context, userID int, name string, entry data.ListEntry) (*data.ReadingList, error)
+	RemoveListEntry(ctx context.Context, userID int, name string, bookID int) (*data.ReadingList, error)
+	ReorderList(ctx context.Context, userID int, name string, bookIDs []int) (*data.ReadingList, error)
+	SetListProgress(ctx context.Context, userID int, name string, bookID int, progress int) (*data.ReadingList, error)
+}
+
+// isPermutation reports whether order contains every book of the entries exactly once.
+func isPermutation(entries []data.ListEntry, order []int) bool {
+	if len(entries) != len(order) {
+		return false
+	}
+	remaining := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		remaining[entry.BookID] = true
+	}
+	for _, bookID := range order {
+		if !remaining[bookID] {
+			return false
+		}
+		delete(remaining, bookID)
+	}
+	return true
+}
+
+// userState holds users and their reading lists in the InMemoryStorage. Entries are kept in list order.
+type userState struct {
+	users      map[int]*data.User
+	userSerial int
+	lists      map[int]map[string][]data.ListEntry
+}
+
+func newUserState() *userState {
+	return &userState{
+		users: make(map[int]*data.User),
+		lists: make(map[int]map[string][]data.ListEntry),
+	}
+}
+
+// deleteBook removes a book from the reading lists of all users.
+func (us *userState) deleteBook(bookID int) {
+	for _, lists := range us.lists {
+		for name, entries := range lists {
+			for i, entry := range entries {
+				if entry.BookID == bookID {
+					lists[name] = append(entries[:i:i], entries[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// list returns the entries of a reading list, after checking that user and list exist.
+func (us *userState) list(userID int, name string) ([]data.ListEntry, error) {
+	if _, ok := us.users[userID]; !ok {
+		return nil, fmt.Errorf("user id %v %w", userID, ErrNotFound)
+	}
+	if !data.IsReadingList(name) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownList, name)
+	}
+	return us.lists[userID][name], nil
+}
+
+// readingList builds a data.ReadingList from the stored entries and numbers the entries by their place in the list.
+// Entries of books in the trash are left out, so they do not leave gaps.
+func (us *userState) readingList(userID int, name string, inTrash func(bookID int) bool) *data.ReadingList {
+	entries := us.lists[userID][name]
+	list := &data.ReadingList{
+		UserID:  userID,
+		Name:    name,
+		Entries: make([]data.ListEntry, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		if inTrash(entry.BookID) {
+			continue
+		}
+		entry.Position = len(list.Entries)
+		list.Entries = append(list.Entries, entry)
+	}
+	return list
+}
+
+// CreateUser creates a new user with empty reading lists.
+func (ims *InMemoryStorage) CreateUser(ctx context.Context, u *data.User) (*data.User, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	ims.users.userSerial++
+	user := &data.User{
+		ID:        ims.users.userSerial,
+		Name:      u.Name,
+		CreatedAt: time.Now().UTC(),
+	}
+	ims.users.users[user.ID] = user
+	ims.users.lists[user.ID] = make(map[string][]data.ListEntry)
+	result := *user
+	return &result, nil
+}
+
+// GetUser returns the user with the given ID.
+func (ims *InMemoryStorage) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	user, ok := ims.users.users[id]
+	if !ok {
+		return nil, fmt.Errorf("user id %v %w", id, ErrNotFound)
+	}
+	result := *user
+	return &result, nil
+}
+
+// GetReadingList returns a reading list of a user in list order.
+func (ims *InMemoryStorage) GetReadingList(ctx context.Context, userID int, name string) (*data.ReadingList, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if _, err := ims.users.list(userID, name); err != nil {
+		return nil, err
+	}
+	return ims.users.readingList(userID, name, ims.inTrash), nil
+}
+
+// AddListEntry appends a book to the end of a reading list.
+func (ims *InMemoryStorage) AddListEntry(ctx context.Context, userID int, name string, entry data.ListEntry) (*data.ReadingList, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	entries, err := ims.users.list(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ims.get(entry.BookID); err != nil {
+		return nil, err
+	}
+	for _, existing := range entries {
+		if existing.BookID == entry.BookID {
+			return nil, fmt.Errorf("%w: book id %v", ErrDuplicateEntry, entry.BookID)
+		}
+	}
+	entry.AddedAt = time.Now().UTC()
+	ims.users.lists[userID][name] = append(entries, entry)
+	return ims.users.readingList(userID, name, ims.inTrash), nil
+}
+
+// RemoveListEntry removes a book from a reading list. The following entries move up by one.
+func (ims *InMemoryStorage) RemoveListEntry(ctx context.Context, userID int, name string, bookID int) (*data.ReadingList, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	entries, err := ims.users.list(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.BookID == bookID {
+			ims.users.lists[userID][name] = append(entries[:i:i], entries[i+1:]...)
+			return ims.users.readingList(userID, name, ims.inTrash), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: book id %v is not on the %v list", ErrNotFound, bookID, name)
+}
+
+// ReorderList puts the entries of a reading list into the given order of book IDs.
+// Entries of books in the trash are not part of the order, they keep their order behind all others.
+func (ims *InMemoryStorage) ReorderList(ctx context.Context, userID int, name string, bookIDs []int) (*data.ReadingList, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	entries, err := ims.users.list(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if !isPermutation(ims.users.readingList(userID, name, ims.inTrash).Entries, bookIDs) {
+		return nil, ErrInvalidOrder
+	}
+	byBook := make(map[int]data.ListEntry, len(entries))
+	for _, entry := range entries {
+		byBook[entry.BookID] = entry
+	}
+	reordered := make([]data.ListEntry, 0, len(entries))
+	for _, bookID := range bookIDs {
+		reordered = append(reordered, byBook[bookID])
+	}
+	for _, entry := range entries {
+		if ims.inTrash(entry.BookID) {
+			reordered = append(reordered, entry)
+		}
+	}
+	ims.users.lists[userID][name] = reordered
+	return ims.users.readingList(userID, name, ims.inTrash), nil
+}
+
+// SetListProgress updates how much of a book on a reading list the user has read.
+func (ims *InMemoryStorage) SetListProgress(ctx context.Context, userID int, name string, bookID int, progress int) (*data.ReadingList, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	entries, err := ims.users.list(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].BookID == bookID {
+			entries[i].Progress = progress
+			return ims.users.readingList(userID, name, ims.inTrash), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: book id %v is not on the %v list", ErrNotFound, bookID, name)
+}
+
+// CreateUser creates a new user with empty reading lists.
+func (psql *PostgresqlStorage) CreateUser(ctx context.Context, u *data.User) (*data.User, error) {
+	query := `
+		INSERT INTO users(name)
+		VALUES ($1)
+		RETURNING id, name, created_at
+	`
+	var user data.User
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, query, u.Name).Scan(&user.ID, &user.Name, &user.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUser returns the user with the given ID.
+func (psql *PostgresqlStorage) GetUser(ctx context.Context, id int) (*data.User, error) {
+	query := `
+		SELECT id, name, created_at
+		FROM users
+		WHERE id = $1
+	`
+	var user data.User
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.databaseConnection.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Name, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("user id %v %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// lockUser locks the row of a user for the rest of the transaction, which serializes all changes to the user's reading lists.
+func lockUser(ctx context.Context, tx *sql.Tx, userID int, name string) error {
+	query := `
+		SELECT id
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`
+	if !data.IsReadingList(name) {
+		return fmt.Errorf("%w: %v", ErrUnknownList, name)
+	}
+	var id int
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user id %v %w", userID, ErrNotFound)
+	}
+	return err
+}
+
+// readingList reads a reading list in list order, leaving out the entries of books in the trash.
+// Positions are numbered from the order, so gaps left by removed or hidden entries do not show.
+func readingList(ctx context.Context, q queryer, userID int, name string) (*data.ReadingList, error) {
+	query := `
+		SELECT e.book_id, e.progress, e.added_at
+		FROM list_entries e
+		JOIN books b ON b.id = e.book_id
+		WHERE e.user_id = $1 AND e.list_name = $2 AND b.deleted_at IS NULL
+		ORDER BY e.position, e.added_at
+	`
+	rows, err := q.QueryContext(ctx, query, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := &data.ReadingList{
+		UserID:  userID,
+		Name:    name,
+		Entries: make([]data.ListEntry, 0),
+	}
+	for rows.Next() {
+		entry := data.ListEntry{Position: len(list.Entries)}
+		if err := rows.Scan(&entry.BookID, &entry.Progress, &entry.AddedAt); err != nil {
+			return nil, err
+		}
+		list.Entries = append(list.Entries, entry)
+	}
+	return list, rows.Err()
+}
+
+// changeReadingList locks the user, applies a change to one of their reading lists and returns the list afterwards.
+func (psql *PostgresqlStorage) changeReadingList(ctx context.Context, userID int, name string, change func(context.Context, *sql.Tx) error) (*data.ReadingList, error) {
+	var list *data.ReadingList
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		if err := lockUser(ctx, tx, userID, name); err != nil {
+			return err
+		}
+		if err := change(ctx, tx); err != nil {
+			return err
+		}
+		var err error
+		list, err = readingList(ctx, tx, userID, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetReadingList returns a reading list of a user in list order. It neither locks the user nor opens a transaction,
+// so reads do not wait for changes to the lists.
+func (psql *PostgresqlStorage) GetReadingList(ctx context.Context, userID int, name string) (*data.ReadingList, error) {
+	if !data.IsReadingList(name) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownList, name)
+	}
+	if _, err := psql.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return readingList(ctx, psql.databaseConnection, userID, name)
+}
+
+// AddListEntry appends a book to the end of a reading list.
+func (psql *PostgresqlStorage) AddListEntry(ctx context.Context, userID int, name string, entry data.ListEntry) (*data.ReadingList, error) {
+	query := `
+		INSERT INTO list_entries(user_id, list_name, book_id, position, progress)
+		SELECT $1, $2, $3, COALESCE(MAX(position) + 1, 0), $4
+		FROM list_entries
+		WHERE user_id = $1 AND list_name = $2
+		ON CONFLICT DO NOTHING
+	`
+	return psql.changeReadingList(ctx, userID, name, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := scanBook(tx.QueryRowContext(ctx, `SELECT `+bookColumns+` FROM books WHERE id = $1 AND deleted_at IS NULL`, entry.BookID)); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, query, userID, name, entry.BookID, entry.Progress)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return fmt.Errorf("%w: book id %v", ErrDuplicateEntry, entry.BookID)
+		}
+		return nil
+	})
+}
+
+// RemoveListEntry removes a book from a reading list. The following entries move up by one.
+func (psql *PostgresqlStorage) RemoveListEntry(ctx context.Context, userID int, name string, bookID int) (*data.ReadingList, error) {
+	query := `
+		DELETE FROM list_entries
+		WHERE user_id = $1 AND list_name = $2 AND book_id = $3
+	`
+	return psql.changeReadingList(ctx, userID, name, func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, query, userID, name, bookID)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return fmt.Errorf("%w: book id %v is not on the %v list", ErrNotFound, bookID, name)
+		}
+		return nil
+	})
+}
+
+// ReorderList puts the entries of a reading list into the given order of book IDs.
+// Entries of books in the trash are not part of the order, they keep their former positions.
+func (psql *PostgresqlStorage) ReorderList(ctx context.Context, userID int, name string, bookIDs []int) (*data.ReadingList, error) {
+	query := `
+		UPDATE list_entries e
+		SET position = o.position - 1
+		FROM unnest($3::INTEGER[]) WITH ORDINALITY AS o(book_id, position)
+		WHERE e.user_id = $1 AND e.list_name = $2 AND e.book_id = o.book_id
+	`
+	return psql.changeReadingList(ctx, userID, name, func(ctx context.Context, tx *sql.Tx) error {
+		current, err := readingList(ctx, tx, userID, name)
+		if err != nil {
+			return err
+		}
+		if !isPermutation(current.Entries, bookIDs) {
+			return ErrInvalidOrder
+		}
+		ids := make([]int64, 0, len(bookIDs))
+		for _, id := range bookIDs {
+			ids = append(ids, int64(id))
+		}
+		_, err = tx.ExecContext(ctx, query, userID, name, pq.Array(ids))
+		return err
+	})
+}
+
+// SetListProgress updates how much of a book on a reading list the user has read.
+func (psql *PostgresqlStorage) SetListProgress(ctx context.Context, userID int, name string, bookID int, progress int) (*data.ReadingList, error) {
+	query := `
+		UPDATE list_entries
+		SET progress = $4
+		WHERE user_id = $1 AND list_name = $2 AND book_id = $3
+	`
+	return psql.changeReadingList(ctx, userID, name, func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, query, userID, name, bookID, progress)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return fmt.Errorf("%w: book id %v is not on the %v list", ErrNotFound, bookID, name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/torbendury/books-go/data"
+)
+
+// ErrVersionConflict is returned when a book is changed based on a version which is not the current one anymore.
+var ErrVersionConflict = errors.New("book has been changed in the meantime")
+
+// VersionStorage is implemented by every storage which keeps a full snapshot of every revision of a book.
+// Versions are written by Create, Update and Revert together with the change itself, using the actor of their context.
+// Like all other reads, the versions of books in the trash are hidden.
+type VersionStorage interface {
+	Versions(ctx context.Context, bookID int, page int, size int) (*data.BookVersionPage, error)
+	Version(ctx context.Context, bookID int, version int) (*data.BookVersion, error)
+	GetAsOf(ctx context.Context, bookID int, at time.Time) (*data.Book, error)
+	Revert(ctx context.Context, bookID int, version int, expected int) (*data.Book, error)
+}
+
+// newBookVersion takes a snapshot of a book as it was just written.
+func newBookVersion(ctx context.Context, b *data.Book) data.BookVersion {
+	book := *b
+	book.Rating = nil
+	book.DeletedAt = nil
+	return data.BookVersion{
+		Version:   b.Version,
+		CreatedAt: time.Now().UTC(),
+		Actor:     ActorFrom(ctx),
+		Book:      book,
+	}
+}
+
+// snapshot stores the given book as a new version. The caller must hold the lock.
+func (ims *InMemoryStorage) snapshot(ctx context.Context, b *data.Book) {
+	ims.versions[b.ID] = append(ims.versions[b.ID], newBookVersion(ctx, b))
+}
+
+// Versions returns a page of the versions of a book, newest first. Pages start at 1.
+func (ims *InMemoryStorage) Versions(ctx context.Context, bookID int, page int, size int) (*data.BookVersionPage, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	versions := ims.versions[bookID]
+	result := &data.BookVersionPage{
+		Versions: make([]data.BookVersion, 0, size),
+		Page:     page,
+		Size:     size,
+		Total:    len(versions),
+	}
+	for i := len(versions) - 1 - pageOffset(page, size); i >= 0 && len(result.Versions) < size; i-- {
+		result.Versions = append(result.Versions, versions[i])
+	}
+	return result, nil
+}
+
+// Version returns a single version of a book.
+func (ims *InMemoryStorage) Version(ctx context.Context, bookID int, version int) (*data.BookVersion, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	return ims.version(bookID, version)
+}
+
+// version is the lock-free implementation of Version. The caller must hold the lock.
+func (ims *InMemoryStorage) version(bookID int, version int) (*data.BookVersion, error) {
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	for _, v := range ims.versions[bookID] {
+		if v.Version == version {
+			return &v, nil
+		}
+	}
+	return nil, fmt.Errorf("version %v of book id %v %w", version, bookID, ErrNotFound)
+}
+
+// GetAsOf returns a book as it was at the given time, i.e. its latest version which was written up to then.
+func (ims *InMemoryStorage) GetAsOf(ctx context.Context, bookID int, at time.Time) (*data.Book, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if ims.indexOf(bookID) < 0 {
+		return nil, fmt.Errorf("book id %v %w", bookID, ErrNotFound)
+	}
+	versions := ims.versions[bookID]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].CreatedAt.After(at) {
+			book := versions[i].Book
+			return &book, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: book id %v did not exist at %v", ErrNotFound, bookID, at.Format(time.RFC3339))
+}
+
+// Revert writes the given version of a book as its new current version. Like any other update, it fails with ErrVersionConflict
+// if expected is not the current version of the book. An expected version of 0 reverts unconditionally.
+func (ims *InMemoryStorage) Revert(ctx context.Context, bookID int, version int, expected int) (*data.Book, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	v, err := ims.version(bookID, version)
+	if err != nil {
+		return nil, err
+	}
+	book := v.Book
+	book.Version = expected
+	return ims.update(ctx, &book)
+}
+
+// insertBookVersion stores the given book as a new version within the transaction which wrote it.
+func insertBookVersion(ctx context.Context, tx *sql.Tx, b *data.Book) error {
+	query := `
+		INSERT INTO book_versions(book_id, version, actor, title, description, price, publisher)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := tx.ExecContext(ctx, query, b.ID, b.Version, ActorFrom(ctx), b.Title, b.Description, b.Price, b.Publisher)
+	return err
+}
+
+// versionColumns are the columns which make up a data.BookVersion, see scanBookVersion.
+const versionColumns = "v.version, v.created_at, v.actor, v.book_id, v.title, v.description, v.price, v.publisher"
+
+// scanBookVersion reads a version from a row which consists of versionColumns.
+func scanBookVersion(row rowScanner) (*data.BookVersion, error) {
+	var v data.BookVersion
+	err := row.Scan(&v.Version, &v.CreatedAt, &v.Actor, &v.Book.ID, &v.Book.Title, &v.Book.Description, &v.Book.Price, &v.Book.Publisher)
+	if err != nil {
+		return nil, err
+	}
+	v.Book.Version = v.Version
+	return &v, nil
+}
+
+// Versions returns a page of the versions of a book, newest first. Pages start at 1.
+func (psql *PostgresqlStorage) Versions(ctx context.Context, bookID int, page int, size int) (*data.BookVersionPage, error) {
+	countQuery := `
+		SELECT version
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	query := `
+		SELECT ` + versionColumns + `
+		FROM book_versions v
+		WHERE v.book_id = $1
+		ORDER BY v.version DESC
+		LIMIT $2 OFFSET $3
+	`
+	result := &data.BookVersionPage{
+		Versions: make([]data.BookVersion, 0, size),
+		Page:     page,
+		Size:     size,
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	// versions are never removed while the book exists, so the current version is their number
+	if err := psql.databaseConnection.QueryRowContext(ctx, countQuery, bookID).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, bookID, size, pageOffset(page, size))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v, err := scanBookVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Versions = append(result.Versions, *v)
+	}
+	return result, rows.Err()
+}
+
+// Version returns a single version of a book.
+func (psql *PostgresqlStorage) Version(ctx context.Context, bookID int, version int) (*data.BookVersion, error) {
+	query := `
+		SELECT ` + versionColumns + `
+		FROM book_versions v
+		JOIN books b ON b.id = v.book_id
+		WHERE v.book_id = $1 AND v.version = $2 AND b.deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanBookVersion(psql.databaseConnection.QueryRowContext(ctx, query, bookID, version))
+}
+
+// GetAsOf returns a book as it was at the given time, i.e. its latest version which was written up to then.
+func (psql *PostgresqlStorage) GetAsOf(ctx context.Context, bookID int, at time.Time) (*data.Book, error) {
+	query := `
+		SELECT ` + versionColumns + `
+		FROM book_versions v
+		JOIN books b ON b.id = v.book_id
+		WHERE v.book_id = $1 AND v.created_at <= $2 AND b.deleted_at IS NULL
+		ORDER BY v.version DESC
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	v, err := scanBookVersion(psql.databaseConnection.QueryRowContext(ctx, query, bookID, at))
+	if err != nil {
+		return nil, err
+	}
+	return &v.Book, nil
+}
+
+// Revert writes the given version of a book as its new current version. Like any other update, it fails with ErrVersionConflict
+// if expected is not the current version of the book. An expected version of 0 reverts unconditionally.
+func (psql *PostgresqlStorage) Revert(ctx context.Context, bookID int, version int, expected int) (*data.Book, error) {
+	query := `
+		SELECT ` + versionColumns + `
+		FROM book_versions v
+		WHERE v.book_id = $1 AND v.version = $2
+	`
+	var resultBook *data.Book
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := psql.withTransaction(ctx, func(tx *sql.Tx) error {
+		v, err := scanBookVersion(tx.QueryRowContext(ctx, query, bookID, version))
+		if err != nil {
+			return err
+		}
+		v.Book.Version = expected
+		resultBook, err = updateBook(ctx, tx, &v.Book)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	psql.updateTitleTrie(func(t *titleTrie) { t.add(resultBook.ID, resultBook.Title) })
+	psql.notifyOutbox()
+	return resultBook, nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// viewFlushTimeout bounds how long the view flusher keeps flushing once it has been stopped, see RunViewFlusher.
+const viewFlushTimeout = 5 * time.Second
+
+// RecordView counts a view of the book with the given ID, which is used as popularity signal for suggestions.
+// Views are only counted in-process, so reading a book never writes to the database. They are added to the books in batches, see RunViewFlusher.
+func (psql *PostgresqlStorage) RecordView(ctx context.Context, id int) error {
+	psql.viewMutex.Lock()
+	psql.views[id]++
+	psql.viewMutex.Unlock()
+	psql.updateTitleTrie(func(t *titleTrie) { t.recordView(id) })
+	return nil
+}
+
+// RunViewFlusher adds the views counted by RecordView to the books in the database every interval, until the context is done.
+// Then the views are flushed one last time, so they are not lost on shutdown. Failures are passed to report.
+func (psql *PostgresqlStorage) RunViewFlusher(ctx context.Context, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), viewFlushTimeout)
+			defer cancel()
+			if err := psql.flushViews(flushCtx); err != nil {
+				report(fmt.Errorf("flushing views: %w", err))
+			}
+			return
+		case <-ticker.C:
+			if err := psql.flushViews(ctx); err != nil {
+				report(fmt.Errorf("flushing views: %w", err))
+			}
+		}
+	}
+}
+
+// flushViews adds all counted views to their books with a single statement. If it fails, the views are counted again for the next flush.
+func (psql *PostgresqlStorage) flushViews(ctx context.Context) error {
+	query := `
+		UPDATE books
+		SET views = books.views + counted.views
+		FROM unnest($1::bigint[], $2::bigint[]) AS counted(id, views)
+		WHERE books.id = counted.id
+	`
+	psql.viewMutex.Lock()
+	views := psql.views
+	psql.views = make(map[int]int64)
+	psql.viewMutex.Unlock()
+	if len(views) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(views))
+	counts := make([]int64, 0, len(views))
+	for id, count := range views {
+		ids = append(ids, int64(id))
+		counts = append(counts, count)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if _, err := psql.databaseConnection.ExecContext(ctx, query, pq.Array(ids), pq.Array(counts)); err != nil {
+		psql.viewMutex.Lock()
+		for id, count := range views {
+			psql.views[id] += count
+		}
+		psql.viewMutex.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/torbendury/books-go/data"
+)
+
+// WebhookStorage is implemented by every storage which keeps webhooks and the log of their deliveries.
+// Deliveries are claimed for a lease before they are attempted, so several servers can deliver from the same storage without sending twice.
+// Deleting a webhook deletes its deliveries as well.
+type WebhookStorage interface {
+	CreateWebhook(ctx context.Context, hook *data.Webhook) (*data.Webhook, error)
+	GetWebhook(ctx context.Context, id int) (*data.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]data.Webhook, error)
+	DeleteWebhook(ctx context.Context, id int) error
+
+	CreateDelivery(ctx context.Context, delivery *data.WebhookDelivery) (*data.WebhookDelivery, error)
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]data.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *data.WebhookDelivery) error
+	Deliveries(ctx context.Context, webhookID int, page int, size int) (*data.WebhookDeliveryPage, error)
+}
+
+// copyWebhook returns a deep copy of a webhook, so callers can not modify the stored event types.
+func copyWebhook(h *data.Webhook) *data.Webhook {
+	result := *h
+	result.Events = append([]string(nil), h.Events...)
+	return &result
+}
+
+// CreateWebhook stores a new webhook.
+func (ims *InMemoryStorage) CreateWebhook(ctx context.Context, h *data.Webhook) (*data.Webhook, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	ims.webhookSerial++
+	hook := copyWebhook(h)
+	hook.ID = ims.webhookSerial
+	hook.CreatedAt = time.Now().UTC()
+	ims.webhooks[hook.ID] = hook
+	return copyWebhook(hook), nil
+}
+
+// GetWebhook returns the webhook with the given ID, including its secret.
+func (ims *InMemoryStorage) GetWebhook(ctx context.Context, id int) (*data.Webhook, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	hook, ok := ims.webhooks[id]
+	if !ok {
+		return nil, fmt.Errorf("webhook id %v %w", id, ErrNotFound)
+	}
+	return copyWebhook(hook), nil
+}
+
+// ListWebhooks returns all webhooks ordered by ID.
+func (ims *InMemoryStorage) ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	hooks := make([]data.Webhook, 0, len(ims.webhooks))
+	for id := 1; id <= ims.webhookSerial; id++ {
+		if hook, ok := ims.webhooks[id]; ok {
+			hooks = append(hooks, *copyWebhook(hook))
+		}
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook deletes a webhook together with its deliveries.
+func (ims *InMemoryStorage) DeleteWebhook(ctx context.Context, id int) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if _, ok := ims.webhooks[id]; !ok {
+		return fmt.Errorf("webhook id %v %w", id, ErrNotFound)
+	}
+	delete(ims.webhooks, id)
+	for deliveryID, delivery := range ims.deliveries {
+		if delivery.WebhookID == id {
+			delete(ims.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+// CreateDelivery adds a pending delivery to the log, which is due immediately.
+func (ims *InMemoryStorage) CreateDelivery(ctx context.Context, d *data.WebhookDelivery) (*data.WebhookDelivery, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if _, ok := ims.webhooks[d.WebhookID]; !ok {
+		return nil, fmt.Errorf("webhook id %v %w", d.WebhookID, ErrNotFound)
+	}
+	ims.deliverySerial++
+	delivery := *d
+	now := time.Now().UTC()
+	delivery.ID = ims.deliverySerial
+	delivery.Status = data.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = now
+	delivery.CreatedAt = now
+	delivery.UpdatedAt = now
+	ims.deliveries[delivery.ID] = &delivery
+	result := delivery
+	return &result, nil
+}
+
+// ClaimDeliveries returns up to limit pending deliveries which are due, oldest first, and postpones them by the lease.
+// If a claimed delivery is not updated before the lease ends, it is handed out again.
+func (ims *InMemoryStorage) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]data.WebhookDelivery, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	claimed := make([]data.WebhookDelivery, 0, limit)
+	for id := 1; id <= ims.deliverySerial && len(claimed) < limit; id++ {
+		delivery, ok := ims.deliveries[id]
+		if !ok || delivery.Status != data.DeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		delivery.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, *delivery)
+	}
+	return claimed, nil
+}
+
+// UpdateDelivery records the outcome of an attempt to deliver.
+func (ims *InMemoryStorage) UpdateDelivery(ctx context.Context, d *data.WebhookDelivery) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	delivery, ok := ims.deliveries[d.ID]
+	if !ok {
+		return fmt.Errorf("delivery id %v %w", d.ID, ErrNotFound)
+	}
+	delivery.Status = d.Status
+	delivery.Attempts = d.Attempts
+	delivery.LastStatusCode = d.LastStatusCode
+	delivery.LastError = d.LastError
+	delivery.NextAttemptAt = d.NextAttemptAt
+	delivery.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// Deliveries returns a page of the deliveries of a webhook, newest first. Pages start at 1.
+func (ims *InMemoryStorage) Deliveries(ctx context.Context, webhookID int, page int, size int) (*data.WebhookDeliveryPage, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+	if _, ok := ims.webhooks[webhookID]; !ok {
+		return nil, fmt.Errorf("webhook id %v %w", webhookID, ErrNotFound)
+	}
+	result := &data.WebhookDeliveryPage{
+		Deliveries: make([]data.WebhookDelivery, 0, size),
+		Page:       page,
+		Size:       size,
+	}
+	skip := pageOffset(page, size)
+	for id := ims.deliverySerial; id > 0; id-- {
+		delivery, ok := ims.deliveries[id]
+		if !ok || delivery.WebhookID != webhookID {
+			continue
+		}
+		result.Total++
+		if result.Total > skip && len(result.Deliveries) < size {
+			result.Deliveries = append(result.Deliveries, *delivery)
+		}
+	}
+	return result, nil
+}
+
+// webhookColumns are the columns of the webhooks table which make up a data.Webhook, in the order expected by scanWebhook.
+const webhookColumns = "id, url, events, secret, created_at"
+
+// scanWebhook scans a row of webhookColumns into a webhook.
+func scanWebhook(row rowScanner) (*data.Webhook, error) {
+	var hook data.Webhook
+	if err := row.Scan(&hook.ID, &hook.URL, pq.Array(&hook.Events), &hook.Secret, &hook.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// deliveryColumns are the columns of the webhook_deliveries table which make up a data.WebhookDelivery, in the order expected by scanDelivery.
+const deliveryColumns = "id, webhook_id, event_type, payload, status, attempts, last_status_code, last_error, next_attempt_at, created_at, updated_at"
+
+// scanDelivery scans a row of deliveryColumns into a delivery.
+func scanDelivery(row rowScanner) (*data.WebhookDelivery, error) {
+	var d data.WebhookDelivery
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// CreateWebhook stores a new webhook.
+func (psql *PostgresqlStorage) CreateWebhook(ctx context.Context, h *data.Webhook) (*data.Webhook, error) {
+	query := `
+		INSERT INTO webhooks(url, events, secret)
+		VALUES ($1, $2, $3)
+		RETURNING ` + webhookColumns
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanWebhook(psql.databaseConnection.QueryRowContext(ctx, query, h.URL, pq.Array(h.Events), h.Secret))
+}
+
+// GetWebhook returns the webhook with the given ID, including its secret.
+func (psql *PostgresqlStorage) GetWebhook(ctx context.Context, id int) (*data.Webhook, error) {
+	query := `
+		SELECT ` + webhookColumns + `
+		FROM webhooks
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanWebhook(psql.databaseConnection.QueryRowContext(ctx, query, id))
+}
+
+// ListWebhooks returns all webhooks ordered by ID.
+func (psql *PostgresqlStorage) ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	query := `
+		SELECT ` + webhookColumns + `
+		FROM webhooks
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := make([]data.Webhook, 0)
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook deletes a webhook. Its deliveries are deleted by the database.
+func (psql *PostgresqlStorage) DeleteWebhook(ctx context.Context, id int) error {
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+		RETURNING id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return psql.databaseConnection.QueryRowContext(ctx, query, id).Scan(&id)
+}
+
+// CreateDelivery adds a pending delivery to the log, which is due immediately.
+func (psql *PostgresqlStorage) CreateDelivery(ctx context.Context, d *data.WebhookDelivery) (*data.WebhookDelivery, error) {
+	query := `
+		INSERT INTO webhook_deliveries(webhook_id, event_type, payload)
+		VALUES ($1, $2, $3)
+		RETURNING ` + deliveryColumns
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return scanDelivery(psql.databaseConnection.QueryRowContext(ctx, query, d.WebhookID, d.EventType, []byte(d.Payload)))
+}
+
+// ClaimDeliveries returns up to limit pending deliveries which are due, oldest first, and postpones them by the lease.
+// Rows which are being claimed by another server are skipped. If a claimed delivery is not updated before the lease ends, it is handed out again.
+func (psql *PostgresqlStorage) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]data.WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + deliveryColumns
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	claimed := make([]data.WebhookDelivery, 0, limit)
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, *delivery)
+	}
+	return claimed, rows.Err()
+}
+
+// UpdateDelivery records the outcome of an attempt to deliver.
+func (psql *PostgresqlStorage) UpdateDelivery(ctx context.Context, d *data.WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = $6, updated_at = now()
+		WHERE id = $1
+		RETURNING id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	var id int
+	return psql.databaseConnection.QueryRowContext(ctx, query, d.ID, d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.NextAttemptAt).Scan(&id)
+}
+
+// Deliveries returns a page of the deliveries of a webhook, newest first. Pages start at 1.
+func (psql *PostgresqlStorage) Deliveries(ctx context.Context, webhookID int, page int, size int) (*data.WebhookDeliveryPage, error) {
+	countQuery := `
+		SELECT COUNT(d.id)
+		FROM webhooks w
+		LEFT JOIN webhook_deliveries d ON d.webhook_id = w.id
+		WHERE w.id = $1
+		GROUP BY w.id
+	`
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+	result := &data.WebhookDeliveryPage{
+		Deliveries: make([]data.WebhookDelivery, 0, size),
+		Page:       page,
+		Size:       size,
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := psql.databaseConnection.QueryRowContext(ctx, countQuery, webhookID).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	rows, err := psql.databaseConnection.QueryContext(ctx, query, webhookID, size, pageOffset(page, size))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Deliveries = append(result.Deliveries, *delivery)
+	}
+	return result, rows.Err()
+}
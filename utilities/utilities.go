@@ -1,2 +1,38 @@
-// Package utilities is not used at the moment.
+// Package utilities contains small helpers which are shared across packages but do not belong to any of them.
 package utilities
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Fold returns a case and diacritic insensitive representation of the given text, e.g. "Crème Brûlée" becomes "creme brulee".
+// It is meant for comparisons and lookups, not for displaying text to users.
+func Fold(text string) string {
+	folder := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(folder, text)
+	if err != nil {
+		folded = text
+	}
+	return strings.ToLower(folded)
+}
+
+// Backoff returns the delay before the next attempt after the given number of failed attempts. The delay starts at the base delay, doubles with
+// every further failure up to the maximum delay, and a random half of it is added as jitter, so clients which fail together do not all retry at once.
+func Backoff(baseDelay time.Duration, maxDelay time.Duration, attempts int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}